@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+)
+
+const configFileExt = ".conf"
+
+// account is one configured Gmail account, with its own connection.
+// Caches, labels, and contacts live in the connection, so are per account.
+type account struct {
+	name      string
+	fn        string
+	conn      *cmdg.CmdG
+	signature string
+}
+
+var (
+	accountsMu sync.Mutex
+	accounts   = make(map[string]*account)
+)
+
+// accountName returns the account name for a config file. E.g. ~/.cmdg/work.conf is "work".
+func accountName(fn string) string {
+	return strings.TrimSuffix(path.Base(fn), configFileExt)
+}
+
+// accountConfigPath returns the config file for a named account.
+func accountConfigPath(name string) string {
+	return path.Join(os.Getenv("HOME"), defaultConfigDir, name+configFileExt)
+}
+
+// listAccounts returns the names of all configured accounts, plus any already connected.
+func listAccounts() ([]string, error) {
+	fns, err := filepath.Glob(path.Join(os.Getenv("HOME"), defaultConfigDir, "*"+configFileExt))
+	if err != nil {
+		return nil, errors.Wrap(err, "listing config files")
+	}
+	seen := make(map[string]bool)
+	var ret []string
+	for _, fn := range fns {
+		n := accountName(fn)
+		seen[n] = true
+		ret = append(ret, n)
+	}
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	for n := range accounts {
+		if !seen[n] {
+			ret = append(ret, n)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (a *account) loadSignature(ctx context.Context) error {
+	if a.conn.ReadOnly() {
+		// No appdata scope.
+		return nil
+	}
+	b, err := a.conn.GetFile(ctx, signatureFilename)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	a.signature = string(b)
+	return nil
+}
+
+// accountSignature returns the signature of the account using conn.
+func accountSignature(conn *cmdg.CmdG) string {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	for _, a := range accounts {
+		if a.conn == conn {
+			return a.signature
+		}
+	}
+	return ""
+}
+
+// connectAccount connects to the account configured in `fn`, loads
+// everything needed to show it, and starts its background reloading.
+func connectAccount(ctx context.Context, fn string) (*account, error) {
+	c, err := cmdg.New(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting")
+	}
+	a := &account{
+		name: accountName(fn),
+		fn:   fn,
+		conn: c,
+	}
+	log.Infof("Connected account %q", a.name)
+	addAddressBooks(c)
+
+	if err := c.SyncCache(ctx); err != nil {
+		log.Errorf("Failed to sync message cache for %q: %v", a.name, err)
+	}
+
+	// Send anything left over from last time, and anything that fails from now on.
+	go c.RunJournal(ctx)
+
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	var errs []error
+	addErr := func(err error) {
+		m.Lock()
+		defer m.Unlock()
+		errs = append(errs, err)
+	}
+	wg.Add(5)
+	go func() {
+		defer wg.Done()
+		if err := a.loadSignature(ctx); err != nil {
+			addErr(errors.Wrap(err, "loading signature from Drive appdata"))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := c.LoadLabels(ctx); err != nil {
+			addErr(errors.Wrap(err, "loading labels"))
+			return
+		}
+		log.Infof("Labels loaded for %q", a.name)
+	}()
+	go func() {
+		defer wg.Done()
+		if err := c.LoadContacts(ctx); err != nil {
+			addErr(errors.Wrap(err, "loading contacts"))
+			return
+		}
+		log.Infof("Contacts loaded for %q", a.name)
+	}()
+	go func() {
+		defer wg.Done()
+		// Not fatal. Without it we just can't choose From address.
+		if err := c.LoadSendAs(ctx); err != nil {
+			log.Errorf("Loading send-as identities for %q: %v", a.name, err)
+			return
+		}
+		log.Infof("Send-as identities loaded for %q", a.name)
+	}()
+	go func() {
+		defer wg.Done()
+		// Only used for the status line.
+		if _, err := c.GetVacation(ctx); err != nil {
+			log.Errorf("Loading vacation settings for %q: %v", a.name, err)
+		}
+	}()
+	wg.Wait()
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	// First run this can take a while, so don't wait for it.
+	go func() {
+		if err := c.LoadRecipients(ctx); err != nil {
+			log.Errorf("Loading recipients for %q: %v", a.name, err)
+		}
+	}()
+	go a.reloadLoop(ctx)
+
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	accounts[a.name] = a
+	return a, nil
+}
+
+// reloadLoop periodically reloads labels, contacts, and settings, and syncs the message cache.
+func (a *account) reloadLoop(ctx context.Context) {
+	ch := time.Tick(labelReloadTime)
+	for {
+		<-ch
+		if err := a.conn.LoadLabels(ctx); err != nil {
+			log.Errorf("Loading labels for %q: %v", a.name, err)
+		} else {
+			log.Infof("Reloaded labels for %q", a.name)
+		}
+		if err := a.conn.LoadContacts(ctx); err != nil {
+			log.Errorf("Loading contacts for %q: %v", a.name, err)
+		} else {
+			log.Infof("Reloaded contacts for %q", a.name)
+		}
+		if err := a.conn.LoadSendAs(ctx); err != nil {
+			log.Errorf("Loading send-as identities for %q: %v", a.name, err)
+		}
+		if err := a.conn.LoadRecipients(ctx); err != nil {
+			log.Errorf("Loading recipients for %q: %v", a.name, err)
+		}
+		if _, err := a.conn.GetVacation(ctx); err != nil {
+			log.Errorf("Loading vacation settings for %q: %v", a.name, err)
+		}
+		if err := a.conn.SyncCache(ctx); err != nil {
+			log.Errorf("Syncing message cache for %q: %v", a.name, err)
+		}
+	}
+}
+
+// accountStatus returns the account name to show in status lines, or empty
+// if there's only the default account and so nothing interesting to say.
+func accountStatus(a *account) string {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	if a == nil {
+		return ""
+	}
+	if len(accounts) == 1 && a.name == accountName(configFileName) {
+		return ""
+	}
+	return a.name
+}
+
+// switchAccount returns the named account, connecting to it if needed.
+// Views hold on to their account, so the old one keeps working for
+// anything still running in the background.
+func switchAccount(ctx context.Context, name string) (*account, error) {
+	accountsMu.Lock()
+	a, found := accounts[name]
+	accountsMu.Unlock()
+	if !found {
+		var err error
+		a, err = connectAccount(ctx, accountConfigPath(name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "connecting to account %q", name)
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+)
+
+var (
+	backupDir = flag.String("backup", "", "Update a Maildir backup of the whole mailbox in this directory, then exit. Safe to run from cron.")
+)
+
+// runBackup updates the backup without starting the UI.
+func runBackup(ctx context.Context) error {
+	c, err := connectBatch()
+	if err != nil {
+		return err
+	}
+	res, err := c.Backup(ctx, *backupDir)
+	if res != nil {
+		how := "changes since last backup"
+		if res.Full {
+			how = "all messages listed"
+		}
+		fmt.Printf("Backup %s: %d added, %d updated, %d deleted (%s)\n", *backupDir, res.Added, res.Updated, res.Deleted, how)
+	}
+	return err
+}
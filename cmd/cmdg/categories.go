@@ -0,0 +1,56 @@
+package main
+
+// category is one of the GMail inbox tabs.
+type category struct {
+	name    string
+	query   string
+	labelID string
+}
+
+// Inbox tabs, in the order Tab cycles through them. After the last
+// one comes the whole inbox again.
+var categories = []*category{
+	{name: "Primary", query: "category:primary", labelID: "CATEGORY_PERSONAL"},
+	{name: "Social", query: "category:social", labelID: "CATEGORY_SOCIAL"},
+	{name: "Promotions", query: "category:promotions", labelID: "CATEGORY_PROMOTIONS"},
+	{name: "Updates", query: "category:updates", labelID: "CATEGORY_UPDATES"},
+	{name: "Forums", query: "category:forums", labelID: "CATEGORY_FORUMS"},
+}
+
+// nextCategory returns the tab after cur, or nil for the whole inbox.
+func nextCategory(cur *category) *category {
+	if cur == nil {
+		return categories[0]
+	}
+	for n, c := range categories {
+		if c == cur && n+1 < len(categories) {
+			return categories[n+1]
+		}
+	}
+	return nil
+}
+
+// inCategory returns true if a message with these labels belongs in
+// the tab. Everything belongs in the whole inbox.
+func inCategory(cat *category, labels []string) bool {
+	if cat == nil {
+		return true
+	}
+	for _, l := range labels {
+		if l == cat.labelID {
+			return true
+		}
+	}
+	return false
+}
+
+// joinQuery combines a search query with a category query.
+func joinQuery(q string, cat *category) string {
+	if cat == nil {
+		return q
+	}
+	if q == "" {
+		return cat.query
+	}
+	return q + " " + cat.query
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNextCategory(t *testing.T) {
+	var names []string
+	var cat *category
+	for {
+		cat = nextCategory(cat)
+		if cat == nil {
+			break
+		}
+		names = append(names, cat.name)
+		if len(names) > len(categories) {
+			t.Fatalf("Category tabs don't cycle back to inbox: %q", names)
+		}
+	}
+	if len(names) != len(categories) {
+		t.Errorf("Got tabs %q, want %d", names, len(categories))
+	}
+}
+
+func TestInCategory(t *testing.T) {
+	social := categories[1]
+	for _, test := range []struct {
+		cat    *category
+		labels []string
+		want   bool
+	}{
+		{nil, nil, true},
+		{nil, []string{"INBOX"}, true},
+		{social, []string{"INBOX", "CATEGORY_SOCIAL"}, true},
+		{social, []string{"INBOX", "CATEGORY_UPDATES"}, false},
+		{social, nil, false},
+	} {
+		if got := inCategory(test.cat, test.labels); got != test.want {
+			t.Errorf("inCategory(%v, %q) = %v, want %v", test.cat, test.labels, got, test.want)
+		}
+	}
+	if got, want := joinQuery("from:bob", social), "from:bob category:social"; got != want {
+		t.Errorf("Got query %q, want %q", got, want)
+	}
+	if got, want := joinQuery("", nil), ""; got != want {
+		t.Errorf("Got query %q, want %q", got, want)
+	}
+}
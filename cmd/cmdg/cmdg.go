@@ -32,13 +32,13 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"sync"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
 	"github.com/ThomasHabets/cmdg/pkg/display"
 	"github.com/ThomasHabets/cmdg/pkg/gpg"
 	"github.com/ThomasHabets/cmdg/pkg/input"
@@ -52,9 +52,12 @@ const (
 var (
 	license         = flag.Bool("license", false, "Show program license.")
 	cfgFile         = flag.String("config", "", "Config file. Default is ~/"+path.Join(defaultConfigDir, configFileName))
+	accountFlag     = flag.String("account", "", "Account to use, configured in ~/"+path.Join(defaultConfigDir, "<account>"+configFileExt)+".")
 	gpgFlag         = flag.String("gpg", "gpg", "Path to GnuPG.")
 	logFile         = flag.String("log", "/dev/null", "Log debug data to this file.")
 	configure       = flag.Bool("configure", false, "Configure OAuth.")
+	migrateSecret   = flag.Bool("migrate_secret", false, "Move the refresh token from the config file to the -secret_store.")
+	logout          = flag.Bool("logout", false, "Revoke the refresh token, and remove it from config and secret store.")
 	updateSignature = flag.Bool("update_signature", false, "Upload ~/.signature to app settings.")
 	verbose         = flag.Bool("verbose", false, "Turn on verbose logging.")
 	shell           = flag.String("shell", "/bin/sh", "Shell to shell out to.")
@@ -62,8 +65,6 @@ var (
 	lynx            = flag.String("lynx", "lynx", "HTML render binary.")
 	enableSign      = flag.Bool("sign", false, "Send signed emails by default.")
 
-	conn *cmdg.CmdG
-
 	// Relative to configDir.
 	configFileName = "cmdg.conf"
 
@@ -74,30 +75,32 @@ var (
 	visualBinary string
 
 	labelReloadTime = time.Minute
-
-	signature string
 )
 
 func configFilePath() string {
 	if *cfgFile != "" {
 		return *cfgFile
 	}
+	if *accountFlag != "" {
+		return accountConfigPath(*accountFlag)
+	}
 	return path.Join(os.Getenv("HOME"), defaultConfigDir, configFileName)
 }
 
-func loadSignature(ctx context.Context) error {
-	b, err := conn.GetFile(ctx, signatureFilename)
-	if err == os.ErrNotExist {
-		return nil
-	}
+// redirectLog sends logging to the -log file.
+func redirectLog() *os.File {
+	f, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		return err
+		log.Fatalf("Can't create logfile %q: %v", *logFile, err)
 	}
-	signature = string(b)
-	return nil
+	log.SetOutput(f)
+	log.SetFormatter(&log.TextFormatter{
+		DisableColors: true,
+	})
+	return f
 }
 
-func run(ctx context.Context) error {
+func run(ctx context.Context, a *account) error {
 	defer func() {
 		display.Exit()
 		fmt.Print(display.TerminalTitle("Terminal"))
@@ -109,7 +112,12 @@ func run(ctx context.Context) error {
 		return err
 	}
 
-	v := NewMessageView(ctx, "INBOX", "", keys)
+	// Terminal is in raw mode now, so ask for any passphrase in a dialog.
+	cmdg.Passphrase = func(prompt string) (string, error) {
+		return dialog.Password(prompt, keys)
+	}
+
+	v := NewMessageView(ctx, a, "INBOX", "", keys)
 
 	if err := v.Run(ctx); err != nil {
 		log.Errorf("Bailing due to error: %v", err)
@@ -133,6 +141,10 @@ func main() {
 		log.Fatalf("Trailing args on cmdline: %q", flag.Args())
 	}
 
+	if *cfgFile != "" && *accountFlag != "" {
+		log.Fatalf("-config and -account can't be used together.")
+	}
+
 	if *verbose {
 		log.SetLevel(log.DebugLevel)
 	}
@@ -154,8 +166,46 @@ func main() {
 		return
 	}
 
+	if *migrateSecret {
+		if err := cmdg.MigrateSecret(configFilePath()); err != nil {
+			log.Fatalf("Migrating refresh token: %v", err)
+		}
+		fmt.Printf("Refresh token moved out of %s\n", configFilePath())
+		return
+	}
+
+	if *logout {
+		if err := cmdg.Logout(configFilePath()); err != nil {
+			log.Fatalf("Logging out: %v", err)
+		}
+		fmt.Printf("Refresh token revoked and removed. Run with -configure to log in again.\n")
+		return
+	}
+
 	ctx := context.Background()
 
+	for _, batch := range []struct {
+		enabled bool
+		name    string
+		run     func(context.Context) error
+	}{
+		{*exportFile != "", "Exporting", runExport},
+		{*importFile != "", "Importing", runImport},
+		{*backupDir != "", "Backing up", runBackup},
+	} {
+		if !batch.enabled {
+			continue
+		}
+		f := redirectLog()
+		err := batch.run(ctx)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", batch.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	pagerBinary = os.Getenv("PAGER")
 	if len(pagerBinary) == 0 {
 		log.Fatalf("You need to set the PAGER environment variable. When in doubt, set to 'less'.")
@@ -171,8 +221,7 @@ func main() {
 
 	cmdg.GPG = gpg.New(*gpgFlag)
 
-	var err error
-	conn, err = cmdg.New(configFilePath())
+	a, err := connectAccount(ctx, configFilePath())
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
@@ -184,70 +233,17 @@ func main() {
 		if err != nil {
 			log.Fatalf("Reading %q: %v", p, err)
 		}
-		if err := conn.UpdateFile(ctx, signatureFilename, b); err != nil {
+		if err := a.conn.UpdateFile(ctx, signatureFilename, b); err != nil {
 			log.Fatalf("Uploading signature file: %v", err)
 		}
+		accountsMu.Lock()
+		a.signature = string(b)
+		accountsMu.Unlock()
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := loadSignature(ctx); err != nil {
-			log.Fatalf("Failed to load signature from Drive appdata: %v", err)
-		}
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := conn.LoadLabels(ctx); err != nil {
-			log.Fatalf("Loading labels: %v", err)
-		}
-		log.Infof("Labels loaded")
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := conn.LoadContacts(ctx); err != nil {
-			log.Fatalf("Loading contacts: %v", err)
-		}
-		log.Infof("Contacts loaded")
-	}()
-	wg.Wait()
-
-	go func() {
-		ch := time.Tick(labelReloadTime)
-		for {
-			<-ch
-			if err := conn.LoadLabels(ctx); err != nil {
-				log.Errorf("Loading labels: %v", err)
-			} else {
-				log.Infof("Reloaded labels")
-			}
-			if err := conn.LoadContacts(ctx); err != nil {
-				log.Errorf("Loading contacts: %v", err)
-			} else {
-				log.Infof("Reloaded contacts")
-			}
-		}
-	}()
-
-	// Redirect logging.
-	{
-		f, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			log.Fatalf("Can't create logfile %q: %v", *logFile, err)
-		}
-		defer f.Close()
-		log.SetOutput(f)
-		log.SetFormatter(&log.TextFormatter{
-			DisableColors: true,
-		})
-	}
+	defer redirectLog().Close()
 
-	if err := run(ctx); err != nil {
+	if err := run(ctx, a); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -72,36 +72,103 @@ func getInput(ctx context.Context, prefill string, keys *input.Input) (string, e
 }
 
 func composeNew(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) error {
-	toOpt, err := dialog.Selection(dialog.Strings2Options(conn.Contacts()), "To> ", true, keys)
+	if err := conn.CheckWrite("composing"); err != nil {
+		return err
+	}
+	to, err := selectRecipient(ctx, conn, keys)
 	if err == dialog.ErrAborted {
 		return nil
 	} else if err != nil {
 		return err
 	}
 
-	to := toOpt.Key
-	if strings.EqualFold(to, "me") {
-		p, err := conn.GetProfile(ctx)
-		if err != nil {
-			return errors.Wrap(err, "failed to get own email address")
-		}
-		to = p.EmailAddress
+	id, err := chooseIdentity(conn, keys, conn.DefaultIdentity())
+	if err == dialog.ErrAborted {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
 	var sig string
-	if signature != "" {
-		sig = "--\n" + signature + "\n"
+	if s := signatureFor(conn, id); s != "" {
+		sig = "--\n" + s + "\n"
 	}
 
-	prefill := fmt.Sprintf(`To: %s
+	prefill := fmt.Sprintf(`%sTo: %s
 CC:
 Subject:
 
-%s`, to, sig)
+%s`, fromLine(conn, id), to, sig)
 
 	return compose(ctx, conn, nil, keys, cmdg.NewThread, prefill)
 }
 
+// chooseIdentity asks the user which identity to send as, if there's more than one.
+// `def` is the one chosen by pressing enter.
+func chooseIdentity(conn *cmdg.CmdG, keys *input.Input, def *cmdg.Identity) (*cmdg.Identity, error) {
+	ids := conn.Identities()
+	if len(ids) < 2 {
+		return def, nil
+	}
+	if len(ids) > 9 {
+		var opts []*dialog.Option
+		for n, id := range ids {
+			opts = append(opts, &dialog.Option{
+				Key:    id.Email,
+				KeyInt: n,
+				Label:  id.From(),
+			})
+		}
+		o, err := dialog.Selection(opts, "From> ", false, keys)
+		if err != nil {
+			return nil, err
+		}
+		return ids[o.KeyInt], nil
+	}
+	opts := []dialog.Option{
+		{Key: input.Enter, Label: "enter — " + def.From()},
+	}
+	for n, id := range ids {
+		opts = append(opts, dialog.Option{
+			Key:    fmt.Sprint(n + 1),
+			KeyInt: n,
+			Label:  fmt.Sprintf("%d — %s", n+1, id.From()),
+		})
+	}
+	a, err := dialog.Question("Send as?", opts, keys)
+	if err != nil {
+		return nil, err
+	}
+	if a == "^C" {
+		return nil, dialog.ErrAborted
+	}
+	if a == input.Enter {
+		return def, nil
+	}
+	for _, o := range opts {
+		if o.Key == a {
+			return ids[o.KeyInt], nil
+		}
+	}
+	return nil, fmt.Errorf("can't happen: unknown identity choice %q", a)
+}
+
+// signatureFor returns the signature to use when sending as the identity.
+func signatureFor(conn *cmdg.CmdG, id *cmdg.Identity) string {
+	if id != nil && id.Signature != "" {
+		return id.Signature
+	}
+	return accountSignature(conn)
+}
+
+// fromLine returns the From header line to prefill, if the user has more than one identity.
+func fromLine(conn *cmdg.CmdG, id *cmdg.Identity) string {
+	if id == nil || len(conn.Identities()) < 2 {
+		return ""
+	}
+	return fmt.Sprintf("From: %s\n", id.From())
+}
+
 func createSig(ctx context.Context, msg string) (string, error) {
 	var out bytes.Buffer
 	cmd := exec.CommandContext(ctx, *gpgFlag, "--no-tty", "--batch", "-s", "-a", "-b")
@@ -168,18 +235,36 @@ func prepareMessage(ctx context.Context, msg string, attachments []*file) (*prep
 	}, nil
 }
 
-// take message text and attachments, and turn it into mail headers and parts
-func sendMessage(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, msg string, threadID cmdg.ThreadID, attachments []*file) error {
+// prepareWithHead is prepareMessage, followed by the header changes.
+func prepareWithHead(ctx context.Context, headOps []headOp, msg string, attachments []*file) (*preparedMessage, error) {
 	prep, err := prepareMessage(ctx, msg, attachments)
 	if err != nil {
-		return errors.Wrap(err, "preparing message")
+		return nil, errors.Wrap(err, "preparing message")
 	}
 	for _, op := range headOps {
 		op(&prep.head)
 	}
+	return prep, nil
+}
+
+// take message text and attachments, and turn it into mail headers and parts
+func sendMessage(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, msg string, threadID cmdg.ThreadID, attachments []*file) error {
+	prep, err := prepareWithHead(ctx, headOps, msg, attachments)
+	if err != nil {
+		return err
+	}
 	return errors.Wrap(conn.SendParts(ctx, threadID, prep.mp, prep.head, prep.parts), "sending parts")
 }
 
+// saveDraft saves the message and attachments as a new draft.
+func saveDraft(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, msg string, attachments []*file) error {
+	prep, err := prepareWithHead(ctx, headOps, msg, attachments)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(conn.MakeDraft(ctx, prep.mp, prep.head, prep.parts), "saving draft")
+}
+
 // compose() is used for compose, replies, and forwards.
 func compose(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, keys *input.Input, threadID cmdg.ThreadID, msg string) error {
 	doEdit := true
@@ -222,7 +307,13 @@ func compose(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, keys *input
 			for {
 				st := time.Now()
 
-				if err := sendMessage(ctx, conn, headOps, msg, threadID, attachments); err != nil {
+				err := sendMessage(ctx, conn, headOps, msg, threadID, attachments)
+				if errors.Cause(err) == cmdg.ErrQueued {
+					log.Infof("Message queued for sending later")
+					dialog.Message("Queued", "Network seems to be down. Message queued, and will be sent when it's back.", keys)
+					break
+				}
+				if err != nil {
 					log.Errorf("Failed to send: %v", err)
 					a, err := dialog.Question(fmt.Sprintf("Failed to send (%q). Save to local file?", err.Error()), []dialog.Option{
 						{Key: "y", Label: "Y — Yes, save to local file"},
@@ -265,7 +356,7 @@ func compose(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, keys *input
 			return nil
 		case "d":
 			st := time.Now()
-			if err := conn.MakeDraft(ctx, msg); err != nil {
+			if err := saveDraft(ctx, conn, headOps, msg, attachments); err != nil {
 				// TODO: ask to save on local filesystem.
 				return err
 			}
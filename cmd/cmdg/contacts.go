@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+var (
+	vcardDir  = flag.String("vcard_dir", "", "Directory of .vcf files to merge into contacts.")
+	abookFile = flag.String("abook", "", "abook addressbook file to merge into contacts.")
+)
+
+// addAddressBooks adds the local address books from flags to the connection.
+func addAddressBooks(conn *cmdg.CmdG) {
+	if *vcardDir != "" {
+		conn.AddAddressBook(cmdg.VCardDir(*vcardDir))
+	}
+	if *abookFile != "" {
+		conn.AddAddressBook(cmdg.Abook(*abookFile))
+	}
+}
+
+// contactOptions returns one option per contact email address, matching
+// also on nickname, organization, and groups. Aliases, contact groups,
+// and addresses we've sent to but that aren't contacts are also
+// included, and all are ranked by how often and recently we send to them.
+// Except "me", which stays first.
+func contactOptions(conn *cmdg.CmdG) []*dialog.Option {
+	opts := []*dialog.Option{{Key: "me", Label: "me", Score: math.Inf(1)}}
+	have := make(map[string]bool)
+	for _, co := range conn.Contacts() {
+		var kw []string
+		for _, k := range append([]string{co.Nickname, co.Organization}, co.Groups...) {
+			if k != "" {
+				kw = append(kw, k)
+			}
+		}
+		for _, e := range co.Emails {
+			a := co.Address(e)
+			have[strings.ToLower(e)] = true
+			opts = append(opts, &dialog.Option{
+				Key:      a,
+				KeyInt:   len(opts),
+				Label:    a,
+				Keywords: kw,
+				Score:    conn.RecipientScore(e),
+			})
+		}
+	}
+	for _, n := range conn.AliasNames() {
+		opts = append(opts, &dialog.Option{
+			Key:      n,
+			KeyInt:   len(opts),
+			Label:    n + " (group)",
+			Keywords: []string{n},
+		})
+	}
+	now := time.Now()
+	for _, r := range conn.Recipients() {
+		a, err := mail.ParseAddress(r.Address)
+		if err != nil || have[strings.ToLower(a.Address)] {
+			continue
+		}
+		opts = append(opts, &dialog.Option{
+			Key:    r.Address,
+			KeyInt: len(opts),
+			Label:  r.Address,
+			Score:  r.Score(now),
+		})
+	}
+	return opts
+}
+
+// resolveRecipient turns "me" and contact nicknames into email addresses.
+// Anything else is returned as is.
+func resolveRecipient(ctx context.Context, conn *cmdg.CmdG, to string) (string, error) {
+	to = strings.TrimSpace(to)
+	if strings.EqualFold(to, "me") {
+		p, err := conn.GetProfile(ctx)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to get own email address")
+		}
+		return p.EmailAddress, nil
+	}
+	if co := conn.ContactByNickname(to); co != nil {
+		return co.Address(co.Emails[0]), nil
+	}
+	return to, nil
+}
+
+// selectRecipient asks for a recipient, offering contacts as options.
+func selectRecipient(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) (string, error) {
+	toOpt, err := dialog.Selection(contactOptions(conn), "To> ", true, keys)
+	if err != nil {
+		return "", err
+	}
+	return resolveRecipient(ctx, conn, toOpt.Key)
+}
+
+// newContactCandidates returns the addresses in From, To, and CC that
+// are neither our own nor already contacts. From comes first.
+func newContactCandidates(ctx context.Context, conn *cmdg.CmdG, msg *cmdg.Message) ([]*mail.Address, error) {
+	var ret []*mail.Address
+	seen := make(map[string]bool)
+	for _, h := range []string{"From", "To", "CC"} {
+		v, err := msg.GetHeader(ctx, h)
+		if err != nil || v == "" {
+			continue
+		}
+		as, err := mail.ParseAddressList(v)
+		if err != nil {
+			if h == "From" {
+				return nil, errors.Wrapf(err, "parsing From %q", v)
+			}
+			log.Warningf("Failed to parse %s header %q: %v", h, v, err)
+			continue
+		}
+		for _, a := range as {
+			k := strings.ToLower(a.Address)
+			if seen[k] || conn.IsOwnAddress(a.Address) || conn.IsContact(a.Address) {
+				continue
+			}
+			seen[k] = true
+			ret = append(ret, a)
+		}
+	}
+	return ret, nil
+}
+
+// addToContacts offers to add the sender, or other people on the message, to Google contacts.
+func addToContacts(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, msg *cmdg.Message) error {
+	cands, err := newContactCandidates(ctx, conn, msg)
+	if err != nil {
+		return err
+	}
+	if len(cands) == 0 {
+		dialog.Message("Contacts", "Everyone on this message is already a contact.", keys)
+		return nil
+	}
+	a := cands[0]
+	if len(cands) > 1 {
+		var opts []*dialog.Option
+		for n, c := range cands {
+			opts = append(opts, &dialog.Option{
+				Key:    c.Address,
+				KeyInt: n,
+				Label:  c.String(),
+			})
+		}
+		o, err := dialog.Selection(opts, "Add to contacts> ", false, keys)
+		if err != nil {
+			return err
+		}
+		a = cands[o.KeyInt]
+	}
+	for {
+		name := a.Name
+		if name == "" {
+			name = "<no name>"
+		}
+		ans, err := dialog.Question(fmt.Sprintf("Add %s <%s> to contacts?", name, a.Address), []dialog.Option{
+			{Key: "y", Label: "y — Yes, add contact"},
+			{Key: "e", Label: "e — Edit name first"},
+			{Key: "n", Label: "n — No"},
+		}, keys)
+		if err != nil {
+			return err
+		}
+		switch ans {
+		case "y":
+			return conn.CreateContact(ctx, a.Name, a.Address)
+		case "e":
+			n, err := dialog.Entry("Name> ", keys)
+			if err == dialog.ErrAborted {
+				continue
+			} else if err != nil {
+				return err
+			}
+			a = &mail.Address{Name: strings.TrimSpace(n), Address: a.Address}
+		default:
+			return nil
+		}
+	}
+}
@@ -22,6 +22,9 @@ const (
 )
 
 func continueDraft(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) error {
+	if err := conn.CheckWrite("editing drafts"); err != nil {
+		return err
+	}
 	drafts, err := conn.ListDrafts(ctx)
 	if err != nil {
 		return errors.Wrap(err, "listing drafts")
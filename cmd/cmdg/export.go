@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+)
+
+var (
+	exportFile   = flag.String("export", "", "Export messages to this mbox file or Maildir directory, then exit. Run again to resume.")
+	exportFormat = flag.String("export_format", cmdg.FormatMbox, "Export format: "+cmdg.FormatMbox+" or "+cmdg.FormatMaildir+".")
+	exportLabel  = flag.String("export_label", "", "Label name or ID to export. Default is all mail.")
+	exportQuery  = flag.String("export_query", "", "Only export messages matching this search query.")
+)
+
+// connectBatch connects for a batch mode. The message cache belongs to
+// the UI, which may be running at the same time, so it's not used.
+func connectBatch() (*cmdg.CmdG, error) {
+	c, err := cmdg.New(configFilePath())
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting")
+	}
+	c.DisableDiskCache()
+	return c, nil
+}
+
+// runExport exports messages without starting the UI.
+func runExport(ctx context.Context) error {
+	c, err := connectBatch()
+	if err != nil {
+		return err
+	}
+	n, err := c.Export(ctx, *exportLabel, *exportQuery, *exportFormat, *exportFile)
+	fmt.Printf("Exported %d messages to %s\n", n, *exportFile)
+	return err
+}
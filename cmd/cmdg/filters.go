@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+// manageFilters lists, creates, and deletes server side filters.
+// If `msg` is not nil then filters can be created based on it.
+func manageFilters(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, msg *cmdg.Message) error {
+	for {
+		opts := []dialog.Option{
+			{Key: "l", Label: "l — List and delete filters"},
+			{Key: "n", Label: "n — New filter"},
+		}
+		if msg != nil {
+			opts = append(opts, dialog.Option{Key: "m", Label: "m — New filter from this message"})
+		}
+		opts = append(opts, dialog.Option{Key: "q", Label: "q — Back"})
+		a, err := dialog.Question("Filters", opts, keys)
+		if err != nil {
+			return err
+		}
+		switch a {
+		case "^C", "q":
+			return nil
+		case "l":
+			err = listFilters(ctx, conn, keys)
+		case "n":
+			err = editFilter(ctx, conn, keys, &gmail.FilterCriteria{})
+		case "m":
+			var fc *gmail.FilterCriteria
+			if fc, err = msg.FilterCriteria(ctx); err == nil {
+				err = editFilter(ctx, conn, keys, fc)
+			}
+		}
+		if err != nil {
+			dialog.Message("Error", err.Error(), keys)
+		}
+	}
+}
+
+// listFilters shows all filters, and offers to delete the one selected.
+func listFilters(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) error {
+	fs, err := conn.ListFilters(ctx)
+	if err != nil {
+		return err
+	}
+	if len(fs) == 0 {
+		dialog.Message("Filters", "There are no filters.", keys)
+		return nil
+	}
+	var opts []*dialog.Option
+	for n, f := range fs {
+		opts = append(opts, &dialog.Option{
+			Key:    f.Id,
+			KeyInt: n,
+			Label:  conn.DescribeFilter(f),
+		})
+	}
+	o, err := dialog.Selection(opts, "Filter> ", false, keys)
+	if errors.Cause(err) == dialog.ErrAborted {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	a, err := dialog.Question(conn.DescribeFilter(fs[o.KeyInt]), []dialog.Option{
+		{Key: "d", Label: "d — Delete filter"},
+		{Key: "q", Label: "q — Back"},
+	}, keys)
+	if err != nil {
+		return err
+	}
+	if a != "d" {
+		return nil
+	}
+	return conn.DeleteFilter(ctx, o.Key)
+}
+
+// toggleLabel adds the label to the list if not there, and removes it if it is.
+func toggleLabel(ls []string, l string) []string {
+	var ret []string
+	found := false
+	for _, t := range ls {
+		if t == l {
+			found = true
+		} else {
+			ret = append(ret, t)
+		}
+	}
+	if !found {
+		ret = append(ret, l)
+	}
+	return ret
+}
+
+// editFilter lets the user edit criteria and actions of a new filter, and then creates it.
+func editFilter(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, fc *gmail.FilterCriteria) error {
+	fa := &gmail.FilterAction{}
+	var label string
+	checkbox := func(ls []string, l string) string {
+		for _, t := range ls {
+			if t == l {
+				return "[x]"
+			}
+		}
+		return "[ ]"
+	}
+	for {
+		labelName := "<none>"
+		for _, l := range conn.Labels() {
+			if l.ID == label {
+				labelName = l.Label
+			}
+		}
+		a, err := dialog.Question("New filter: "+cmdg.DescribeFilterCriteria(fc), []dialog.Option{
+			{Key: "f", Label: fmt.Sprintf("f — From: %s", fc.From)},
+			{Key: "t", Label: fmt.Sprintf("t — To: %s", fc.To)},
+			{Key: "s", Label: fmt.Sprintf("s — Subject: %s", fc.Subject)},
+			{Key: "w", Label: fmt.Sprintf("w — Has the words: %s", fc.Query)},
+			{Key: "l", Label: fmt.Sprintf("l — Apply label: %s", labelName)},
+			{Key: "i", Label: fmt.Sprintf("i — %s Skip inbox", checkbox(fa.RemoveLabelIds, cmdg.Inbox))},
+			{Key: "r", Label: fmt.Sprintf("r — %s Mark as read", checkbox(fa.RemoveLabelIds, cmdg.Unread))},
+			{Key: "*", Label: fmt.Sprintf("* — %s Star it", checkbox(fa.AddLabelIds, cmdg.Starred))},
+			{Key: "d", Label: fmt.Sprintf("d — %s Delete it", checkbox(fa.AddLabelIds, cmdg.Trash))},
+			{Key: "c", Label: "c — Create filter"},
+			{Key: "a", Label: "a — Abort"},
+		}, keys)
+		if err != nil {
+			return err
+		}
+		entry := func(prompt string, v *string) error {
+			s, err := dialog.Entry(prompt+" (empty to clear)> ", keys)
+			if err == dialog.ErrAborted {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			*v = s
+			return nil
+		}
+		switch a {
+		case "^C", "a":
+			return nil
+		case "f":
+			err = entry("From", &fc.From)
+		case "t":
+			err = entry("To", &fc.To)
+		case "s":
+			err = entry("Subject", &fc.Subject)
+		case "w":
+			err = entry("Has the words", &fc.Query)
+		case "l":
+			var opts []*dialog.Option
+			for _, l := range conn.Labels() {
+				if l.IsSystem() {
+					continue
+				}
+				opts = append(opts, &dialog.Option{
+					Key:   l.ID,
+					Label: l.Label,
+				})
+			}
+			o, isNew, err2 := dialog.SelectionNew(opts, "Label> ", keys)
+			if errors.Cause(err2) == dialog.ErrAborted {
+				label = ""
+			} else if err2 != nil {
+				err = err2
+			} else if isNew {
+				var l *cmdg.Label
+				if l, err = conn.CreateLabel(ctx, o.Key); err == nil {
+					label = l.ID
+				}
+			} else {
+				label = o.Key
+			}
+		case "i":
+			fa.RemoveLabelIds = toggleLabel(fa.RemoveLabelIds, cmdg.Inbox)
+		case "r":
+			fa.RemoveLabelIds = toggleLabel(fa.RemoveLabelIds, cmdg.Unread)
+		case "*":
+			fa.AddLabelIds = toggleLabel(fa.AddLabelIds, cmdg.Starred)
+		case "d":
+			fa.AddLabelIds = toggleLabel(fa.AddLabelIds, cmdg.Trash)
+		case "c":
+			action := &gmail.FilterAction{
+				AddLabelIds:    fa.AddLabelIds,
+				RemoveLabelIds: fa.RemoveLabelIds,
+			}
+			if label != "" {
+				action.AddLabelIds = append(append([]string{}, action.AddLabelIds...), label)
+			}
+			if _, err := conn.CreateFilter(ctx, &gmail.Filter{
+				Criteria: fc,
+				Action:   action,
+			}); err != nil {
+				return err
+			}
+			dialog.Message("Filter created", conn.DescribeFilter(&gmail.Filter{Criteria: fc, Action: action}), keys)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
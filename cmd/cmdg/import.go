@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+)
+
+var (
+	importFile        = flag.String("import", "", "Import messages from this mbox file or Maildir directory, then exit. Run again to resume.")
+	importLabel       = flag.String("import_label", "", "Label to add to imported messages. Created if needed.")
+	importProgress    = flag.String("import_progress", "", "File recording what's been imported. Default is next to what's imported.")
+	importReport      = flag.String("import_report", "", "File listing messages that failed to import. Default is next to what's imported.")
+	importConcurrency = flag.Int("import_concurrency", 4, "Messages to upload at the same time.")
+)
+
+// runImport imports messages without starting the UI.
+func runImport(ctx context.Context) error {
+	c, err := connectBatch()
+	if err != nil {
+		return err
+	}
+	res, err := c.Import(ctx, *importFile, cmdg.ImportOptions{
+		Label:       *importLabel,
+		Progress:    *importProgress,
+		Report:      *importReport,
+		Concurrency: *importConcurrency,
+	})
+	if res != nil {
+		fmt.Printf("Imported %d messages, %d already imported, %d failed\n", res.Imported, res.Skipped, res.Failed)
+	}
+	return err
+}
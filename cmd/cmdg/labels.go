@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/display"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+// manageLabels lets the user create, rename, recolor, and delete labels.
+// Returns when the user aborts the label selection.
+func manageLabels(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) error {
+	for {
+		var opts []*dialog.Option
+		for _, l := range conn.Labels() {
+			if l.IsSystem() {
+				continue
+			}
+			opts = append(opts, &dialog.Option{
+				Key:     l.ID,
+				Label:   l.Label,
+				Display: l.LabelString(),
+			})
+		}
+		o, isNew, err := dialog.SelectionNew(opts, "Manage label> ", keys)
+		if errors.Cause(err) == dialog.ErrAborted {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "selecting label")
+		}
+		if isNew {
+			if _, err := conn.CreateLabel(ctx, o.Key); err != nil {
+				dialog.Message("Error", err.Error(), keys)
+			}
+			continue
+		}
+		if err := manageLabel(ctx, conn, keys, o.Key); err != nil {
+			dialog.Message("Error", err.Error(), keys)
+		}
+	}
+}
+
+// manageLabel asks what to do with one label, and does it.
+func manageLabel(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, id string) error {
+	var label *cmdg.Label
+	for _, l := range conn.Labels() {
+		if l.ID == id {
+			label = l
+		}
+	}
+	if label == nil {
+		return fmt.Errorf("label %q went away", id)
+	}
+	a, err := dialog.Question(label.LabelString(), []dialog.Option{
+		{Key: "r", Label: "r — Rename"},
+		{Key: "c", Label: "c — Change color"},
+		{Key: "x", Label: "x — Remove color"},
+		{Key: "d", Label: "d — Delete"},
+		{Key: "q", Label: "q — Back"},
+	}, keys)
+	if err != nil {
+		return err
+	}
+	switch a {
+	case "r":
+		name, err := dialog.Entry(fmt.Sprintf("Rename %q to> ", label.Label), keys)
+		if err == dialog.ErrAborted || name == "" {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return conn.RenameLabel(ctx, id, name)
+	case "c":
+		var opts []*dialog.Option
+		for _, c := range cmdg.LabelPalette() {
+			opts = append(opts, &dialog.Option{
+				Key:   c,
+				Label: fmt.Sprintf("%s %s %s %s", cmdg.LabelColorString(c), label.Label, display.Reset, c),
+			})
+		}
+		o, err := dialog.Selection(opts, "Color> ", false, keys)
+		if errors.Cause(err) == dialog.ErrAborted {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return conn.SetLabelColor(ctx, id, o.Key)
+	case "x":
+		return conn.SetLabelColor(ctx, id, "")
+	case "d":
+		a, err := dialog.Question(fmt.Sprintf("Delete label %q from all messages?", label.Label), []dialog.Option{
+			{Key: "y", Label: "y — Yes, delete it"},
+			{Key: "n", Label: "n — No"},
+		}, keys)
+		if err != nil {
+			return err
+		}
+		if a != "y" {
+			return nil
+		}
+		log.Infof("Deleting label %q (%q)", id, label.Label)
+		return conn.DeleteLabel(ctx, id)
+	}
+	return nil
+}
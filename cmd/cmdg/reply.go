@@ -8,7 +8,6 @@ import (
 	"regexp"
 	"strings"
 
-	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/ThomasHabets/cmdg/pkg/cmdg"
@@ -48,6 +47,17 @@ func replyQuoted(s string) string {
 // Args:
 //   msg: Message to reply or forward.
 func replyOrForward(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, to, cc, subjPrefix string, rmPrefix *regexp.Regexp, msg *cmdg.Message) error {
+	if err := conn.CheckWrite("replying"); err != nil {
+		return err
+	}
+	// Default to replying from the address it was sent to.
+	id, err := chooseIdentity(conn, keys, msg.IdentityFor(ctx))
+	if err == dialog.ErrAborted {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
 	b, err := msg.GetUnpatchedBody(ctx)
 	if err != nil {
 		return err
@@ -76,8 +86,8 @@ func replyOrForward(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, to,
 		fmt.Sprintf("On %s, %s said:", date.Format("Mon, 2 Jan 2006 15:04:05 -0700"), orig),
 		replyQuoted(b),
 	}
-	if signature != "" {
-		body = append(body, "\n--\n"+signature+"\n")
+	if s := signatureFor(conn, id); s != "" {
+		body = append(body, "\n--\n"+s+"\n")
 	}
 
 	threadID, err := msg.ThreadID(ctx)
@@ -85,7 +95,7 @@ func replyOrForward(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, to,
 		return err
 	}
 
-	prefill := strings.Join(headers, "\n") + "\n\n" + strings.Join(body, "\n")
+	prefill := fromLine(conn, id) + strings.Join(headers, "\n") + "\n\n" + strings.Join(body, "\n")
 	refs, err := msg.GetReferences(ctx)
 	if err != nil {
 		// don't care
@@ -126,21 +136,16 @@ func replyAll(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, msg *cmdg
 }
 
 func forward(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, msg *cmdg.Message) error {
+	if err := conn.CheckWrite("forwarding"); err != nil {
+		return err
+	}
 	// Get recipient
-	toOpt, err := dialog.Selection(dialog.Strings2Options(conn.Contacts()), "To> ", true, keys)
+	to, err := selectRecipient(ctx, conn, keys)
 	if err == dialog.ErrAborted {
 		return nil
 	} else if err != nil {
 		return err
 	}
-	to := toOpt.Key
-	if strings.EqualFold(to, "me") {
-		p, err := conn.GetProfile(ctx)
-		if err != nil {
-			return errors.Wrap(err, "failed to get own email address")
-		}
-		to = p.EmailAddress
-	}
 
 	return replyOrForward(ctx, conn, keys, to, "", forwardPrefix, forwardPrefixes, msg)
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+const vacationDateLayout = "2006-01-02"
+
+// msToTime converts Gmail's milliseconds since epoch.
+func msToTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func timeToMS(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// vacationDate formats the start or end date for display.
+// End time is exclusive, so shows the day before.
+func vacationDate(ms int64, end bool) string {
+	if ms == 0 {
+		return "<none>"
+	}
+	t := msToTime(ms)
+	if end {
+		t = t.Add(-time.Millisecond)
+	}
+	return t.Format(vacationDateLayout)
+}
+
+// askVacationDate asks for a date, and returns it as the start of that day,
+// or the start of the next day if `end`. Returns 0 for no date.
+func askVacationDate(prompt string, end bool, keys *input.Input) (int64, error) {
+	s, err := dialog.Entry(prompt+" (YYYY-MM-DD, empty for none)> ", keys)
+	if err != nil {
+		return 0, err
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.ParseInLocation(vacationDateLayout, s, time.Local)
+	if err != nil {
+		return 0, errors.Wrapf(err, "bad date %q", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return timeToMS(t), nil
+}
+
+// editVacationText edits the subject and body in the editor. The body
+// is edited and saved as plain text, so any HTML version is converted,
+// and then replaced.
+func editVacationText(ctx context.Context, v *gmail.VacationSettings, keys *input.Input) error {
+	s, err := getInput(ctx, fmt.Sprintf("Subject: %s\n\n%s", v.ResponseSubject, cmdg.VacationText(v)), keys)
+	if err != nil {
+		return err
+	}
+	m, err := mail.ReadMessage(strings.NewReader(s))
+	if err != nil {
+		return errors.Wrap(err, "vacation text malformed. Needs to be `Subject:` line, empty line, then body")
+	}
+	b, err := ioutil.ReadAll(m.Body)
+	if err != nil {
+		return err
+	}
+	v.ResponseSubject = m.Header.Get("Subject")
+	v.ResponseBodyPlainText = string(b)
+	v.ResponseBodyHtml = ""
+	return nil
+}
+
+// vacationSettings shows and edits the vacation responder settings.
+func vacationSettings(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) error {
+	cur, err := conn.GetVacation(ctx)
+	if err != nil {
+		return err
+	}
+	// Edit a copy, so that aborting leaves the current settings alone.
+	nv := *cur
+	v := &nv
+	checkbox := func(b bool) string {
+		if b {
+			return "[x]"
+		}
+		return "[ ]"
+	}
+	for {
+		a, err := dialog.Question("Vacation responder", []dialog.Option{
+			{Key: "e", Label: fmt.Sprintf("e — %s Enabled", checkbox(v.EnableAutoReply))},
+			{Key: "t", Label: fmt.Sprintf("t — Edit subject and text. Subject: %s", v.ResponseSubject)},
+			{Key: "f", Label: fmt.Sprintf("f — First day: %s", vacationDate(v.StartTime, false))},
+			{Key: "l", Label: fmt.Sprintf("l — Last day: %s", vacationDate(v.EndTime, true))},
+			{Key: "c", Label: fmt.Sprintf("c — %s Only send to my contacts", checkbox(v.RestrictToContacts))},
+			{Key: "d", Label: fmt.Sprintf("d — %s Only send to my domain", checkbox(v.RestrictToDomain))},
+			{Key: "s", Label: "s — Save"},
+			{Key: "a", Label: "a — Abort, discarding changes"},
+		}, keys)
+		if err != nil {
+			return err
+		}
+		switch a {
+		case "^C", "a":
+			return nil
+		case "e":
+			v.EnableAutoReply = !v.EnableAutoReply
+		case "t":
+			err = editVacationText(ctx, v, keys)
+		case "f":
+			var t int64
+			if t, err = askVacationDate("First day", false, keys); err == nil {
+				v.StartTime = t
+			}
+		case "l":
+			var t int64
+			if t, err = askVacationDate("Last day", true, keys); err == nil {
+				v.EndTime = t
+			}
+		case "c":
+			v.RestrictToContacts = !v.RestrictToContacts
+		case "d":
+			v.RestrictToDomain = !v.RestrictToDomain
+		case "s":
+			return conn.UpdateVacation(ctx, v)
+		}
+		if err == dialog.ErrAborted {
+			continue
+		}
+		if err != nil {
+			dialog.Message("Error", err.Error(), keys)
+		}
+	}
+}
@@ -28,16 +28,27 @@ space, x           — Mark message and advance
 X                  — Mark message and step up
 e                  — Archive marked messages
 d                  — Move marked messages to trash
-l                  — Label marked messages
+!                  — Report marked messages as spam
+$                  — Mark marked messages as not spam
+m                  — Mute and archive the threads of marked messages
+l                  — Label marked messages, optionally creating a new label
 L                  — Unlabel marked messages
 *                  — Toggle starred on highlighted message
+i                  — Mark marked messages as important
+I                  — Mark marked messages as not important
 c                  — Compose new message
 C                  — Continue message from draft
 N, n, ^N, j, Down  — Next message
 P, p, ^P, k, Up    — Previous message
 r, ^R              — Reload current view
 g                  — Go to label
+M                  — Manage labels
+F                  — Manage filters
+V                  — Vacation responder settings
 1                  — Go to inbox
+tab                — Cycle through inbox category tabs
+T                  — Toggle conversation view
+A                  — Switch account
 s, ^s              — Search
 q                  — Quit
 ^L                 — Refresh screen
@@ -56,6 +67,15 @@ var (
 type historyUpdate struct {
 	historyID cmdg.HistoryID
 	history   []*gmail.History
+
+	// In conversation mode, the threads changed by the history.
+	threads []threadUpdate
+}
+
+// threadUpdate is a thread reloaded because history says it changed.
+type threadUpdate struct {
+	id     cmdg.ThreadID
+	thread *cmdg.Thread // nil if deleted.
 }
 
 type concurrency struct {
@@ -82,13 +102,17 @@ func (c *concurrency) Done() {
 // MessageView is the state for a message view.
 type MessageView struct {
 	// Static state.
-	label string
-	query string
+	acct          *account
+	label         string
+	query         string
+	conversations bool      // One row per thread instead of per message.
+	category      *category // Inbox tab, or nil for all.
 
 	// Communicate with main thread.
 	keys            *input.Input
 	errors          chan error
 	pageCh          chan *cmdg.Page
+	threadPageCh    chan *cmdg.ThreadPage
 	messageCh       chan *cmdg.Message
 	historyUpdateCh chan historyUpdate
 	removeMessage   chan string
@@ -97,33 +121,81 @@ type MessageView struct {
 	messages  []*cmdg.Message
 	pos       int
 	historyID cmdg.HistoryID
+
+	// In conversation mode each row is the last message of a thread. Keyed by that message's ID.
+	threads map[string]*cmdg.Thread
 }
 
 // NewMessageView creates a new message view.
-func NewMessageView(ctx context.Context, label, q string, in *input.Input) *MessageView {
+func NewMessageView(ctx context.Context, a *account, label, q string, in *input.Input) *MessageView {
+	return newMessageView(ctx, a, label, q, nil, false, in)
+}
+
+// NewConversationView creates a new message view showing one row per thread.
+func NewConversationView(ctx context.Context, a *account, label, q string, in *input.Input) *MessageView {
+	return newMessageView(ctx, a, label, q, nil, true, in)
+}
+
+func newMessageView(ctx context.Context, a *account, label, q string, cat *category, conversations bool, in *input.Input) *MessageView {
 	v := &MessageView{
+		acct:            a,
 		label:           label,
+		conversations:   conversations,
+		category:        cat,
 		errors:          make(chan error, 20),
 		pageCh:          make(chan *cmdg.Page),
+		threadPageCh:    make(chan *cmdg.ThreadPage),
 		historyUpdateCh: make(chan historyUpdate, 20),
 		messageCh:       make(chan *cmdg.Message),
+		removeMessage:   make(chan string),
 		keys:            in,
 		query:           q,
+		threads:         make(map[string]*cmdg.Thread),
 	}
 	go v.fetchPage(ctx, "")
 	return v
 }
 
+// newView creates a view of another label or query, keeping the account and conversation mode.
+func (mv *MessageView) newView(ctx context.Context, label, q string) *MessageView {
+	return newMessageView(ctx, mv.acct, label, q, nil, mv.conversations, mv.keys)
+}
+
+// messageIDs expands row IDs into the IDs of all messages they represent.
+// In conversation mode that is every message in the thread.
+func (mv *MessageView) messageIDs(ids []string) []string {
+	if !mv.conversations {
+		return ids
+	}
+	var ret []string
+	for _, id := range ids {
+		if t, found := mv.threads[id]; found {
+			ret = append(ret, t.MessageIDs()...)
+		} else {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
 // returns:
 // * true if doing anything. If this is 'false' then don't use other two returns.
 // * new list of messages
 // * an offset of how much pos should go back by after removal
+//
+// Nothing is done if changes are not allowed, so that the view is
+// left as it was.
 func (mv *MessageView) applyMarked(ctx context.Context, name string, op func(context.Context, []string) error, marked map[string]bool) (bool, []*cmdg.Message, int) {
+	if err := mv.acct.conn.CheckWrite(name); err != nil {
+		mv.errors <- err
+		return false, nil, 0
+	}
 	ids, nm, ofs := filterMarked(mv.messages, marked, mv.pos)
 	if len(ids) == 0 {
 		log.Infof("No marked messages to do do operation %q on", name)
 		return false, nil, 0
 	}
+	ids = mv.messageIDs(ids)
 	go func() {
 		st := time.Now()
 		if err := op(ctx, ids); err != nil {
@@ -139,7 +211,7 @@ func (mv *MessageView) fetchPage(ctx context.Context, token string) {
 	ctx, cancel := context.WithTimeout(ctx, messageListReloadTimeout)
 	if token == "" {
 		// Only update history on first page.
-		hid, err := conn.HistoryID(ctx)
+		hid, err := mv.acct.conn.HistoryID(ctx)
 		if err != nil {
 			log.Errorf("Failed to get history ID: %v", err)
 		} else {
@@ -150,9 +222,16 @@ func (mv *MessageView) fetchPage(ctx context.Context, token string) {
 		}
 	}
 
-	log.Infof("Listing messages on label %q query %q with token %q…", mv.label, mv.query, token)
+	if mv.conversations {
+		mv.fetchThreadPage(ctx, token)
+		cancel()
+		return
+	}
+
+	q := joinQuery(mv.query, mv.category)
+	log.Infof("Listing messages on label %q query %q with token %q…", mv.label, q, token)
 	st := time.Now()
-	page, err := conn.ListMessages(ctx, mv.label, mv.query, token)
+	page, err := mv.acct.conn.ListMessages(ctx, mv.label, q, token)
 	if err != nil {
 		mv.errors <- err
 		cancel()
@@ -169,6 +248,25 @@ func (mv *MessageView) fetchPage(ctx context.Context, token string) {
 	mv.pageCh <- page
 }
 
+func (mv *MessageView) fetchThreadPage(ctx context.Context, token string) {
+	q := joinQuery(mv.query, mv.category)
+	log.Infof("Listing threads on label %q query %q with token %q…", mv.label, q, token)
+	st := time.Now()
+	page, err := mv.acct.conn.ListThreads(ctx, mv.label, q, token)
+	if err != nil {
+		mv.errors <- err
+		return
+	}
+	// Rows are keyed on the last message of each thread, so metadata
+	// needs to be loaded before the page can be shown.
+	if err := page.PreloadSubjects(ctx); err != nil {
+		mv.errors <- err
+		return
+	}
+	log.Infof("Listing threads took %v", time.Since(st))
+	mv.threadPageCh <- page
+}
+
 // MessageViewOp is an operation to perform as the message closes.
 type MessageViewOp struct {
 	fun         func(*MessageView)
@@ -288,6 +386,47 @@ func filterMarked(msgs []*cmdg.Message, marked map[string]bool, pos int) ([]stri
 	return ids, ms, ofs
 }
 
+// markThreads also marks all other messages in the list that are in
+// the same threads as the marked messages. Only what's already loaded
+// is looked at, so that it doesn't block.
+func markThreads(msgs []*cmdg.Message, marked map[string]bool) {
+	ctx := context.Background()
+	threads := make(map[cmdg.ThreadID]bool)
+	for _, msg := range msgs {
+		if !marked[msg.ID] || !msg.HasData(cmdg.LevelMinimal) {
+			continue
+		}
+		if tid, err := msg.ThreadID(ctx); err == nil {
+			threads[tid] = true
+		}
+	}
+	for _, msg := range msgs {
+		if marked[msg.ID] || !msg.HasData(cmdg.LevelMinimal) {
+			continue
+		}
+		if tid, err := msg.ThreadID(ctx); err == nil && threads[tid] {
+			marked[msg.ID] = true
+		}
+	}
+}
+
+// threadIDs returns the threads of the messages, without duplicates.
+func threadIDs(ctx context.Context, msgs []*cmdg.Message) ([]cmdg.ThreadID, error) {
+	var ret []cmdg.ThreadID
+	seen := make(map[cmdg.ThreadID]bool)
+	for _, msg := range msgs {
+		tid, err := msg.ThreadID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tid] {
+			seen[tid] = true
+			ret = append(ret, tid)
+		}
+	}
+	return ret, nil
+}
+
 func filterMessage(msgs []*cmdg.Message, id string, pos int) ([]*cmdg.Message, int) {
 	var ret []*cmdg.Message
 
@@ -304,7 +443,7 @@ func filterMessage(msgs []*cmdg.Message, id string, pos int) ([]*cmdg.Message, i
 }
 
 func (mv *MessageView) historyCheck(ctx context.Context) error {
-	hists, hid, err := conn.History(ctx, mv.historyID, mv.label)
+	hists, hid, err := mv.acct.conn.History(ctx, mv.historyID, mv.label)
 	if err != nil {
 		return errors.Wrapf(err, "getting history since %d", mv.historyID)
 	}
@@ -313,6 +452,14 @@ func (mv *MessageView) historyCheck(ctx context.Context) error {
 		return nil
 	}
 
+	if mv.conversations {
+		mv.historyUpdateCh <- historyUpdate{
+			historyID: hid,
+			threads:   mv.reloadThreads(ctx, historyThreadIDs(hists)),
+		}
+		return nil
+	}
+
 	// The GMail API returns false positives if a new message
 	// affects *any thread* that is in the current label, even if
 	// the message itself doesn't have the label.
@@ -333,7 +480,7 @@ func (mv *MessageView) historyCheck(ctx context.Context) error {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				m := cmdg.NewMessage(conn, hists[hi].MessagesAdded[mi].Message.Id)
+				m := cmdg.NewMessage(mv.acct.conn, hists[hi].MessagesAdded[mi].Message.Id)
 				// Load labels.
 				ls, err := m.GetLabels(ctx, true)
 				if err != nil {
@@ -355,9 +502,165 @@ func (mv *MessageView) historyCheck(ctx context.Context) error {
 	return nil
 }
 
+// historyThreadIDs returns the threads of all messages in the history.
+func historyThreadIDs(hists []*gmail.History) []cmdg.ThreadID {
+	var ret []cmdg.ThreadID
+	seen := make(map[cmdg.ThreadID]bool)
+	add := func(m *gmail.Message) {
+		if m == nil || m.ThreadId == "" {
+			return
+		}
+		id := cmdg.ThreadID(m.ThreadId)
+		if !seen[id] {
+			seen[id] = true
+			ret = append(ret, id)
+		}
+	}
+	for _, h := range hists {
+		for _, m := range h.MessagesAdded {
+			add(m.Message)
+		}
+		for _, m := range h.MessagesDeleted {
+			add(m.Message)
+		}
+		for _, m := range h.LabelsAdded {
+			add(m.Message)
+		}
+		for _, m := range h.LabelsRemoved {
+			add(m.Message)
+		}
+	}
+	return ret
+}
+
+// reloadThreads reloads the threads. Threads that fail to load are
+// left out, except deleted ones, which are returned without thread.
+func (mv *MessageView) reloadThreads(ctx context.Context, ids []cmdg.ThreadID) []threadUpdate {
+	var wg sync.WaitGroup
+	ret := make([]*threadUpdate, len(ids))
+	for n, id := range ids {
+		n, id := n, id
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t, err := mv.acct.conn.ReloadThread(ctx, id)
+			if e, ok := errors.Cause(err).(*googleapi.Error); ok && e.Code == 404 {
+				ret[n] = &threadUpdate{id: id}
+			} else if err != nil {
+				log.Errorf("Failed to reload thread %q from history: %v", id, err)
+			} else {
+				ret[n] = &threadUpdate{id: id, thread: t}
+			}
+		}()
+	}
+	wg.Wait()
+	var us []threadUpdate
+	for _, u := range ret {
+		if u != nil {
+			us = append(us, *u)
+		}
+	}
+	return us
+}
+
+// threadInView returns true if the thread belongs in this conversation view.
+func (mv *MessageView) threadInView(t *cmdg.Thread) bool {
+	if t.Last() == nil {
+		return false
+	}
+	if mv.label != "" && !t.HasLabel(mv.label) {
+		return false
+	}
+	if mv.category != nil && !t.HasLabel(mv.category.labelID) {
+		return false
+	}
+	if mv.label == cmdg.Inbox && t.HasLabel(cmdg.Muted) {
+		return false
+	}
+	return true
+}
+
+func threadHasMessage(t *cmdg.Thread, id string) bool {
+	for _, m := range t.MessageIDs() {
+		if m == id {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeThreads applies reloaded threads to the conversation list.
+// Threads with new messages move to the top, like new messages do,
+// and threads no longer in the view are removed. The current position
+// stays on the same row.
+func (mv *MessageView) mergeThreads(updates []threadUpdate) {
+	remove := func(n int) {
+		delete(mv.threads, mv.messages[n].ID)
+		mv.messages = append(mv.messages[:n], mv.messages[n+1:]...)
+		if n < mv.pos || (mv.pos >= len(mv.messages) && mv.pos > 0) {
+			mv.pos--
+		}
+	}
+	for _, u := range updates {
+		row := -1
+		for n, m := range mv.messages {
+			if t, found := mv.threads[m.ID]; found && t.ID == u.id {
+				row = n
+				break
+			}
+		}
+		if u.thread == nil || !mv.threadInView(u.thread) {
+			if row >= 0 {
+				log.Infof("History removed thread %q from this view", u.id)
+				remove(row)
+			}
+			continue
+		}
+		last := u.thread.Last()
+		if row >= 0 && mv.messages[row].ID == last.ID {
+			// Only labels changed, and they're already updated.
+			continue
+		}
+		if row >= 0 && !threadHasMessage(u.thread, mv.messages[row].ID) {
+			// The last message was deleted. Nothing new, so
+			// the thread stays where it is.
+			delete(mv.threads, mv.messages[row].ID)
+			mv.threads[last.ID] = u.thread
+			mv.messages[row] = last
+			continue
+		}
+		current := row >= 0 && row == mv.pos
+		if row >= 0 {
+			remove(row)
+		}
+		log.Infof("History says thread %q has new message %q", u.id, last.ID)
+		mv.threads[last.ID] = u.thread
+		mv.messages = append([]*cmdg.Message{last}, mv.messages...)
+		if current {
+			mv.pos = 0
+		} else if len(mv.messages) > 1 {
+			mv.pos++
+		}
+	}
+}
+
+// openView is a view of an opened message or thread.
+type openView interface {
+	Run(context.Context) (*MessageViewOp, error)
+}
+
+// openCurrent opens the message or thread at the current position.
+func (mv *MessageView) openCurrent(ctx context.Context) (openView, error) {
+	if t, found := mv.threads[mv.messages[mv.pos].ID]; found {
+		return NewOpenThreadView(ctx, mv.acct.conn, t, mv.keys)
+	}
+	return NewOpenMessageView(ctx, mv.acct.conn, mv.messages[mv.pos], mv.label, mv.keys)
+}
+
 // Run runs the messagelist view.
 func (mv *MessageView) Run(ctx context.Context) error {
 	log.Infof("Running MessageView")
+	conn := mv.acct.conn
 	// TODO: defer a sync.WaitGroup.Wait() waiting on all goroutines spawned.
 	theresMore := true
 	var contentHeight int
@@ -402,6 +705,25 @@ func (mv *MessageView) Run(ctx context.Context) error {
 	}
 	empty()
 
+	// labelLocal changes labels locally on the given rows. In
+	// conversation mode that's every message in their threads.
+	labelLocal := func(ids []string, add, remove []string) {
+		for _, id := range ids {
+			msgs := []*cmdg.Message{mv.messages[messagePos[id]]}
+			if t, found := mv.threads[id]; found {
+				msgs = t.Messages()
+			}
+			for _, m := range msgs {
+				for _, l := range remove {
+					m.RemoveLabelIDLocal(l)
+				}
+				for _, l := range add {
+					m.AddLabelIDLocal(l)
+				}
+			}
+		}
+	}
+
 	drawMessage := func(cur int) error {
 		s := "Loading…"
 		if cur >= len(mv.messages) {
@@ -409,6 +731,12 @@ func (mv *MessageView) Run(ctx context.Context) error {
 		}
 		curmsg := mv.messages[cur]
 
+		thread := mv.threads[curmsg.ID]
+		hasLabel := curmsg.HasLabel
+		if thread != nil {
+			hasLabel = thread.HasLabel
+		}
+
 		prefix := " "
 		reset := display.Reset
 		if cur == mv.pos {
@@ -440,7 +768,11 @@ func (mv *MessageView) Run(ctx context.Context) error {
 				colors = " | " + colors
 				fullColors = " | " + fullColors
 			}
-			from = display.FixedWidth(from, 20)
+			if thread != nil {
+				from = fmt.Sprintf("%s %3d", display.FixedWidth(from, 16), thread.Len())
+			} else {
+				from = display.FixedWidth(from, 20)
+			}
 			s = fmt.Sprintf("%[1]*.[1]*[2]s | %[3]s | %[4]s",
 				6, tm,
 				from, subj)
@@ -452,7 +784,7 @@ func (mv *MessageView) Run(ctx context.Context) error {
 			s += reset
 		} else {
 			go func(cur int) {
-				if err := curmsg.Preload(ctx, cmdg.LevelMetadata); err != nil {
+				if err := curmsg.PreloadBatched(ctx, cmdg.LevelMetadata); err != nil {
 					log.Warningf("Failed to load metadata for email ID %s: %v", curmsg.ID, err)
 					if e, ok := errors.Cause(err).(*googleapi.Error); ok {
 						log.Warningf("Failing to load was googleapi error %+v", e)
@@ -472,19 +804,24 @@ func (mv *MessageView) Run(ctx context.Context) error {
 			prefix += " "
 		}
 
-		if curmsg.IsUnread() {
+		if hasLabel(cmdg.Unread) {
 			prefix = display.Bold + prefix + ">"
 		} else {
 			prefix += " "
 		}
 
+		important := " "
+		if hasLabel(cmdg.Important) {
+			important = "!"
+		}
+
 		star := " "
-		if curmsg.HasLabel(cmdg.Starred) {
+		if hasLabel(cmdg.Starred) {
 			star = "*"
 			prefix = display.Yellow + prefix
 		}
 
-		screen.Printlnf(cur-scroll, "%s%s%s%s", reset, prefix, star, s)
+		screen.Printlnf(cur-scroll, "%s%s%s%s%s", reset, prefix, important, star, s)
 		return nil
 	}
 
@@ -515,6 +852,24 @@ func (mv *MessageView) Run(ctx context.Context) error {
 		mv.pos++
 		return true
 	}
+	pageLoaded := func(token string) {
+		want := contentHeight
+		if token == "" {
+			log.Infof("All pages loaded")
+			if len(mv.messages) == 0 {
+				screen.Printlnf(0, "<empty>")
+			}
+			theresMore = false
+		} else {
+			if want > len(mv.messages) {
+				go mv.fetchPage(ctx, token)
+			} else {
+				log.Infof("Enough pages. Have %d messages, want %d", len(mv.messages), want)
+				theresMore = false
+			}
+		}
+		mkMessagePos()
+	}
 	for {
 		status := ""
 		select {
@@ -526,6 +881,10 @@ func (mv *MessageView) Run(ctx context.Context) error {
 				log.Infof("Got duplicate history update %d", mv.historyID)
 			} else {
 				mv.historyID = histUpdate.historyID
+				if mv.conversations {
+					mv.mergeThreads(histUpdate.threads)
+					mkMessagePos()
+				}
 				for _, hist := range histUpdate.history {
 					log.Infof("History entry: %d add, %d delete, %d labeladd, %d labeldelete", len(hist.MessagesAdded), len(hist.MessagesDeleted), len(hist.LabelsAdded), len(hist.LabelsRemoved))
 					for _, m := range hist.MessagesDeleted {
@@ -556,6 +915,14 @@ func (mv *MessageView) Run(ctx context.Context) error {
 									break
 								}
 							}
+							if this && !inCategory(mv.category, ladd.Message.LabelIds) {
+								log.Infof("History moved %q to current label %q, but not to tab %q", ladd.Message.Id, mv.label, mv.category.name)
+								this = false
+							}
+							if this && mv.label == cmdg.Inbox && conn.IsMuted(ladd.Message) {
+								log.Infof("History moved %q to inbox, but the thread is muted", ladd.Message.Id)
+								this = false
+							}
 							if this {
 								// Confirmed. This is a new message.
 								log.Infof("History says %q was moved to current label %q", ladd.Message.Id, mv.label)
@@ -587,6 +954,14 @@ func (mv *MessageView) Run(ctx context.Context) error {
 									}
 								}
 							}
+							if addme && hasData && !inCategory(mv.category, ma.Message.LabelIds) {
+								log.Infof("Not adding message %q from another tab", ma.Message.Id)
+								addme = false
+							}
+							if addme && mv.label == cmdg.Inbox && conn.IsMuted(ma.Message) {
+								log.Infof("Not adding message %q from muted thread", ma.Message.Id)
+								addme = false
+							}
 							if addme {
 								log.Infof("Adding message from history")
 								var nm *cmdg.Message
@@ -614,7 +989,7 @@ func (mv *MessageView) Run(ctx context.Context) error {
 										msg.RemoveLabelIDLocal(l)
 									}
 								}
-								if l == mv.label {
+								if l == mv.label || (mv.category != nil && l == mv.category.labelID) {
 									this = true
 								}
 							}
@@ -681,22 +1056,19 @@ func (mv *MessageView) Run(ctx context.Context) error {
 			log.Printf("MessageListView: Got page!")
 			pages = append(pages, p)
 			mv.messages = append(mv.messages, p.Messages...)
-			want := contentHeight
-			if p.Response.NextPageToken == "" {
-				log.Infof("All pages loaded")
-				if len(mv.messages) == 0 {
-					screen.Printlnf(0, "<empty>")
-				}
-				theresMore = false
-			} else {
-				if want > len(mv.messages) {
-					go mv.fetchPage(ctx, p.Response.NextPageToken)
-				} else {
-					log.Infof("Enough pages. Have %d messages, want %d", len(mv.messages), want)
-					theresMore = false
+			pageLoaded(p.Response.NextPageToken)
+		case p := <-mv.threadPageCh:
+			log.Printf("MessageListView: Got thread page!")
+			for _, t := range p.Threads {
+				m := t.Last()
+				if m == nil {
+					log.Warningf("Skipping thread %q with no loaded messages", t.ID)
+					continue
 				}
+				mv.threads[m.ID] = t
+				mv.messages = append(mv.messages, m)
 			}
-			mkMessagePos()
+			pageLoaded(p.Response.NextPageToken)
 
 		case id := <-mv.removeMessage:
 			mv.messages, mv.pos = filterMessage(mv.messages, id, mv.pos)
@@ -720,7 +1092,7 @@ func (mv *MessageView) Run(ctx context.Context) error {
 					break
 				}
 				for {
-					vo, err := NewOpenMessageView(ctx, mv.messages[mv.pos], mv.keys)
+					vo, err := mv.openCurrent(ctx)
 					if err != nil {
 						mv.errors <- errors.Wrapf(err, "Opening message")
 					} else {
@@ -760,17 +1132,82 @@ func (mv *MessageView) Run(ctx context.Context) error {
 					return err
 				}
 			case "e":
-				idch := make(chan []string)
-				ok, nm, ofs := mv.applyMarked(ctx, "archive", func(ctx context.Context, ids []string) error {
-					idch <- ids
-					return conn.BatchArchive(ctx, ids)
-				}, marked)
-				for _, id := range <-idch {
-					mv.messages[messagePos[id]].RemoveLabelIDLocal(cmdg.Inbox)
+				ids, _, _ := filterMarked(mv.messages, marked, mv.pos)
+				ok, nm, ofs := mv.applyMarked(ctx, "archive", conn.BatchArchive, marked)
+				if !ok {
+					break
+				}
+				labelLocal(ids, nil, []string{cmdg.Inbox})
+				if mv.label == cmdg.Inbox {
+					mv.pos -= ofs
+					scroll -= ofs
+					if scroll < 0 {
+						scroll = 0
+					}
+					mv.messages = nm
+					marked = map[string]bool{}
+					mkMessagePos()
+				}
+			case "!":
+				ids, _, _ := filterMarked(mv.messages, marked, mv.pos)
+				ok, nm, ofs := mv.applyMarked(ctx, "report spam", conn.BatchSpam, marked)
+				if !ok {
+					break
+				}
+				labelLocal(ids, []string{cmdg.Spam}, []string{cmdg.Inbox})
+				// Spam is not listed anywhere but in the spam label.
+				if mv.label != cmdg.Spam {
+					mv.pos -= ofs
+					scroll -= ofs
+					if scroll < 0 {
+						scroll = 0
+					}
+					mv.messages = nm
+					marked = map[string]bool{}
+					mkMessagePos()
+				}
+			case "$":
+				ids, _, _ := filterMarked(mv.messages, marked, mv.pos)
+				ok, nm, ofs := mv.applyMarked(ctx, "not spam", conn.BatchNotSpam, marked)
+				if !ok {
+					break
+				}
+				labelLocal(ids, []string{cmdg.Inbox}, []string{cmdg.Spam})
+				if mv.label == cmdg.Spam {
+					mv.pos -= ofs
+					scroll -= ofs
+					if scroll < 0 {
+						scroll = 0
+					}
+					mv.messages = nm
+					marked = map[string]bool{}
+					mkMessagePos()
+				}
+			case "m":
+				var msgs []*cmdg.Message
+				for _, msg := range mv.messages {
+					if marked[msg.ID] {
+						msgs = append(msgs, msg)
+					}
 				}
+				markThreads(mv.messages, marked)
+				ids, _, _ := filterMarked(mv.messages, marked, mv.pos)
+				ok, nm, ofs := mv.applyMarked(ctx, "mute", func(ctx context.Context, _ []string) error {
+					threads, err := threadIDs(ctx, msgs)
+					if err != nil {
+						return errors.Wrap(err, "finding threads to mute")
+					}
+					for _, tid := range threads {
+						if err := conn.MuteThread(ctx, tid); err != nil {
+							return err
+						}
+					}
+					return nil
+				}, marked)
 				if !ok {
 					break
 				}
+				labelLocal(ids, []string{cmdg.Muted}, []string{cmdg.Inbox})
 				if mv.label == cmdg.Inbox {
 					mv.pos -= ofs
 					scroll -= ofs
@@ -799,6 +1236,10 @@ func (mv *MessageView) Run(ctx context.Context) error {
 				if mv.pos >= len(mv.messages) {
 					break
 				}
+				if err := conn.CheckWrite("starring"); err != nil {
+					mv.errors <- err
+					break
+				}
 				// TODO: Because it's a toggle this is not suitable for batch operation.
 				curmsg := mv.messages[mv.pos]
 				f := curmsg.AddLabelID
@@ -816,8 +1257,26 @@ func (mv *MessageView) Run(ctx context.Context) error {
 						mv.errors <- errors.Wrapf(err, "%s STARRED label", verb)
 					}
 				}()
+			case "i":
+				ids, _, _ := filterMarked(mv.messages, marked, mv.pos)
+				if ok, _, _ := mv.applyMarked(ctx, "mark important", func(ctx context.Context, ids []string) error {
+					return conn.BatchLabel(ctx, ids, cmdg.Important)
+				}, marked); ok {
+					labelLocal(ids, []string{cmdg.Important}, nil)
+				}
+			case "I":
+				ids, _, _ := filterMarked(mv.messages, marked, mv.pos)
+				if ok, _, _ := mv.applyMarked(ctx, "mark not important", func(ctx context.Context, ids []string) error {
+					return conn.BatchUnlabel(ctx, ids, cmdg.Important)
+				}, marked); ok {
+					labelLocal(ids, nil, []string{cmdg.Important})
+				}
 			case "l":
 				// TODO: can this be partially merged with 'L' code?
+				if err := conn.CheckWrite("labelling"); err != nil {
+					mv.errors <- err
+					break
+				}
 				ids, _, _ := filterMarked(mv.messages, marked, mv.pos)
 				if len(ids) != 0 {
 					var opts []*dialog.Option
@@ -827,19 +1286,23 @@ func (mv *MessageView) Run(ctx context.Context) error {
 							Label: l.Label,
 						})
 					}
-					label, err := dialog.Selection(opts, "Label> ", false, mv.keys)
+					label, isNew, err := dialog.SelectionNew(opts, "Label> ", mv.keys)
+					if err == nil && isNew {
+						var l *cmdg.Label
+						if l, err = conn.CreateLabel(ctx, label.Key); err == nil {
+							label = &dialog.Option{Key: l.ID, Label: l.Label}
+						}
+					}
 					if errors.Cause(err) == dialog.ErrAborted {
 						// No-op.
 					} else if err != nil {
 						mv.errors <- errors.Wrapf(err, "Selecting label")
 					} else {
-						for _, id := range ids {
-							mv.messages[messagePos[id]].AddLabelIDLocal(label.Key)
-						}
+						labelLocal(ids, []string{label.Key}, nil)
 						log.Infof("Batch labelling %q/%q %d messages in the background…", label.Key, label.Label, len(ids))
 						go func() {
 							st := time.Now()
-							if err := conn.BatchLabel(ctx, ids, label.Key); err != nil {
+							if err := conn.BatchLabel(ctx, mv.messageIDs(ids), label.Key); err != nil {
 								mv.errors <- errors.Wrapf(err, "Batch labelling")
 							} else {
 								log.Infof("Batch labelled %d: %v", len(ids), time.Since(st))
@@ -848,6 +1311,10 @@ func (mv *MessageView) Run(ctx context.Context) error {
 					}
 				}
 			case "L":
+				if err := conn.CheckWrite("unlabelling"); err != nil {
+					mv.errors <- err
+					break
+				}
 				ids, _, _ := filterMarked(mv.messages, marked, mv.pos)
 				if len(ids) != 0 {
 					var opts []*dialog.Option
@@ -871,13 +1338,11 @@ func (mv *MessageView) Run(ctx context.Context) error {
 						} else if err != nil {
 							mv.errors <- errors.Wrapf(err, "Selecting label")
 						} else {
-							for _, id := range ids {
-								mv.messages[messagePos[id]].RemoveLabelIDLocal(label.Key)
-							}
+							labelLocal(ids, nil, []string{label.Key})
 							log.Infof("Batch unlabelling %q/%q from %d messages in the background…", label.Key, label.Label, len(ids))
 							go func() {
 								st := time.Now()
-								if err := conn.BatchUnlabel(ctx, ids, label.Key); err != nil {
+								if err := conn.BatchUnlabel(ctx, mv.messageIDs(ids), label.Key); err != nil {
 									mv.errors <- errors.Wrapf(err, "Batch labelling")
 								} else {
 									log.Infof("Batch unlabelled %d: %v", len(ids), time.Since(st))
@@ -943,15 +1408,27 @@ func (mv *MessageView) Run(ctx context.Context) error {
 				} else if err != nil {
 					mv.errors <- errors.Wrapf(err, "Selecting label")
 				} else {
-					nv := NewMessageView(ctx, label.Key, "", mv.keys)
+					nv := mv.newView(ctx, label.Key, "")
 					// TODO: not optimal, since it adds a
 					// stack frame on every navigation.
 					return nv.Run(ctx)
 				}
+			case input.Tab:
+				if mv.label != cmdg.Inbox {
+					log.Infof("Category tabs are only in the inbox, not %q", mv.label)
+					break
+				}
+				// TODO: not optimal, since it adds a
+				// stack frame on every navigation.
+				return newMessageView(ctx, mv.acct, mv.label, mv.query, nextCategory(mv.category), mv.conversations, mv.keys).Run(ctx)
 			case "1":
 				// TODO: not optimal, since it adds a
 				// stack frame on every navigation.
-				return NewMessageView(ctx, cmdg.Inbox, "", mv.keys).Run(ctx)
+				return mv.newView(ctx, cmdg.Inbox, "").Run(ctx)
+			case "T":
+				// TODO: not optimal, since it adds a
+				// stack frame on every navigation.
+				return newMessageView(ctx, mv.acct, mv.label, mv.query, mv.category, !mv.conversations, mv.keys).Run(ctx)
 			case "s", input.CtrlS:
 				q, err := dialog.Entry("Query> ", mv.keys)
 				if err == dialog.ErrAborted {
@@ -959,11 +1436,50 @@ func (mv *MessageView) Run(ctx context.Context) error {
 				} else if err != nil {
 					mv.errors <- errors.Wrapf(err, "Getting query")
 				} else if q != "" {
-					nv := NewMessageView(ctx, "", q, mv.keys)
+					nv := mv.newView(ctx, "", q)
 					// TODO: not optimal, since it adds a
 					// stack frame on every navigation.
 					return nv.Run(ctx)
 				}
+			case "M":
+				if err := manageLabels(ctx, conn, mv.keys); err != nil {
+					mv.errors <- err
+				}
+			case "V":
+				if err := vacationSettings(ctx, conn, mv.keys); err != nil {
+					mv.errors <- errors.Wrap(err, "vacation responder settings")
+				}
+			case "F":
+				var cur *cmdg.Message
+				if len(mv.messages) > 0 {
+					cur = mv.messages[mv.pos]
+				}
+				if err := manageFilters(ctx, conn, mv.keys, cur); err != nil {
+					mv.errors <- errors.Wrap(err, "managing filters")
+				}
+			case "A":
+				names, err := listAccounts()
+				if err != nil {
+					mv.errors <- err
+					break
+				}
+				opt, err := dialog.Selection(dialog.Strings2Options(names), "Account> ", false, mv.keys)
+				if errors.Cause(err) == dialog.ErrAborted {
+					// No-op.
+				} else if err != nil {
+					mv.errors <- errors.Wrapf(err, "Selecting account")
+				} else if opt.Key != mv.acct.name {
+					screen.Printlnf(screen.Height-1, "Connecting to %s…", opt.Key)
+					screen.Draw()
+					a, err := switchAccount(ctx, opt.Key)
+					if err != nil {
+						mv.errors <- err
+						break
+					}
+					// TODO: not optimal, since it adds a
+					// stack frame on every navigation.
+					return newMessageView(ctx, a, cmdg.Inbox, "", nil, mv.conversations, mv.keys).Run(ctx)
+				}
 			case "q":
 				return nil
 			default:
@@ -994,6 +1510,24 @@ func (mv *MessageView) Run(ctx context.Context) error {
 			log.Debugf("Print took %v", time.Since(st))
 		}
 		// Print status.
+		if s := accountStatus(mv.acct); s != "" {
+			status += "[" + s + "] "
+		}
+		if conn.ReadOnly() {
+			status += "Read-only "
+		}
+		if mv.conversations {
+			status += "Conversations "
+		}
+		if mv.category != nil {
+			status += mv.category.name + " "
+		}
+		if conn.VacationActive(time.Now()) {
+			status += display.Yellow + "Vacation responder ON" + display.Reset + " "
+		}
+		if n := conn.PendingJournal(); n > 0 {
+			status += fmt.Sprintf("Offline: %d pending ", n)
+		}
 		if theresMore {
 			status += display.Color(50) + "Loading…"
 		}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+)
+
+func TestHistoryThreadIDs(t *testing.T) {
+	msg := func(id, tid string) *gmail.Message {
+		return &gmail.Message{Id: id, ThreadId: tid}
+	}
+	hists := []*gmail.History{
+		{MessagesAdded: []*gmail.HistoryMessageAdded{{Message: msg("a2", "t1")}}},
+		{LabelsRemoved: []*gmail.HistoryLabelRemoved{{Message: msg("b1", "t2")}}},
+		{LabelsAdded: []*gmail.HistoryLabelAdded{{Message: msg("a1", "t1")}}},
+		{MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: msg("c1", "t3")}}},
+	}
+	if got, want := fmt.Sprint(historyThreadIDs(hists)), "[t1 t2 t3]"; got != want {
+		t.Errorf("Got %s, want %s", got, want)
+	}
+}
+
+// fakeThreads serves threads, with the labels of each message.
+type fakeThreads struct {
+	m       sync.Mutex
+	t       *testing.T
+	threads map[string][][2]string // Message ID and label.
+}
+
+func (f *fakeThreads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	id := strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/me/threads/")
+	msgs, found := f.threads[id]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": {"code": 404, "message": "Not Found"}}`)
+		return
+	}
+	resp := &gmail.Thread{Id: id}
+	for _, m := range msgs {
+		var labels []string
+		if m[1] != "" {
+			labels = []string{m[1]}
+		}
+		resp.Messages = append(resp.Messages, &gmail.Message{
+			Id:       m[0],
+			ThreadId: id,
+			LabelIds: labels,
+			Payload: &gmail.MessagePart{
+				Headers: []*gmail.MessagePartHeader{{Name: "Subject", Value: "Subject of " + m[0]}},
+			},
+		})
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		f.t.Error(err)
+	}
+}
+
+func TestMergeThreads(t *testing.T) {
+	fake := &fakeThreads{
+		t: t,
+		threads: map[string][][2]string{
+			"t1": {{"a1", cmdg.Inbox}},
+			"t2": {{"b1", cmdg.Inbox}},
+			"t3": {{"c1", cmdg.Inbox}},
+		},
+	}
+	serv := httptest.NewServer(fake)
+	defer serv.Close()
+	c, err := cmdg.NewFake(&http.Client{Transport: &redirector{base: serv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	mv := &MessageView{
+		acct:          &account{conn: c},
+		label:         cmdg.Inbox,
+		conversations: true,
+		threads:       make(map[string]*cmdg.Thread),
+	}
+	for _, u := range mv.reloadThreads(ctx, []cmdg.ThreadID{"t1", "t2", "t3"}) {
+		mv.threads[u.thread.Last().ID] = u.thread
+		mv.messages = append(mv.messages, u.thread.Last())
+	}
+	mv.pos = 2
+
+	fake.m.Lock()
+	fake.threads["t1"] = [][2]string{{"a1", cmdg.Inbox}, {"a2", cmdg.Inbox}} // New message.
+	fake.threads["t2"] = [][2]string{{"b1", ""}}                             // Archived.
+	fake.threads["t4"] = [][2]string{{"d1", cmdg.Inbox}}                     // New thread.
+	fake.threads["t5"] = [][2]string{{"e1", ""}}                             // Not in inbox.
+	fake.m.Unlock()
+
+	// t6 doesn't exist.
+	mv.mergeThreads(mv.reloadThreads(ctx, []cmdg.ThreadID{"t1", "t2", "t4", "t5", "t6"}))
+
+	var rows []string
+	for _, m := range mv.messages {
+		rows = append(rows, fmt.Sprintf("%s/%s", mv.threads[m.ID].ID, m.ID))
+	}
+	if got, want := strings.Join(rows, " "), "t4/d1 t1/a2 t3/c1"; got != want {
+		t.Errorf("Got rows %q, want %q", got, want)
+	}
+	if got := mv.messages[mv.pos].ID; got != "c1" {
+		t.Errorf("Current row moved to %q, want c1", got)
+	}
+	if len(mv.threads) != 3 {
+		t.Errorf("Got %d threads, want 3", len(mv.threads))
+	}
+}
@@ -42,8 +42,13 @@ r              — Reply
 s, ^s          — Search within message
 a              — Reply all
 e              — Archive
+!              — Report spam
+$              — Not spam
+m              — Mute and archive thread
 t              — Browse attachments (if any)
 H              — Force HTML view
+F              — Filters, including creating one from this message
++              — Add sender to contacts
 \              — Show raw message source
 |              — Pipe to command
 
@@ -109,10 +114,14 @@ func help(txt string, keys *input.Input) error {
 
 // OpenMessageView is the view for an open message.
 type OpenMessageView struct {
+	conn   *cmdg.CmdG
 	msg    *cmdg.Message
 	keys   *input.Input
 	screen *display.Screen
 
+	// Label of the message list the message was opened from.
+	label string
+
 	update chan struct{}
 	errors chan error
 
@@ -131,15 +140,17 @@ func dottime(t time.Time) string {
 }
 
 // NewOpenMessageView creates a new open message view.
-func NewOpenMessageView(ctx context.Context, msg *cmdg.Message, in *input.Input) (*OpenMessageView, error) {
+func NewOpenMessageView(ctx context.Context, conn *cmdg.CmdG, msg *cmdg.Message, label string, in *input.Input) (*OpenMessageView, error) {
 	screen, err := display.NewScreen()
 	if err != nil {
 		return nil, err
 	}
 	ov := &OpenMessageView{
+		conn:   conn,
 		msg:    msg,
 		keys:   in,
 		screen: screen,
+		label:  label,
 		update: make(chan struct{}),
 		errors: make(chan error, 20),
 	}
@@ -277,6 +288,29 @@ func (ov *OpenMessageView) Draw(lines []string, scroll int) error {
 	return nil
 }
 
+// wrapLines splits a message body into lines no wider than `width`.
+func wrapLines(b string, width int) []string {
+	lines := []string{}
+	for _, l := range strings.Split(b, "\n") {
+		if len(l) == 0 {
+			lines = append(lines, "")
+			continue
+		}
+		for len(l) > 0 {
+			// TODO: break on runewidth
+			// TODO: break on word boundary
+			if len(l) > width {
+				lines = append(lines, l[:width])
+				l = l[width:]
+			} else {
+				lines = append(lines, l)
+				l = ""
+			}
+		}
+	}
+	return lines
+}
+
 func showError(oscreen *display.Screen, keys *input.Input, msg string) {
 	log.Warningf("Displaying error to user: %q", msg)
 
@@ -442,29 +476,12 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 			if err != nil {
 				ov.errors <- errors.Wrapf(err, "Getting message body")
 			} else {
-				lines = []string{}
-				for _, l := range strings.Split(b, "\n") {
-					if len(l) == 0 {
-						lines = append(lines, "")
-						continue
-					}
-					for len(l) > 0 {
-						// TODO: break on runewidth
-						// TODO: break on word boundary
-						if len(l) > ov.screen.Width {
-							lines = append(lines, l[:ov.screen.Width])
-							l = l[ov.screen.Width:]
-						} else {
-							lines = append(lines, l)
-							l = ""
-						}
-					}
-				}
+				lines = wrapLines(b, ov.screen.Width)
 			}
 			go func() {
 				if ov.msg.IsUnread() {
 					st := time.Now()
-					if err := ov.msg.RemoveLabelID(ctx, cmdg.Unread); err != nil {
+					if err := ov.msg.MarkRead(ctx); err != nil {
 						ov.errors <- errors.Wrapf(err, "Failed to remove unread label")
 					} else {
 						log.Infof("Marked unread in %v", time.Since(st))
@@ -511,7 +528,7 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 				ov.Draw(lines, scroll)
 			case "l":
 				var opts []*dialog.Option
-				for _, l := range conn.Labels() {
+				for _, l := range ov.conn.Labels() {
 					opts = append(opts, &dialog.Option{
 						Key:   l.ID,
 						Label: l.Label,
@@ -593,15 +610,15 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 				scroll = ov.scroll(ctx, len(lines), scroll, -1)
 				ov.Draw(lines, scroll)
 			case "f":
-				if err := forward(ctx, conn, ov.keys, ov.msg); err != nil {
+				if err := forward(ctx, ov.conn, ov.keys, ov.msg); err != nil {
 					ov.errors <- fmt.Errorf("Failed to forward: %v", err)
 				}
 			case "r":
-				if err := reply(ctx, conn, ov.keys, ov.msg); err != nil {
+				if err := reply(ctx, ov.conn, ov.keys, ov.msg); err != nil {
 					ov.errors <- fmt.Errorf("Failed to reply: %v", err)
 				}
 			case "a":
-				if err := replyAll(ctx, conn, ov.keys, ov.msg); err != nil {
+				if err := replyAll(ctx, ov.conn, ov.keys, ov.msg); err != nil {
 					ov.errors <- fmt.Errorf("Failed to replyAll: %v", err)
 				}
 			case "H":
@@ -610,12 +627,57 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 				go func() {
 					ov.update <- struct{}{}
 				}()
+			case "F":
+				if err := manageFilters(ctx, ov.conn, ov.keys, ov.msg); err != nil {
+					ov.errors <- errors.Wrap(err, "managing filters")
+				}
+			case "+":
+				if err := addToContacts(ctx, ov.conn, ov.keys, ov.msg); err == dialog.ErrAborted {
+					// No-op.
+				} else if err != nil {
+					ov.errors <- errors.Wrap(err, "adding contact")
+				}
 			case "e": // Archive
 				if err := ov.msg.RemoveLabelID(ctx, cmdg.Inbox); err != nil {
 					ov.errors <- fmt.Errorf("Failed to archive : %v", err)
 				} else {
 					return OpRemoveCurrent(nil), nil
 				}
+			case "!": // Report spam
+				if err := ov.conn.BatchSpam(ctx, []string{ov.msg.ID}); err != nil {
+					ov.errors <- fmt.Errorf("Failed to report spam: %v", err)
+				} else {
+					ov.msg.RemoveLabelIDLocal(cmdg.Inbox)
+					ov.msg.AddLabelIDLocal(cmdg.Spam)
+					// Spam is not listed anywhere but in the spam label.
+					if ov.label != cmdg.Spam {
+						return OpRemoveCurrent(nil), nil
+					}
+				}
+			case "$": // Not spam
+				if err := ov.conn.BatchNotSpam(ctx, []string{ov.msg.ID}); err != nil {
+					ov.errors <- fmt.Errorf("Failed to mark as not spam: %v", err)
+				} else {
+					ov.msg.RemoveLabelIDLocal(cmdg.Spam)
+					ov.msg.AddLabelIDLocal(cmdg.Inbox)
+					if ov.label == cmdg.Spam {
+						return OpRemoveCurrent(nil), nil
+					}
+				}
+			case "m": // Mute
+				if err := func() error {
+					tid, err := ov.msg.ThreadID(ctx)
+					if err != nil {
+						return err
+					}
+					return ov.conn.MuteThread(ctx, tid)
+				}(); err != nil {
+					ov.errors <- fmt.Errorf("Failed to mute thread: %v", err)
+				} else {
+					ov.msg.RemoveLabelIDLocal(cmdg.Inbox)
+					ov.msg.AddLabelIDLocal(cmdg.Muted)
+					return OpRemoveCurrent(nil), nil
+				}
 			case "s", input.CtrlS: // Search
 				ns, err := ov.incrementalSearch(ctx, lines)
 				if err != nil {
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/display"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+const (
+	openThreadViewHelp = `?, F1     — Help
+^R             — Reload
+u              — Exit thread
+n, Down        — Scroll down
+space          — Page down
+backspace      — Page up
+p, Up          — Scroll up
+^P             — Previous thread
+^N             — Next thread
+f              — Forward last message
+r              — Reply to last message
+a              — Reply all to last message
+e              — Archive thread
+
+Press [enter] to exit
+`
+)
+
+// OpenThreadView is the view for an open thread, showing all messages one after the other.
+type OpenThreadView struct {
+	conn   *cmdg.CmdG
+	thread *cmdg.Thread
+	keys   *input.Input
+	screen *display.Screen
+
+	update chan struct{}
+	errors chan error
+}
+
+// NewOpenThreadView creates a new open thread view.
+func NewOpenThreadView(ctx context.Context, conn *cmdg.CmdG, thread *cmdg.Thread, in *input.Input) (*OpenThreadView, error) {
+	screen, err := display.NewScreen()
+	if err != nil {
+		return nil, err
+	}
+	tv := &OpenThreadView{
+		conn:   conn,
+		thread: thread,
+		keys:   in,
+		screen: screen,
+		update: make(chan struct{}),
+		errors: make(chan error, 20),
+	}
+	go func() {
+		st := time.Now()
+		if err := thread.Preload(ctx, cmdg.LevelFull); err != nil {
+			tv.errors <- err
+		}
+		log.Infof("Got full thread in %v", time.Since(st))
+		tv.update <- struct{}{}
+	}()
+	return tv, nil
+}
+
+// threadLines renders all messages of the thread, with a short header for each.
+func (tv *OpenThreadView) threadLines(ctx context.Context) ([]string, error) {
+	var lines []string
+	for n, msg := range tv.thread.Messages() {
+		from, err := msg.GetHeader(ctx, "From")
+		if err != nil {
+			from = fmt.Sprintf("Unknown: %q", err)
+		}
+		date := "???"
+		if ts, err := msg.GetTime(ctx); err == nil {
+			date = ts.Format(tsLayout)
+		}
+		b, err := msg.GetBody(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting body of message %q", msg.ID)
+		}
+		if n > 0 {
+			lines = append(lines, "", strings.Repeat("—", tv.screen.Width))
+		}
+		lines = append(lines, fmt.Sprintf("%sFrom: %s%s", display.Bold, from, display.Reset))
+		lines = append(lines, fmt.Sprintf("%sDate: %s%s", display.Bold, date, display.Reset))
+		lines = append(lines, "")
+		lines = append(lines, wrapLines(b, tv.screen.Width)...)
+	}
+	return lines, nil
+}
+
+// Draw draws the open thread.
+func (tv *OpenThreadView) Draw(lines []string, scroll int) {
+	// Should never make RPCs.
+	ctx := cancelledContext()
+
+	subject := "(No subject)"
+	if msgs := tv.thread.Messages(); len(msgs) > 0 {
+		if s, err := msgs[0].GetSubject(ctx); err == nil && s != "" {
+			subject = s
+		}
+	}
+	tv.screen.Printlnf(0, "Thread of %d messages: %s", tv.thread.Len(), subject)
+	tv.screen.Printlnf(1, strings.Repeat("—", tv.screen.Width))
+	line := 2
+	if len(lines) > scroll {
+		for _, l := range lines[scroll:] {
+			tv.screen.Printlnf(line, "%s", strings.TrimRight(l, "\r "))
+			line++
+			if line >= tv.screen.Height-2 {
+				break
+			}
+		}
+	}
+	for ; line < tv.screen.Height-2; line++ {
+		tv.screen.Printlnf(line, "")
+	}
+	tv.screen.Printlnf(tv.screen.Height-2, strings.Repeat("—", tv.screen.Width))
+}
+
+func (tv *OpenThreadView) scroll(lines, scroll, inc int) int {
+	scroll += inc
+	if maxscroll := lines - tv.screen.Height + 4; scroll >= maxscroll {
+		scroll = maxscroll
+	}
+	if scroll < 0 {
+		scroll = 0
+	}
+	return scroll
+}
+
+// Run runs the open thread view event loop.
+func (tv *OpenThreadView) Run(ctx context.Context) (*MessageViewOp, error) {
+	log.Infof("Running OpenThreadView")
+	scroll := 0
+	tv.screen.Printf(0, 0, "Loading…")
+	tv.screen.Draw()
+	var lines []string
+	markedRead := false
+	for {
+		select {
+		case <-tv.keys.Winch():
+			var err error
+			if tv.screen, err = display.NewScreen(); err != nil {
+				return nil, err
+			}
+			go func() {
+				tv.update <- struct{}{}
+			}()
+		case err := <-tv.errors:
+			if err != nil {
+				showError(tv.screen, tv.keys, err.Error())
+				tv.screen.Draw()
+			}
+			continue
+		case <-tv.update:
+			var err error
+			lines, err = tv.threadLines(ctx)
+			if err != nil {
+				tv.errors <- err
+			}
+			// Only when first shown. Later updates are reloads and
+			// window resizes, and anything that's become unread
+			// since then was marked so by someone else.
+			var unread []string
+			if !markedRead && err == nil {
+				markedRead = true
+				for _, m := range tv.thread.Messages() {
+					if m.IsUnread() {
+						unread = append(unread, m.ID)
+						m.RemoveLabelIDLocal(cmdg.Unread)
+					}
+				}
+			}
+			if len(unread) > 0 {
+				go func() {
+					if err := tv.conn.BatchMarkRead(ctx, unread); err != nil {
+						tv.errors <- errors.Wrapf(err, "Failed to remove unread label")
+					}
+				}()
+			}
+			tv.screen.Clear()
+			tv.Draw(lines, scroll)
+		case key, ok := <-tv.keys.Chan():
+			if !ok {
+				log.Errorf("OpenThread: Input channel closed!")
+				continue
+			}
+			switch key {
+			case "?", input.F1:
+				help(openThreadViewHelp, tv.keys)
+			case input.CtrlR:
+				go func() {
+					if err := tv.thread.Reload(ctx, cmdg.LevelFull); err != nil {
+						tv.errors <- errors.Wrap(err, "reloading thread")
+					}
+					tv.update <- struct{}{}
+				}()
+			case "u":
+				return nil, nil
+			case "q":
+				return OpQuit(), nil
+			case input.CtrlP:
+				return OpPrev(), nil
+			case input.CtrlN:
+				return OpNext(), nil
+			case input.Home:
+				scroll = 0
+			case "n", input.Down:
+				tv.screen.UseCache()
+				scroll = tv.scroll(len(lines), scroll, 1)
+			case " ", input.CtrlV, input.PgDown:
+				scroll = tv.scroll(len(lines), scroll, tv.screen.Height-4)
+			case "p", input.Up:
+				tv.screen.UseCache()
+				scroll = tv.scroll(len(lines), scroll, -1)
+			case input.Backspace, input.CtrlH, input.PgUp, "Meta-v":
+				scroll = tv.scroll(len(lines), scroll, -(tv.screen.Height - 4))
+			case "f", "r", "a":
+				last := tv.thread.Last()
+				if last == nil {
+					break
+				}
+				f := map[string]func(context.Context, *cmdg.CmdG, *input.Input, *cmdg.Message) error{
+					"f": forward,
+					"r": reply,
+					"a": replyAll,
+				}[key]
+				if err := f(ctx, tv.conn, tv.keys, last); err != nil {
+					tv.errors <- errors.Wrapf(err, "Failed to reply or forward")
+				}
+			case "e": // Archive
+				if err := tv.conn.BatchArchive(ctx, tv.thread.MessageIDs()); err != nil {
+					tv.errors <- fmt.Errorf("Failed to archive: %v", err)
+				} else {
+					for _, m := range tv.thread.Messages() {
+						m.RemoveLabelIDLocal(cmdg.Inbox)
+					}
+					return OpRemoveCurrent(nil), nil
+				}
+			default:
+				log.Infof("Unknown key: %q", key)
+			}
+			tv.Draw(lines, scroll)
+		}
+		tv.screen.Draw()
+	}
+}
@@ -0,0 +1,340 @@
+package cmdg
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// AddressBook is a source of contacts other than Google.
+type AddressBook interface {
+	// Name is used in logs and errors.
+	Name() string
+
+	// Load reads all contacts.
+	Load() ([]*Contact, error)
+}
+
+// VCardDir is a directory of .vcf files, searched recursively.
+type VCardDir string
+
+// Name implements AddressBook.
+func (d VCardDir) Name() string {
+	return "vCard directory " + string(d)
+}
+
+// Load implements AddressBook.
+func (d VCardDir) Load() ([]*Contact, error) {
+	var ret []*Contact
+	err := filepath.Walk(string(d), func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !strings.EqualFold(filepath.Ext(fn), ".vcf") {
+			return nil
+		}
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cs, err := parseVCards(f)
+		if err != nil {
+			return errors.Wrapf(err, "parsing %q", fn)
+		}
+		ret = append(ret, cs...)
+		return nil
+	})
+	return ret, err
+}
+
+// vcardUnescape undoes vCard value escaping.
+func vcardUnescape(s string) string {
+	return strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+// vcardSplit splits on `sep`, except where escaped.
+func vcardSplit(s string, sep byte) []string {
+	var ret []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			ret = append(ret, vcardUnescape(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(ret, vcardUnescape(s[start:]))
+}
+
+// parseVCards parses all vCards in the stream. Only the fields for
+// Contact are used.
+func parseVCards(r io.Reader) ([]*Contact, error) {
+	// Unfold continuation lines.
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		l := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		lines = append(lines, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var ret []*Contact
+	var cur *Contact
+	var structName string
+	for _, l := range lines {
+		colon := strings.Index(l, ":")
+		if colon < 0 {
+			continue
+		}
+		// Drop parameters and property group.
+		prop := strings.ToUpper(strings.SplitN(l[:colon], ";", 2)[0])
+		if dot := strings.LastIndex(prop, "."); dot >= 0 {
+			prop = prop[dot+1:]
+		}
+		value := l[colon+1:]
+		switch {
+		case prop == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			cur = &Contact{}
+			structName = ""
+		case cur == nil:
+		case prop == "END" && strings.EqualFold(value, "VCARD"):
+			if cur.Name == "" {
+				cur.Name = structName
+			}
+			if len(cur.Emails) > 0 {
+				ret = append(ret, cur)
+			}
+			cur = nil
+		case prop == "FN":
+			cur.Name = vcardUnescape(value)
+		case prop == "N":
+			// Family;Given;Additional;Prefix;Suffix
+			p := vcardSplit(value, ';')
+			var ns []string
+			for _, i := range []int{1, 0} {
+				if i < len(p) && p[i] != "" {
+					ns = append(ns, p[i])
+				}
+			}
+			structName = strings.Join(ns, " ")
+		case prop == "EMAIL":
+			if e := strings.TrimSpace(vcardUnescape(value)); e != "" {
+				cur.Emails = append(cur.Emails, e)
+			}
+		case prop == "NICKNAME":
+			if cur.Nickname == "" {
+				cur.Nickname = strings.TrimSpace(vcardSplit(value, ',')[0])
+			}
+		case prop == "ORG":
+			if cur.Organization == "" {
+				cur.Organization = vcardSplit(value, ';')[0]
+			}
+		case prop == "CATEGORIES":
+			for _, g := range vcardSplit(value, ',') {
+				if g = strings.TrimSpace(g); g != "" {
+					cur.Groups = append(cur.Groups, g)
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Abook is an addressbook file from the abook program.
+type Abook string
+
+// Name implements AddressBook.
+func (a Abook) Name() string {
+	return "abook file " + string(a)
+}
+
+// Load implements AddressBook.
+func (a Abook) Load() ([]*Contact, error) {
+	f, err := os.Open(string(a))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseAbook(f)
+}
+
+// parseAbook parses an abook addressbook file. Each entry is an ini section.
+func parseAbook(r io.Reader) ([]*Contact, error) {
+	var ret []*Contact
+	var cur *Contact
+	done := func() {
+		if cur != nil && len(cur.Emails) > 0 {
+			ret = append(ret, cur)
+		}
+		cur = nil
+	}
+	split := func(s string) []string {
+		var ret []string
+		for _, t := range strings.Split(s, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				ret = append(ret, t)
+			}
+		}
+		return ret
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if strings.HasPrefix(l, "[") && strings.HasSuffix(l, "]") {
+			done()
+			if l != "[format]" {
+				cur = &Contact{}
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "name":
+			cur.Name = strings.TrimSpace(kv[1])
+		case "email":
+			cur.Emails = split(kv[1])
+		case "nick":
+			cur.Nickname = strings.TrimSpace(kv[1])
+		case "groups":
+			cur.Groups = split(kv[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	done()
+	return ret, nil
+}
+
+// mergeContacts adds the local contacts to the Google ones. A local
+// contact with an email address matching a contact already known is
+// the same person, so its other email addresses, and any
+// missing nickname, organization, and groups, are added to that one.
+// The returned list is sorted by name.
+func mergeContacts(google []*Contact, local []*Contact) []*Contact {
+	byEmail := make(map[string]*Contact)
+	var ret []*Contact
+	add := func(co *Contact) {
+		for _, e := range co.Emails {
+			byEmail[strings.ToLower(e)] = co
+		}
+	}
+	for _, co := range google {
+		t := *co
+		t.Emails = append([]string(nil), co.Emails...)
+		ret = append(ret, &t)
+		add(&t)
+	}
+	for _, co := range local {
+		var existing *Contact
+		for _, e := range co.Emails {
+			if existing = byEmail[strings.ToLower(e)]; existing != nil {
+				break
+			}
+		}
+		if existing == nil {
+			n := *co
+			n.Emails = append([]string(nil), co.Emails...)
+			ret = append(ret, &n)
+			add(&n)
+			continue
+		}
+		for _, e := range co.Emails {
+			if byEmail[strings.ToLower(e)] == nil {
+				existing.Emails = append(existing.Emails, e)
+			}
+		}
+		if existing.Nickname == "" {
+			existing.Nickname = co.Nickname
+		}
+		if existing.Organization == "" {
+			existing.Organization = co.Organization
+		}
+		existing.Groups = mergeGroups(existing.Groups, co.Groups)
+		add(existing)
+	}
+	sortContacts(ret)
+	return ret
+}
+
+// mergeGroups returns the union of the two group lists, as a new slice.
+func mergeGroups(a, b []string) []string {
+	var ret []string
+	ret = append(ret, a...)
+	for _, g := range b {
+		found := false
+		for _, t := range ret {
+			if strings.EqualFold(t, g) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, g)
+		}
+	}
+	return ret
+}
+
+// sortContacts sorts by name, or by first email address if there's no name.
+func sortContacts(cs []*Contact) {
+	sortKey := func(co *Contact) string {
+		if co.Name != "" {
+			return strings.ToLower(co.Name)
+		}
+		return strings.ToLower(co.Emails[0])
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		return sortKey(cs[i]) < sortKey(cs[j])
+	})
+}
+
+// AddAddressBook adds a local address book, merged into the contacts on next LoadContacts.
+func (c *CmdG) AddAddressBook(ab AddressBook) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.addressBooks = append(c.addressBooks, ab)
+}
+
+// loadAddressBooks loads all local address books. Errors are logged,
+// and that address book skipped.
+func (c *CmdG) loadAddressBooks() []*Contact {
+	c.m.RLock()
+	abs := c.addressBooks
+	c.m.RUnlock()
+	var ret []*Contact
+	for _, ab := range abs {
+		cs, err := ab.Load()
+		if err != nil {
+			log.Errorf("Failed to load %s: %v", ab.Name(), err)
+			continue
+		}
+		log.Infof("Loaded %d contacts from %s", len(cs), ab.Name())
+		ret = append(ret, cs...)
+	}
+	return ret
+}
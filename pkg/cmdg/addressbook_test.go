@@ -0,0 +1,114 @@
+package cmdg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVCards(t *testing.T) {
+	in := strings.Join([]string{
+		"BEGIN:VCARD",
+		"VERSION:3.0",
+		"FN:Alice Smith",
+		"N:Smith;Alice;;;",
+		"NICKNAME:ally,al",
+		"ORG:Acme\\, Inc.;Engineering",
+		"item1.EMAIL;TYPE=INTERNET:alice@example.com",
+		"EMAIL;TYPE=WORK:alice@acme.exa",
+		" mple.com",
+		"CATEGORIES:friends,work",
+		"END:VCARD",
+		"BEGIN:VCARD",
+		"VERSION:4.0",
+		"N:Jones;Bob;;;",
+		"EMAIL:bob@example.com",
+		"END:VCARD",
+		"BEGIN:VCARD",
+		"FN:No Email",
+		"END:VCARD",
+	}, "\r\n")
+	got, err := parseVCards(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Contact{
+		{
+			Name:         "Alice Smith",
+			Emails:       []string{"alice@example.com", "alice@acme.example.com"},
+			Nickname:     "ally",
+			Organization: "Acme, Inc.",
+			Groups:       []string{"friends", "work"},
+		},
+		{
+			Name:   "Bob Jones",
+			Emails: []string{"bob@example.com"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseAbook(t *testing.T) {
+	in := `# abook addressbook file
+
+[format]
+program=abook
+version=0.6.1
+
+
+[0]
+name=Carol
+email=carol@example.com, carol@example.org
+nick=cc
+groups=work
+
+[1]
+name=Nobody
+`
+	got, err := parseAbook(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Contact{
+		{
+			Name:     "Carol",
+			Emails:   []string{"carol@example.com", "carol@example.org"},
+			Nickname: "cc",
+			Groups:   []string{"work"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestMergeContacts(t *testing.T) {
+	google := []*Contact{
+		{Name: "Bob", Emails: []string{"bob@example.com"}, Groups: []string{"Friends"}},
+		{Name: "Carol", Emails: []string{"carol@work.example"}},
+	}
+	local := []*Contact{
+		{Name: "Robert", Emails: []string{"BOB@example.com", "bob@home.example"}, Nickname: "bobby", Groups: []string{"friends", "chess"}},
+		{Name: "Alice", Emails: []string{"alice@example.com"}},
+		{Name: "Alice again", Emails: []string{"alice@example.com"}},
+		{Name: "carol", Emails: []string{"carol@home.example"}, Organization: "Acme"},
+	}
+	got := mergeContacts(google, local)
+	want := []*Contact{
+		{Name: "Alice", Emails: []string{"alice@example.com"}},
+		{Name: "Bob", Emails: []string{"bob@example.com", "bob@home.example"}, Nickname: "bobby", Groups: []string{"Friends", "chess"}},
+		{Name: "Carol", Emails: []string{"carol@work.example"}},
+		{Name: "carol", Emails: []string{"carol@home.example"}, Organization: "Acme"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		for _, c := range got {
+			t.Logf("got %+v", c)
+		}
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if len(google[0].Groups) != 1 || google[0].Nickname != "" || len(google[0].Emails) != 1 {
+		t.Errorf("Input modified: %+v", google[0])
+	}
+}
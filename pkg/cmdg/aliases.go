@@ -0,0 +1,167 @@
+package cmdg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// splitAddressList splits an address list on commas that are not inside
+// quotes, comments, angle brackets, or groups ("Name: a, b;"). Empty
+// entries are dropped.
+func splitAddressList(s string) []string {
+	var ret []string
+	var cur strings.Builder
+	inQuote := false
+	inGroup := false
+	escaped := false
+	depth := 0 // Parentheses and angle brackets.
+	add := func() {
+		if t := strings.TrimSpace(cur.String()); t != "" {
+			ret = append(ret, t)
+		}
+		cur.Reset()
+	}
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			inQuote = !inQuote
+		case inQuote:
+		case r == '(' || r == '<':
+			depth++
+		case (r == ')' || r == '>') && depth > 0:
+			depth--
+		case depth > 0:
+		case r == ':':
+			inGroup = true
+		case r == ';':
+			inGroup = false
+		case r == ',' && !inGroup:
+			add()
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	add()
+	return ret
+}
+
+// splitGroup splits a group ("Name: a, b;") into its name and members.
+func splitGroup(a string) (string, string, bool) {
+	if !strings.HasSuffix(a, ";") {
+		return "", "", false
+	}
+	i := strings.Index(a, ":")
+	if i < 0 || strings.Contains(a[:i], "@") {
+		return "", "", false
+	}
+	return strings.TrimSpace(a[:i]), strings.TrimSuffix(a[i+1:], ";"), true
+}
+
+// expandAddresses replaces each entry that is not an email address with
+// what `lookup` returns for it, recursively. Unknown names are an error.
+// Groups are kept, with their members expanded.
+func expandAddresses(s string, lookup func(string) ([]string, bool)) (string, error) {
+	var expand func(string, []string, *[]string, map[string]bool) error
+	expand = func(s string, path []string, ret *[]string, seen map[string]bool) error {
+		for _, a := range splitAddressList(s) {
+			if name, members, ok := splitGroup(a); ok {
+				var sub []string
+				if err := expand(members, path, &sub, make(map[string]bool)); err != nil {
+					return err
+				}
+				*ret = append(*ret, strings.TrimSpace(fmt.Sprintf("%s: %s", name, strings.Join(sub, ", ")))+";")
+				continue
+			}
+			if strings.Contains(a, "@") {
+				k := strings.ToLower(a)
+				if !seen[k] {
+					seen[k] = true
+					*ret = append(*ret, a)
+				}
+				continue
+			}
+			name := strings.ToLower(strings.Trim(a, `"`))
+			for _, p := range path {
+				if p == name {
+					return fmt.Errorf("alias loop: %s -> %s", strings.Join(path, " -> "), name)
+				}
+			}
+			members, found := lookup(name)
+			if !found {
+				return fmt.Errorf("%q is not an email address, alias, or contact group", a)
+			}
+			if err := expand(strings.Join(members, ", "), append(path, name), ret, seen); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var ret []string
+	if err := expand(s, nil, &ret, make(map[string]bool)); err != nil {
+		return "", err
+	}
+	return strings.Join(ret, ", "), nil
+}
+
+// lookupAlias returns the addresses for the lower case alias or contact
+// group name. Aliases from the config take precedence.
+func (c *CmdG) lookupAlias(name string) ([]string, bool) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	for k, v := range c.aliases {
+		if strings.ToLower(k) == name {
+			return v, true
+		}
+	}
+	var ret []string
+	found := false
+	for _, co := range c.contacts {
+		for _, g := range co.Groups {
+			if strings.ToLower(g) == name {
+				found = true
+				if len(co.Emails) > 0 {
+					ret = append(ret, co.Address(co.Emails[0]))
+				}
+			}
+		}
+	}
+	return ret, found
+}
+
+// ExpandAddressList expands aliases and contact group names in the
+// address list to their member addresses.
+func (c *CmdG) ExpandAddressList(s string) (string, error) {
+	ret, err := expandAddresses(s, c.lookupAlias)
+	return ret, errors.Wrapf(err, "expanding %q", s)
+}
+
+// AliasNames returns the names of all aliases and contact groups, sorted.
+func (c *CmdG) AliasNames() []string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	seen := make(map[string]bool)
+	var ret []string
+	add := func(s string) {
+		if !seen[strings.ToLower(s)] {
+			seen[strings.ToLower(s)] = true
+			ret = append(ret, s)
+		}
+	}
+	for k := range c.aliases {
+		add(k)
+	}
+	for _, co := range c.contacts {
+		for _, g := range co.Groups {
+			add(g)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,99 @@
+package cmdg
+
+import (
+	"net/http"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitAddressList(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{" , ,", nil},
+		{"a@example.com", []string{"a@example.com"}},
+		{"team, bob@example.com", []string{"team", "bob@example.com"}},
+		{`"Smith, Alice" <alice@example.com>, bob`, []string{`"Smith, Alice" <alice@example.com>`, "bob"}},
+		{`"Say \"hi, there\"" <a@example.com>,b`, []string{`"Say \"hi, there\"" <a@example.com>`, "b"}},
+		{"a@example.com (Alice, A), <weird,@example.com>", []string{"a@example.com (Alice, A)", "<weird,@example.com>"}},
+		{"undisclosed-recipients:;", []string{"undisclosed-recipients:;"}},
+		{"Team: a@example.com, b@example.com;, c@example.com", []string{"Team: a@example.com, b@example.com;", "c@example.com"}},
+		{`"Re: x" <a@example.com>, b@example.com`, []string{`"Re: x" <a@example.com>`, "b@example.com"}},
+	} {
+		if got := splitAddressList(test.in); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitAddressList(%q): got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestExpandAddresses(t *testing.T) {
+	aliases := map[string][]string{
+		"team":  {"Alice <alice@example.com>", "bob@example.com"},
+		"all":   {"team", "carol@example.com"},
+		"loop1": {"loop2"},
+		"loop2": {"loop1"},
+	}
+	lookup := func(s string) ([]string, bool) {
+		v, found := aliases[s]
+		return v, found
+	}
+	for _, test := range []struct {
+		in, want, err string
+	}{
+		{in: "", want: ""},
+		{in: "dave@example.com", want: "dave@example.com"},
+		{in: "Team", want: "Alice <alice@example.com>, bob@example.com"},
+		{in: "all, BOB@example.com", want: "Alice <alice@example.com>, bob@example.com, carol@example.com"},
+		{in: `"team"`, want: "Alice <alice@example.com>, bob@example.com"},
+		{in: "bob@example.com, nosuch", err: `"nosuch" is not an email address`},
+		{in: "loop1", err: "alias loop"},
+		{in: "undisclosed-recipients:;", want: "undisclosed-recipients:;"},
+		{in: "Friends: team, dave@example.com;, bob@example.com", want: "Friends: Alice <alice@example.com>, bob@example.com, dave@example.com;, bob@example.com"},
+		{in: "Friends: nosuch;", err: `"nosuch" is not an email address`},
+	} {
+		got, err := expandAddresses(test.in, lookup)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expandAddresses(%q): got error %v, want %q", test.in, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandAddresses(%q): %v", test.in, err)
+		} else if got != test.want {
+			t.Errorf("expandAddresses(%q): got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestAssemblePartsExpands(t *testing.T) {
+	c, err := NewFake(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.aliases = map[string][]string{"team": {"alice@example.com", "bob@example.com"}}
+	head := mail.Header{
+		"To":  {"team"},
+		"Cc":  {"undisclosed-recipients:;"},
+		"Bcc": {"Friends: team, carol@example.com;"},
+	}
+	msg, err := c.assembleParts("mixed", head, []*Part{{Contents: "hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"To: alice@example.com, bob@example.com\r\n",
+		"Bcc: alice@example.com, bob@example.com, carol@example.com\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Message is missing %q:\n%s", want, msg)
+		}
+	}
+	if strings.Contains(msg, "Cc:") {
+		t.Errorf("Empty group added a header:\n%s", msg)
+	}
+}
@@ -0,0 +1,400 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Inside the backup Maildir.
+	backupIndexName = ".cmdg-backup.json"
+	backupLockName  = ".cmdg-backup.lock"
+)
+
+// backupEntry is a message in the backup.
+type backupEntry struct {
+	// Relative to the Maildir.
+	File string `json:"file"`
+
+	// Seconds since epoch.
+	Date     int64    `json:"date"`
+	LabelIDs []string `json:"labels"`
+}
+
+// backupIndex is what's in the backup, and how far into history it is.
+type backupIndex struct {
+	// Zero until the first full download has finished.
+	HistoryID HistoryID               `json:"history_id"`
+	Messages  map[string]*backupEntry `json:"messages"`
+}
+
+// BackupResult is what changed in a backup run.
+type BackupResult struct {
+	Full    bool // If all messages were listed, instead of using history.
+	Added   int
+	Updated int
+	Deleted int
+}
+
+func readBackupIndex(fn string) (*backupIndex, error) {
+	idx := &backupIndex{}
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		// New backup.
+	} else if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(b, idx); err != nil {
+		return nil, errors.Wrapf(err, "parsing %q", fn)
+	}
+	if idx.Messages == nil {
+		idx.Messages = make(map[string]*backupEntry)
+	}
+	return idx, nil
+}
+
+func (idx *backupIndex) write(fn string) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fn, b)
+}
+
+// backup is one backup run.
+type backup struct {
+	c     *CmdG
+	dir   string
+	index *backupIndex
+	res   BackupResult
+}
+
+func (b *backup) indexFile() string {
+	return path.Join(b.dir, backupIndexName)
+}
+
+// skipBackup returns true for messages that are not backed up. Like
+// the message list, that's spam and trash.
+func skipBackup(labelIDs []string) bool {
+	for _, l := range labelIDs {
+		if l == Spam || l == Trash {
+			return true
+		}
+	}
+	return false
+}
+
+// sameStrings returns true if a and b have the same strings, in any order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := make(map[string]int)
+	for _, s := range a {
+		m[s]++
+	}
+	for _, s := range b {
+		if m[s] == 0 {
+			return false
+		}
+		m[s]--
+	}
+	return true
+}
+
+// remove deletes a message from the backup, if it's there.
+func (b *backup) remove(id string) error {
+	e, found := b.index.Messages[id]
+	if !found {
+		return nil
+	}
+	if err := os.Remove(path.Join(b.dir, e.File)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(b.index.Messages, id)
+	b.res.Deleted++
+	return nil
+}
+
+// relabel rewrites a backed up message with new labels. The labels
+// header changes, and maybe the flags in the file name.
+//
+// Returns found=false if the file is gone, e.g. because an earlier run
+// renamed it and then failed before saving the index. The message
+// then needs to be downloaded again.
+func (b *backup) relabel(id string, labelIDs []string) (bool, error) {
+	e := b.index.Messages[id]
+	if sameStrings(e.LabelIDs, labelIDs) {
+		return true, nil
+	}
+	old := path.Join(b.dir, e.File)
+	raw, err := ioutil.ReadFile(old)
+	if os.IsNotExist(err) {
+		log.Warningf("Backup of message %q missing (%q), downloading again", id, e.File)
+		delete(b.index.Messages, id)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	m := &exportMessage{
+		ID:       id,
+		Date:     time.Unix(e.Date, 0),
+		LabelIDs: labelIDs,
+		Labels:   b.c.labelNames(labelIDs),
+		Raw:      string(raw),
+	}
+	if err := writeMaildir(b.dir, m); err != nil {
+		return false, err
+	}
+	e.LabelIDs = labelIDs
+	if fn := path.Join("cur", maildirName(m)); fn != e.File {
+		if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		e.File = fn
+	}
+	b.res.Updated++
+	return true, nil
+}
+
+// add downloads and writes new messages.
+func (b *backup) add(ctx context.Context, msgs []*Message) error {
+	ms, err := b.c.exportMessages(ctx, msgs)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		if skipBackup(m.LabelIDs) {
+			continue
+		}
+		if err := writeMaildir(b.dir, m); err != nil {
+			return errors.Wrapf(err, "writing message %q", m.ID)
+		}
+		b.index.Messages[m.ID] = &backupEntry{
+			File:     path.Join("cur", maildirName(m)),
+			Date:     m.Date.Unix(),
+			LabelIDs: m.LabelIDs,
+		}
+		b.c.forgetMessage(m.ID)
+		b.res.Added++
+	}
+	return nil
+}
+
+// update brings the given messages up to date, whatever happened to them.
+func (b *backup) update(ctx context.Context, ids []string) error {
+	var msgs []*Message
+	for _, id := range ids {
+		msgs = append(msgs, NewMessage(b.c, id))
+	}
+	if err := b.c.BatchPreload(ctx, msgs, LevelMinimal); err != nil {
+		// Failures are retried one by one below.
+		log.Warningf("Failed to batch load labels: %v", err)
+	}
+	var todo []*Message
+	for _, m := range msgs {
+		err := m.Preload(ctx, LevelMinimal)
+		if isNotFound(err) {
+			if err := b.remove(m.ID); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		m.m.RLock()
+		labels := m.Response.LabelIds
+		m.m.RUnlock()
+		switch _, found := b.index.Messages[m.ID]; {
+		case skipBackup(labels):
+			err = b.remove(m.ID)
+		case found:
+			if found, err = b.relabel(m.ID, labels); err == nil && !found {
+				todo = append(todo, m)
+				continue
+			}
+		default:
+			todo = append(todo, m)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "updating message %q", m.ID)
+		}
+		b.c.forgetMessage(m.ID)
+	}
+	return b.add(ctx, todo)
+}
+
+// full lists every message, downloading new ones and removing what's
+// gone. The index is saved after every page, so that an interrupted
+// first backup doesn't start over.
+func (b *backup) full(ctx context.Context) error {
+	b.res.Full = true
+	// Get this before listing, so that nothing is missed.
+	h, err := b.c.HistoryID(ctx)
+	if err != nil {
+		return err
+	}
+	b.index.HistoryID = 0
+	seen := make(map[string]bool)
+	token := ""
+	for {
+		page, err := b.c.ListMessages(ctx, "", "", token)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for _, m := range page.Messages {
+			seen[m.ID] = true
+			ids = append(ids, m.ID)
+		}
+		if err := b.update(ctx, ids); err != nil {
+			return err
+		}
+		if err := b.index.write(b.indexFile()); err != nil {
+			return errors.Wrap(err, "saving backup index")
+		}
+		log.Infof("Backup listed %d messages, %d added", len(seen), b.res.Added)
+		token = page.Response.NextPageToken
+		if token == "" {
+			break
+		}
+	}
+	for id := range b.index.Messages {
+		if !seen[id] {
+			if err := b.remove(id); err != nil {
+				return err
+			}
+		}
+	}
+	b.index.HistoryID = h
+	return nil
+}
+
+// incremental applies what happened since the last run. Returns
+// found=false if history that old is not available. Like full, the
+// index is saved after every chunk, so that files renamed by relabel
+// are not left pointed to by an old index.
+func (b *backup) incremental(ctx context.Context) (bool, error) {
+	hists, h, err := b.c.History(ctx, b.index.HistoryID, "")
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	seen := make(map[string]bool)
+	var ids []string
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, hist := range hists {
+		for _, m := range hist.MessagesAdded {
+			add(m.Message.Id)
+		}
+		for _, m := range hist.MessagesDeleted {
+			add(m.Message.Id)
+		}
+		for _, m := range hist.LabelsAdded {
+			add(m.Message.Id)
+		}
+		for _, m := range hist.LabelsRemoved {
+			add(m.Message.Id)
+		}
+	}
+	log.Infof("Backup history has %d entries changing %d messages", len(hists), len(ids))
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > pageSize {
+			chunk = chunk[:pageSize]
+		}
+		ids = ids[len(chunk):]
+		if err := b.update(ctx, chunk); err != nil {
+			return true, err
+		}
+		if err := b.index.write(b.indexFile()); err != nil {
+			return true, errors.Wrap(err, "saving backup index")
+		}
+	}
+	if h != 0 {
+		b.index.HistoryID = h
+	}
+	return true, nil
+}
+
+// lockBackup takes an exclusive lock on the backup, so that runs from
+// cron don't overlap.
+func lockBackup(dir string) (*os.File, error) {
+	f, err := os.OpenFile(path.Join(dir, backupLockName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.Errorf("another backup of %q is running", dir)
+		}
+		return nil, errors.Wrap(err, "locking backup")
+	}
+	return f, nil
+}
+
+// Backup keeps a Maildir mirror of the mailbox, except spam and
+// trash. The first run downloads everything. After that only what
+// history says has changed is downloaded, removed, or relabeled. If
+// history is too old (404) everything is listed again, but only
+// messages not already in the backup are downloaded.
+func (c *CmdG) Backup(ctx context.Context, dir string) (*BackupResult, error) {
+	for _, d := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(path.Join(dir, d), 0700); err != nil {
+			return nil, err
+		}
+	}
+	lock, err := lockBackup(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	b := &backup{
+		c:   c,
+		dir: dir,
+	}
+	if b.index, err = readBackupIndex(b.indexFile()); err != nil {
+		return nil, err
+	}
+	if err := c.LoadLabels(ctx); err != nil {
+		return nil, errors.Wrap(err, "loading labels")
+	}
+
+	found := false
+	if b.index.HistoryID != 0 {
+		found, err = b.incremental(ctx)
+		if err != nil {
+			return &b.res, err
+		}
+		if !found {
+			log.Warningf("Backup history ID %d too old, listing all messages", b.index.HistoryID)
+		}
+	}
+	if !found {
+		if err := b.full(ctx); err != nil {
+			return &b.res, err
+		}
+	}
+	if err := b.index.write(b.indexFile()); err != nil {
+		return &b.res, errors.Wrap(err, "saving backup index")
+	}
+	return &b.res, nil
+}
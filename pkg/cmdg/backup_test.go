@@ -0,0 +1,231 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// redirectTransport sends all requests to a test server.
+type redirectTransport struct {
+	to *url.URL
+}
+
+func (t *redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.URL.Scheme = t.to.Scheme
+	r.URL.Host = t.to.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// fakeMailbox is just enough of the Gmail API for backups.
+type fakeMailbox struct {
+	m        sync.Mutex
+	t        *testing.T
+	messages map[string][]string // Labels.
+	history  []*gmail.History
+	expired  bool
+}
+
+func (f *fakeMailbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	reply := func(v interface{}) {
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			f.t.Error(err)
+		}
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/me/")
+	switch {
+	case p == "profile":
+		reply(map[string]string{"historyId": "100"})
+	case p == "labels":
+		reply(map[string]interface{}{"labels": []map[string]string{{"id": Inbox, "name": "INBOX"}}})
+	case p == "messages":
+		var ms []map[string]string
+		for id := range f.messages {
+			ms = append(ms, map[string]string{"id": id})
+		}
+		reply(map[string]interface{}{"messages": ms})
+	case strings.HasPrefix(p, "messages/"):
+		id := strings.TrimPrefix(p, "messages/")
+		labels, found := f.messages[id]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			reply(map[string]interface{}{"error": map[string]interface{}{"code": 404, "message": "Not Found"}})
+			return
+		}
+		reply(map[string]interface{}{
+			"id":           id,
+			"threadId":     id,
+			"labelIds":     labels,
+			"internalDate": "1000000",
+			"raw":          base64.URLEncoding.EncodeToString([]byte("Subject: " + id + "\r\n\r\nbody\r\n")),
+		})
+	case p == "history":
+		if f.expired {
+			w.WriteHeader(http.StatusNotFound)
+			reply(map[string]interface{}{"error": map[string]interface{}{"code": 404, "message": "Not Found"}})
+			return
+		}
+		reply(map[string]interface{}{"history": f.history, "historyId": "200"})
+	default:
+		// Including batch, which falls back to one by one.
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func backupFiles(t *testing.T, dir string) []string {
+	fs, err := filepath.Glob(path.Join(dir, "cur", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := range fs {
+		fs[n] = path.Base(fs[n])
+	}
+	return fs
+}
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := &fakeMailbox{
+		t: t,
+		messages: map[string][]string{
+			"a": {Inbox},
+			"b": {Inbox, Unread},
+			"s": {Spam},
+		},
+	}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	c, err := NewFake(&http.Client{Transport: &redirectTransport{to: u}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// First run downloads everything but spam.
+	res, err := c.Backup(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != (BackupResult{Full: true, Added: 2}) {
+		t.Errorf("First run: %+v", res)
+	}
+	if got, want := strings.Join(backupFiles(t, dir), " "), "1000.a.cmdg:2,S 1000.b.cmdg:2,"; got != want {
+		t.Errorf("Got files %q, want %q", got, want)
+	}
+
+	// Then only history.
+	fake.m.Lock()
+	delete(fake.messages, "a")
+	fake.messages["b"] = []string{Inbox, Starred}
+	fake.messages["c"] = []string{Inbox}
+	fake.history = []*gmail.History{
+		{MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: &gmail.Message{Id: "a"}}}},
+		{LabelsAdded: []*gmail.HistoryLabelAdded{{Message: &gmail.Message{Id: "b"}, LabelIds: []string{Starred}}}},
+		{MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "c"}}}},
+	}
+	fake.m.Unlock()
+	res, err = c.Backup(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != (BackupResult{Added: 1, Updated: 1, Deleted: 1}) {
+		t.Errorf("Second run: %+v", res)
+	}
+	if got, want := strings.Join(backupFiles(t, dir), " "), "1000.b.cmdg:2,FS 1000.c.cmdg:2,S"; got != want {
+		t.Errorf("Got files %q, want %q", got, want)
+	}
+	b, err := ioutil.ReadFile(path.Join(dir, "cur", "1000.b.cmdg:2,FS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "X-Gmail-Labels: INBOX,STARRED\nSubject: b\n\nbody\n"; got != want {
+		t.Errorf("Got relabeled message %q, want %q", got, want)
+	}
+
+	// Expired history falls back to listing everything.
+	fake.m.Lock()
+	fake.expired = true
+	delete(fake.messages, "c")
+	fake.m.Unlock()
+	res, err = c.Backup(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != (BackupResult{Full: true, Deleted: 1}) {
+		t.Errorf("Resync: %+v", res)
+	}
+	if got, want := strings.Join(backupFiles(t, dir), " "), "1000.b.cmdg:2,FS"; got != want {
+		t.Errorf("Got files %q, want %q", got, want)
+	}
+	idx, err := readBackupIndex(path.Join(dir, backupIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.HistoryID != 100 || len(idx.Messages) != 1 {
+		t.Errorf("Bad index after resync: %+v", idx)
+	}
+
+	// A file missing from under the index is downloaded again.
+	if err := os.Remove(path.Join(dir, "cur", "1000.b.cmdg:2,FS")); err != nil {
+		t.Fatal(err)
+	}
+	fake.m.Lock()
+	fake.expired = false
+	fake.messages["b"] = []string{Inbox}
+	fake.history = []*gmail.History{
+		{LabelsRemoved: []*gmail.HistoryLabelRemoved{{Message: &gmail.Message{Id: "b"}, LabelIds: []string{Starred}}}},
+	}
+	fake.m.Unlock()
+	res, err = c.Backup(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != (BackupResult{Added: 1}) {
+		t.Errorf("Missing file run: %+v", res)
+	}
+	if got, want := strings.Join(backupFiles(t, dir), " "), "1000.b.cmdg:2,S"; got != want {
+		t.Errorf("Got files %q, want %q", got, want)
+	}
+}
+
+func TestBackupLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := lockBackup(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockBackup(dir); err == nil {
+		t.Errorf("Locked twice")
+	}
+	l.Close()
+	l, err = lockBackup(dir)
+	if err != nil {
+		t.Errorf("Lock not released: %v", err)
+	} else {
+		l.Close()
+	}
+}
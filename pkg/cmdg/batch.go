@@ -0,0 +1,336 @@
+package cmdg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	batchURL = "https://www.googleapis.com/batch/gmail/v1"
+
+	// Max number of requests per batch. Google allows 100, but
+	// recommends at most 50, since larger batches get rate limited.
+	batchMax = 50
+
+	// How long to wait for more requests before sending a batch.
+	batchDelay = 20 * time.Millisecond
+
+	// How long a batch from the batcher may take, including retries.
+	// It's not tied to any one caller, since it's shared.
+	batchTimeout = 2 * time.Minute
+)
+
+// buildBatchRequest writes a multipart batch body getting all the messages at the given level.
+// For LevelMetadata, `headers` limits which headers are returned.
+// Returns the content type to use.
+func buildBatchRequest(w io.Writer, ids []string, level DataLevel, headers ...string) (string, error) {
+	var extra string
+	for _, h := range headers {
+		extra += "&metadataHeaders=" + url.QueryEscape(h)
+	}
+	mw := multipart.NewWriter(w)
+	for n, id := range ids {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", "application/http")
+		h.Set("Content-ID", fmt.Sprintf("<item-%d>", n))
+		p, err := mw.CreatePart(h)
+		if err != nil {
+			return "", err
+		}
+		if _, err := fmt.Fprintf(p, "GET /gmail/v1/users/%s/messages/%s?format=%s%s&alt=json\r\n\r\n",
+			url.PathEscape(email), url.PathEscape(id), url.QueryEscape(string(level)), extra); err != nil {
+			return "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return "multipart/mixed; boundary=" + mw.Boundary(), nil
+}
+
+// parseBatchResponse parses the response to a batch request of `n` items.
+// Returns one message or one error for each item, in request order.
+func parseBatchResponse(contentType string, body io.Reader, n int) ([]*gmail.Message, []error, error) {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "parsing batch response content type %q", contentType)
+	}
+	if mt != "multipart/mixed" {
+		return nil, nil, fmt.Errorf("batch response has unexpected content type %q", mt)
+	}
+	msgs := make([]*gmail.Message, n)
+	errs := make([]error, n)
+	got := make([]bool, n)
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "reading batch response part")
+		}
+		cid := strings.Trim(p.Header.Get("Content-ID"), "<>")
+		i, err := strconv.Atoi(strings.TrimPrefix(cid, "response-item-"))
+		if err != nil || i < 0 || i >= n {
+			return nil, nil, fmt.Errorf("batch response has bad Content-ID %q", cid)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(p), nil)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "parsing batch response item %d", i)
+		}
+		got[i] = true
+		if err := googleapi.CheckResponse(resp); err != nil {
+			errs[i] = err
+			resp.Body.Close()
+			continue
+		}
+		var m gmail.Message
+		if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+			errs[i] = errors.Wrapf(err, "decoding batch response item %d", i)
+		} else {
+			msgs[i] = &m
+		}
+		resp.Body.Close()
+	}
+	for i := range got {
+		if !got[i] {
+			errs[i] = fmt.Errorf("batch response missing item %d", i)
+		}
+	}
+	return msgs, errs, nil
+}
+
+// batchGet gets up to batchMax messages in one HTTP request, without caching.
+// Returns one message or one error per ID.
+func (c *CmdG) batchGet(ctx context.Context, ids []string, level DataLevel, headers ...string) ([]*gmail.Message, []error, error) {
+	var msgs []*gmail.Message
+	var errs []error
+	err := c.wrapLogRPCN(ctx, "gmail.Batch.Users.Messages.Get", len(ids), func() error {
+		var body bytes.Buffer
+		ct, err := buildBatchRequest(&body, ids, level, headers...)
+		if err != nil {
+			return errors.Wrap(err, "building batch request")
+		}
+		req, err := http.NewRequest("POST", batchURL, &body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", ct)
+		req.Header.Set("User-Agent", userAgent())
+		resp, err := c.authedClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+		msgs, errs, err = parseBatchResponse(resp.Header.Get("Content-Type"), resp.Body, len(ids))
+		return err
+	}, "email=%q level=%s headers=%v ids=%v", email, level, headers, ids)
+	return msgs, errs, err
+}
+
+// BatchPreload loads all the messages at the given level, using as few
+// HTTP requests as possible. Messages already loaded or on disk are skipped.
+// Returns the first error, but still loads all it can.
+func (c *CmdG) BatchPreload(ctx context.Context, msgs []*Message, level DataLevel) error {
+	var todo []*Message
+	for _, m := range msgs {
+		if m.HasData(level) {
+			continue
+		}
+		if c.cache != nil {
+			if r := c.cache.getMessage(m.ID, level); r != nil {
+				if err := m.setResponse(ctx, r, level); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		todo = append(todo, m)
+	}
+	var ret error
+	for len(todo) > 0 {
+		chunk := todo
+		if len(chunk) > batchMax {
+			chunk = chunk[:batchMax]
+		}
+		todo = todo[len(chunk):]
+		errs := c.batchLoad(ctx, chunk, level)
+		for _, err := range errs {
+			if err != nil && ret == nil {
+				ret = err
+			}
+		}
+	}
+	return ret
+}
+
+// batchLoad loads up to batchMax messages in one request, returning the error for each message.
+// Items that fail with rate limiting or server errors are retried in a new batch.
+func (c *CmdG) batchLoad(ctx context.Context, msgs []*Message, level DataLevel) []error {
+	ret := make([]error, len(msgs))
+	todo := make([]int, len(msgs))
+	for n := range msgs {
+		todo[n] = n
+	}
+	for attempt := 0; ; attempt++ {
+		st := time.Now()
+		ids := make([]string, len(todo))
+		for k, n := range todo {
+			ids[k] = msgs[n].ID
+		}
+		var gen uint64
+		if c.cache != nil {
+			gen = c.cache.generation()
+		}
+		resps, errs, err := c.batchGet(ctx, ids, level)
+		if err != nil {
+			for _, n := range todo {
+				ret[n] = err
+			}
+			return ret
+		}
+		log.Debugf("Batch downloaded %d messages at level %q in %v", len(ids), level, time.Since(st))
+		var again []int
+		var after time.Duration
+		for k, n := range todo {
+			m := msgs[n]
+			if errs[k] != nil {
+				ret[n] = errs[k]
+				if retry, a := retryable("gmail.Users.Messages.Get", errs[k]); retry && attempt < *rpcRetries {
+					again = append(again, n)
+					if a > after {
+						after = a
+					}
+				}
+				continue
+			}
+			if c.cache != nil {
+				c.cache.putMessage(m.ID, level, resps[k], gen)
+			}
+			ret[n] = m.setResponse(ctx, resps[k], level)
+		}
+		if len(again) == 0 {
+			return ret
+		}
+		d := backoff(attempt)
+		if after > d {
+			d = after
+		}
+		log.Warningf("%d of %d batch items failed, retrying in %v: %v", len(again), len(todo), d, ret[again[0]])
+		if err := sleep(ctx, d); err != nil {
+			return ret
+		}
+		todo = again
+	}
+}
+
+// batcher collects message loads requested around the same time into batches.
+type batcher struct {
+	conn *CmdG
+
+	m       sync.Mutex
+	pending map[DataLevel]*pendingBatch
+}
+
+type pendingBatch struct {
+	msgs    []*Message
+	waiters map[string][]chan error
+}
+
+func newBatcher(c *CmdG) *batcher {
+	return &batcher{
+		conn:    c,
+		pending: make(map[DataLevel]*pendingBatch),
+	}
+}
+
+// load queues up the message for loading, and waits for it to be loaded.
+func (b *batcher) load(ctx context.Context, msg *Message, level DataLevel) error {
+	ch := make(chan error, 1)
+	b.m.Lock()
+	p := b.pending[level]
+	if p == nil {
+		p = &pendingBatch{
+			waiters: make(map[string][]chan error),
+		}
+		b.pending[level] = p
+		time.AfterFunc(batchDelay, func() { b.flush(p, level) })
+	}
+	if _, found := p.waiters[msg.ID]; !found {
+		p.msgs = append(p.msgs, msg)
+	}
+	p.waiters[msg.ID] = append(p.waiters[msg.ID], ch)
+	if len(p.msgs) >= batchMax {
+		delete(b.pending, level)
+		go b.run(p, level)
+	}
+	b.m.Unlock()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *batcher) flush(p *pendingBatch, level DataLevel) {
+	b.m.Lock()
+	if b.pending[level] != p {
+		// Already sent because it filled up.
+		b.m.Unlock()
+		return
+	}
+	delete(b.pending, level)
+	b.m.Unlock()
+	b.run(p, level)
+}
+
+// run loads the batch. Callers stop waiting when their context is done,
+// but the batch is shared, so it runs on its own timeout instead.
+func (b *batcher) run(p *pendingBatch, level DataLevel) {
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+	errs := b.conn.batchLoad(ctx, p.msgs, level)
+	for n, m := range p.msgs {
+		for _, ch := range p.waiters[m.ID] {
+			ch <- errs[n]
+		}
+	}
+}
+
+// PreloadBatched is like Preload, but coalesces with other calls
+// made around the same time into a single HTTP batch request.
+func (msg *Message) PreloadBatched(ctx context.Context, level DataLevel) error {
+	if msg.HasData(level) {
+		return nil
+	}
+	if msg.conn.cache != nil {
+		if m := msg.conn.cache.getMessage(msg.ID, level); m != nil {
+			return msg.setResponse(ctx, m, level)
+		}
+	}
+	return msg.conn.batcher.load(ctx, msg, level)
+}
@@ -0,0 +1,202 @@
+package cmdg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestBuildBatchRequest(t *testing.T) {
+	var b bytes.Buffer
+	ct, err := buildBatchRequest(&b, []string{"abc", "def"}, LevelMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(&b, params["boundary"])
+	for n, id := range []string{"abc", "def"} {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("Part %d: %v", n, err)
+		}
+		if got, want := p.Header.Get("Content-Type"), "application/http"; got != want {
+			t.Errorf("Part %d: content type %q, want %q", n, got, want)
+		}
+		var body bytes.Buffer
+		if _, err := body.ReadFrom(p); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := body.String(), "GET /gmail/v1/users/me/messages/"+id+"?format=metadata&alt=json\r\n\r\n"; got != want {
+			t.Errorf("Part %d: got %q, want %q", n, got, want)
+		}
+	}
+	if _, err := mr.NextPart(); err == nil {
+		t.Errorf("Too many parts")
+	}
+}
+
+func TestParseBatchResponse(t *testing.T) {
+	// Out of order, with one error and one missing item.
+	resp := strings.Join([]string{
+		"--batch_foo",
+		"Content-Type: application/http",
+		"Content-ID: <response-item-1>",
+		"",
+		"HTTP/1.1 404 Not Found",
+		"Content-Type: application/json; charset=UTF-8",
+		"",
+		`{"error":{"code":404,"message":"Requested entity was not found."}}`,
+		"--batch_foo",
+		"Content-Type: application/http",
+		"Content-ID: <response-item-0>",
+		"",
+		"HTTP/1.1 200 OK",
+		"Content-Type: application/json; charset=UTF-8",
+		"",
+		`{"id":"abc","threadId":"t1","labelIds":["INBOX","UNREAD"]}`,
+		"--batch_foo--",
+		"",
+	}, "\r\n")
+	msgs, errs, err := parseBatchResponse("multipart/mixed; boundary=batch_foo", strings.NewReader(resp), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != nil {
+		t.Errorf("Item 0: unexpected error %v", errs[0])
+	}
+	if got, want := msgs[0].Id, "abc"; got != want {
+		t.Errorf("Item 0: got ID %q, want %q", got, want)
+	}
+	if got, want := len(msgs[0].LabelIds), 2; got != want {
+		t.Errorf("Item 0: got %d labels, want %d", got, want)
+	}
+	if e, ok := errs[1].(*googleapi.Error); !ok || e.Code != 404 {
+		t.Errorf("Item 1: want 404 googleapi error, got %v", errs[1])
+	}
+	if errs[2] == nil {
+		t.Errorf("Item 2: want error for missing item")
+	}
+}
+
+// fakeBatch serves batch requests for messages. Messages in `limited`
+// are rate limited the first time they're asked for.
+type fakeBatch struct {
+	m        sync.Mutex
+	t        *testing.T
+	limited  map[string]bool
+	requests []string
+}
+
+func (f *fakeBatch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		f.t.Error(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var ids []string
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		line, err := bufio.NewReader(p).ReadString('?')
+		if err != nil {
+			f.t.Error(err)
+		}
+		ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(line, "GET /gmail/v1/users/me/messages/"), "?"))
+	}
+	f.requests = append(f.requests, strings.Join(ids, ","))
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	for n, id := range ids {
+		p, err := mw.CreatePart(map[string][]string{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {fmt.Sprintf("<response-item-%d>", n)},
+		})
+		if err != nil {
+			f.t.Error(err)
+			return
+		}
+		if f.limited[id] {
+			delete(f.limited, id)
+			fmt.Fprint(p, "HTTP/1.1 429 Too Many Requests\r\nContent-Type: application/json\r\n\r\n"+
+				`{"error":{"code":429,"message":"Too many concurrent requests for user"}}`)
+			continue
+		}
+		fmt.Fprintf(p, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\r\n"+
+			`{"id":%q,"threadId":%q}`, id, id)
+	}
+	if err := mw.Close(); err != nil {
+		f.t.Error(err)
+	}
+}
+
+func newFakeBatch(t *testing.T, fake *fakeBatch) (*CmdG, func()) {
+	ts := httptest.NewServer(fake)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewFake(&http.Client{Transport: &redirectTransport{to: u}})
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	return c, ts.Close
+}
+
+func TestBatchLoadRetries(t *testing.T) {
+	fake := &fakeBatch{t: t, limited: map[string]bool{"b": true}}
+	c, done := newFakeBatch(t, fake)
+	defer done()
+
+	msgs := []*Message{NewMessage(c, "a"), NewMessage(c, "b"), NewMessage(c, "c")}
+	for n, err := range c.batchLoad(context.Background(), msgs, LevelMinimal) {
+		if err != nil {
+			t.Errorf("Message %q: %v", msgs[n].ID, err)
+		}
+	}
+	if got, want := strings.Join(fake.requests, " "), "a,b,c b"; got != want {
+		t.Errorf("Got requests %q, want %q", got, want)
+	}
+}
+
+func TestBatcherOutlivesFirstCaller(t *testing.T) {
+	fake := &fakeBatch{t: t}
+	c, done := newFakeBatch(t, fake)
+	defer done()
+
+	// First caller gives up, but the second is in the same batch.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.batcher.load(ctx, NewMessage(c, "a"), LevelMinimal); err == nil {
+		t.Errorf("Cancelled load succeeded")
+	}
+	if err := c.batcher.load(context.Background(), NewMessage(c, "b"), LevelMinimal); err != nil {
+		t.Fatal(err)
+	}
+	fake.m.Lock()
+	defer fake.m.Unlock()
+	if got, want := strings.Join(fake.requests, " "), "a,b"; got != want {
+		t.Errorf("Got requests %q, want %q", got, want)
+	}
+}
@@ -2,12 +2,18 @@ package cmdg
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
-	"path"
+	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
@@ -17,11 +23,25 @@ const (
 	spaces               = "\n\t\r "
 	oauthRedirectOffline = "urn:ietf:wg:oauth:2.0:oob"
 
+	// How long to wait for the user to authorize in the browser.
+	oauthTimeout = 10 * time.Minute
+
 	// Populate these for a binary-only release.
 	defaultClientID     = ""
 	defaultClientSecret = ""
 )
 
+var (
+	oauthPort    = flag.Int("oauth_port", 0, "Port on 127.0.0.1 to receive the OAuth redirect on, when configuring. 0 means any free port.")
+	oauthOOB     = flag.Bool("oauth_oob", false, "Configure using the old copy-paste OAuth flow, instead of a local redirect.")
+	oauthBrowser = flag.String("oauth_browser", "", "Command to open the OAuth URL with when configuring, e.g. xdg-open. Default is to only print it.")
+
+	oauthEndpoint = oauth2.Endpoint{
+		AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+		TokenURL: "https://accounts.google.com/o/oauth2/token",
+	}
+)
+
 // ConfigOAuth contains the config for the oauth.
 type ConfigOAuth struct {
 	ClientID, ClientSecret, RefreshToken, AccessToken, APIKey string
@@ -30,6 +50,16 @@ type ConfigOAuth struct {
 // Config is… hmm… this should probably be cleand up.
 type Config struct {
 	OAuth ConfigOAuth
+
+	// Aliases are names that, when used on a To, CC, or BCC line,
+	// are expanded to the list of addresses.
+	Aliases map[string][]string `json:",omitempty"`
+
+	// Secret is where the refresh token is, if not in OAuth.
+	Secret *ConfigSecret `json:",omitempty"`
+
+	// ReadOnly is true if only read access to email was granted.
+	ReadOnly bool `json:",omitempty"`
 }
 
 func readLine(s string) (string, error) {
@@ -43,35 +73,171 @@ func readLine(s string) (string, error) {
 	return id, nil
 }
 
-func auth(cfg ConfigOAuth) (string, error) {
+// newPKCE returns a PKCE code verifier and its S256 challenge (RFC 7636).
+func newPKCE() (string, string, error) {
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	h := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(h[:]), nil
+}
+
+// randomString returns n random bytes, URL safe base64 encoded.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "getting random bytes")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func oauthConfig(cfg ConfigOAuth, redirect string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		Endpoint:     oauthEndpoint,
+		Scopes:       []string{scopeFor(*readOnlyFlag)},
+		RedirectURL:  redirect,
+	}
+}
+
+// authCodeURL returns the URL the user should open to grant access.
+func authCodeURL(ocfg *oauth2.Config, state, challenge string) string {
 	at := oauth2.AccessTypeOffline
 	if accessType == "online" {
 		at = oauth2.AccessTypeOnline
 	}
-	ocfg := oauth2.Config{
-		ClientID:     cfg.ClientID,
-		ClientSecret: cfg.ClientSecret,
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
-			TokenURL: "https://accounts.google.com/o/oauth2/token",
-		},
-		Scopes:      []string{scope},
-		RedirectURL: oauthRedirectOffline,
+	return ocfg.AuthCodeURL(state, at,
+		oauth2.SetAuthURLParam("code_challenge", challenge),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+}
+
+// exchangeCode exchanges the auth code for a token, and returns the refresh token.
+func exchangeCode(ctx context.Context, ocfg *oauth2.Config, code, verifier string) (string, error) {
+	token, err := ocfg.Exchange(ctx, strings.TrimSpace(code), oauth2.SetAuthURLParam("code_verifier", verifier))
+	if err != nil {
+		return "", errors.Wrap(err, "exchanging auth code for token")
 	}
-	fmt.Printf("Cut and paste this URL into your browser:\n  %s\n", ocfg.AuthCodeURL("", at))
-	fmt.Printf("Returned code: ")
-	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if token.RefreshToken == "" {
+		return "", fmt.Errorf("no refresh token returned. Try revoking access for the app, and configure again")
+	}
+	return token.RefreshToken, nil
+}
+
+// waitForCode serves HTTP on the listener until the OAuth redirect
+// arrives, and returns the auth code from it.
+func waitForCode(ctx context.Context, l net.Listener, state string) (string, error) {
+	type result struct {
+		code string
+		err  error
+	}
+	ch := make(chan result, 1)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			if q.Get("code") == "" && q.Get("error") == "" {
+				// Browsers ask for favicon and such.
+				http.NotFound(w, r)
+				return
+			}
+			var res result
+			switch {
+			case q.Get("state") != state:
+				res.err = fmt.Errorf("OAuth state mismatch. Got %q", q.Get("state"))
+			case q.Get("error") != "":
+				res.err = fmt.Errorf("OAuth error: %s", q.Get("error"))
+			default:
+				res.code = q.Get("code")
+			}
+			if res.err != nil {
+				http.Error(w, "cmdg: "+res.err.Error(), http.StatusBadRequest)
+			} else {
+				fmt.Fprintf(w, "cmdg is now authorized. You can close this window.\n")
+			}
+			select {
+			case ch <- res:
+			default:
+			}
+		}),
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case res := <-ch:
+		return res.code, res.err
+	}
+}
+
+// authLoopback gets a refresh token by having the browser redirect to
+// a temporary HTTP server on localhost.
+func authLoopback(ctx context.Context, cfg ConfigOAuth) (string, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *oauthPort))
+	if err != nil {
+		return "", errors.Wrap(err, "listening for OAuth redirect")
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	state, err := randomString(16)
 	if err != nil {
 		return "", err
 	}
-	token, err := ocfg.Exchange(oauth2.NoContext, line)
+	verifier, challenge, err := newPKCE()
 	if err != nil {
 		return "", err
 	}
-	return token.RefreshToken, nil
+	ocfg := oauthConfig(cfg, fmt.Sprintf("http://127.0.0.1:%d/", port))
+	u := authCodeURL(ocfg, state, challenge)
+	fmt.Printf("Open this URL in your browser:\n  %s\n", u)
+	fmt.Printf("If the browser is on another machine, first forward the port with:\n  ssh -L %d:127.0.0.1:%d <this host>\n", port, port)
+	if *oauthPort == 0 {
+		fmt.Printf("(use -oauth_port to choose the port)\n")
+	}
+	if *oauthBrowser != "" {
+		if err := exec.Command(*oauthBrowser, u).Start(); err != nil {
+			fmt.Printf("Failed to start browser %q: %v\n", *oauthBrowser, err)
+		}
+	}
+	fmt.Printf("Waiting for authorization…\n")
+
+	ctx, cancel := context.WithTimeout(ctx, oauthTimeout)
+	defer cancel()
+	code, err := waitForCode(ctx, l, state)
+	if err != nil {
+		return "", err
+	}
+	return exchangeCode(ctx, ocfg, code, verifier)
 }
 
-func makeConfig() ([]byte, error) {
+// authOOB gets a refresh token by having the user copy and paste the code.
+// Deprecated by Google for new clients.
+func authOOB(ctx context.Context, cfg ConfigOAuth) (string, error) {
+	verifier, challenge, err := newPKCE()
+	if err != nil {
+		return "", err
+	}
+	ocfg := oauthConfig(cfg, oauthRedirectOffline)
+	fmt.Printf("Cut and paste this URL into your browser:\n  %s\n", authCodeURL(ocfg, "", challenge))
+	fmt.Printf("Returned code: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return exchangeCode(ctx, ocfg, line, verifier)
+}
+
+func auth(cfg ConfigOAuth) (string, error) {
+	ctx := context.Background()
+	if *oauthOOB {
+		return authOOB(ctx, cfg)
+	}
+	return authLoopback(ctx, cfg)
+}
+
+func makeConfig(fn string) (*Config, error) {
 	var err error
 
 	id := defaultClientID
@@ -101,24 +267,20 @@ func makeConfig() ([]byte, error) {
 		OAuth: ConfigOAuth{
 			ClientID:     id,
 			ClientSecret: secret,
-			RefreshToken: token,
 		},
+		ReadOnly: *readOnlyFlag,
 	}
-	b, err := json.Marshal(conf)
-	if err != nil {
+	if err := storeToken(fn, conf, token); err != nil {
 		return nil, err
 	}
-	return b, nil
+	return conf, nil
 }
 
 // Configure sets up configuration with oauth and stuff.
 func Configure(fn string) error {
-	b, err := makeConfig()
+	conf, err := makeConfig(fn)
 	if err != nil {
 		return err
 	}
-	if err := os.MkdirAll(path.Dir(fn), 0700); err != nil {
-		return errors.Wrapf(err, "creating config directory %q", path.Dir(fn))
-	}
-	return ioutil.WriteFile(fn, b, 0600)
+	return writeConfig(fn, conf)
 }
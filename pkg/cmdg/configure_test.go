@@ -0,0 +1,147 @@
+package cmdg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestPKCE(t *testing.T) {
+	v, c, err := newPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) < 43 || len(v) > 128 {
+		t.Errorf("Verifier length %d outside RFC 7636 range", len(v))
+	}
+	h := sha256.Sum256([]byte(v))
+	if want := base64.RawURLEncoding.EncodeToString(h[:]); c != want {
+		t.Errorf("Challenge: got %q, want %q", c, want)
+	}
+	v2, _, err := newPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v == v2 {
+		t.Errorf("Same verifier twice: %q", v)
+	}
+}
+
+// fakeTokenServer answers token requests. Since it runs in another
+// goroutine, problems are reported with t.Error and an HTTP error, and
+// the test fails when the exchange does.
+func fakeTokenServer(t *testing.T, refresh string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bad := false
+		for k, want := range map[string]string{
+			"grant_type":    "authorization_code",
+			"code":          "the-code",
+			"code_verifier": "the-verifier",
+			"redirect_uri":  "http://127.0.0.1:1234/",
+		} {
+			if got := r.PostForm.Get(k); got != want {
+				t.Errorf("Token request %q: got %q, want %q", k, got, want)
+				bad = true
+			}
+		}
+		if bad {
+			http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"access","token_type":"Bearer","expires_in":3600,"refresh_token":%q}`, refresh)
+	}))
+}
+
+func TestExchangeCode(t *testing.T) {
+	for _, test := range []struct {
+		refresh string
+		err     bool
+	}{
+		{refresh: "the-refresh-token"},
+		{refresh: "", err: true},
+	} {
+		ts := fakeTokenServer(t, test.refresh)
+		ocfg := &oauth2.Config{
+			ClientID:     "id",
+			ClientSecret: "secret",
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  ts.URL + "/auth",
+				TokenURL: ts.URL + "/token",
+			},
+			RedirectURL: "http://127.0.0.1:1234/",
+		}
+		got, err := exchangeCode(context.Background(), ocfg, "the-code\n", "the-verifier")
+		ts.Close()
+		if test.err {
+			if err == nil {
+				t.Errorf("Want error for refresh token %q, got %q", test.refresh, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.refresh {
+			t.Errorf("Got refresh token %q, want %q", got, test.refresh)
+		}
+	}
+}
+
+func TestWaitForCode(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		code  string
+		err   string
+	}{
+		{query: "code=abc&state=st", code: "abc"},
+		{query: "code=abc&state=other", err: "state mismatch"},
+		{query: "error=access_denied&state=st", err: "access_denied"},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		query := test.query
+		go func() {
+			// Favicon requests are ignored.
+			for _, q := range []string{"/favicon.ico", "/?" + query} {
+				resp, err := http.Get(fmt.Sprintf("http://%s%s", l.Addr(), q))
+				if err != nil {
+					// Server may be closed before the response is read.
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
+		code, err := waitForCode(ctx, l, "st")
+		cancel()
+		l.Close()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.query, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		} else if code != test.code {
+			t.Errorf("%q: got code %q, want %q", test.query, code, test.code)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package cmdg
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -13,6 +12,7 @@ import (
 	"net/mail"
 	"net/textproto"
 	"os"
+	"path"
 	"sort"
 	"strings"
 	"sync"
@@ -83,8 +83,55 @@ type CmdG struct {
 	drive        *drive.Service
 	people       *people.Service
 	messageCache map[string]*Message
+	threadCache  map[ThreadID]*Thread
 	labelCache   map[string]*Label
-	contacts     []string
+
+	// Generation of the label at the time it was last created,
+	// changed, or deleted here. So that LoadLabels doesn't undo
+	// what happened while it was listing.
+	labelGen     uint64
+	labelChanged map[string]uint64
+
+	contacts   []*Contact
+	identities []*Identity
+	vacation   *gmail.VacationSettings
+
+	// On-disk message cache. nil if not used.
+	cache *diskCache
+
+	// Coalesces message loads into HTTP batch requests.
+	batcher *batcher
+
+	// Gmail quota. The quota is per user, so each connection
+	// (account) has its own.
+	quota *quotaLimiter
+
+	// Journal of mutations and outgoing messages not yet sent to
+	// the server. nil if not used.
+	journal *journal
+
+	// Local copy of contacts, and where it's saved. Empty
+	// filename if not saved.
+	contactStore *contactStore
+	contactsFile string
+	addressBooks []AddressBook
+
+	// True if no changes are allowed.
+	readOnly bool
+
+	// Local address aliases from the config.
+	aliases map[string][]string
+
+	// Index of addresses we've sent to, and where it's saved.
+	// recipientsMu is held while changing it, since that's done
+	// on a copy.
+	recipientsMu   sync.Mutex
+	recipients     *recipientIndex
+	recipientsFile string
+
+	// Threads muted this session, in case new messages in them
+	// show up in history before they get the label.
+	muted map[ThreadID]bool
 }
 
 func userAgent() string {
@@ -117,47 +164,81 @@ func (c *CmdG) LabelCache(label *Label) *Label {
 func NewFake(client *http.Client) (*CmdG, error) {
 	conn := &CmdG{
 		authedClient: client,
+		messageCache: make(map[string]*Message),
+		threadCache:  make(map[ThreadID]*Thread),
+		labelCache:   make(map[string]*Label),
+		quota:        newQuotaLimiter(quotaUnitsPerSecond, quotaUnitsPerSecond),
 	}
+	conn.batcher = newBatcher(conn)
 	return conn, conn.setupClients()
 }
 
+// proxyTransport returns the transport to use for the -socks5 proxy,
+// or nil if none.
+func proxyTransport() (http.RoundTripper, error) {
+	if *socks5 == "" {
+		return nil, nil
+	}
+	dialer, err := proxy.SOCKS5("tcp", *socks5, nil, proxy.Direct)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to socks5 proxy %q", *socks5)
+	}
+	if cd, ok := dialer.(proxy.ContextDialer); ok {
+		return &http.Transport{
+			DialContext: cd.DialContext,
+		}, nil
+	}
+	return &http.Transport{
+		Dial: dialer.Dial,
+	}, nil
+}
+
 // New creates a new CmdG.
 func New(fn string) (*CmdG, error) {
 	conn := &CmdG{
 		messageCache: make(map[string]*Message),
+		threadCache:  make(map[ThreadID]*Thread),
 		labelCache:   make(map[string]*Label),
+		quota:        newQuotaLimiter(quotaUnitsPerSecond, quotaUnitsPerSecond),
 	}
+	conn.batcher = newBatcher(conn)
 
 	// Read config.
-	var conf Config
+	conf, err := readConfig(fn)
+	if err != nil {
+		return nil, err
+	}
+	if conf.OAuth.RefreshToken, err = conf.refreshToken(); err != nil {
+		return nil, err
+	}
+	conn.aliases = conf.Aliases
+	conn.readOnly = conf.ReadOnly || *readOnlyFlag
+
+	// Set up disk cache.
 	{
-		f, err := ioutil.ReadFile(fn)
+		var err error
+		conn.cache, err = newDiskCache(path.Join(stateDirFor(fn), cacheDirName))
 		if err != nil {
 			return nil, err
 		}
-		if err := json.Unmarshal(f, &conf); err != nil {
-			return nil, errors.Wrapf(err, "unmarshalling config")
-		}
 	}
 
-	var tp http.RoundTripper
-
-	// Set up SOCKS5 proxy.
-	if *socks5 != "" {
-		dialer, err := proxy.SOCKS5("tcp", *socks5, nil, proxy.Direct)
+	// Set up journal of pending changes.
+	{
+		var err error
+		conn.journal, err = newJournal(path.Join(stateDirFor(fn), journalDirName))
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to connect to socks5 proxy %q", *socks5)
-		}
-		if cd, ok := dialer.(proxy.ContextDialer); ok {
-			tp = &http.Transport{
-				DialContext: cd.DialContext,
-			}
-		} else {
-			tp = &http.Transport{
-				Dial: dialer.Dial,
-			}
+			return nil, err
 		}
 	}
+	conn.contactsFile = path.Join(stateDirFor(fn), contactsFileName)
+	conn.recipientsFile = path.Join(stateDirFor(fn), recipientsFileName)
+
+	// Set up SOCKS5 proxy.
+	tp, err := proxyTransport()
+	if err != nil {
+		return nil, err
+	}
 
 	// Attach APIkey, if any.
 	if conf.OAuth.APIKey != "" {
@@ -186,7 +267,7 @@ func New(fn string) (*CmdG, error) {
 				AuthURL:  "https://accounts.google.com/o/oauth2/auth",
 				TokenURL: "https://accounts.google.com/o/oauth2/token",
 			},
-			Scopes:      []string{scope},
+			Scopes:      []string{scopeFor(conf.ReadOnly)},
 			RedirectURL: oauthRedirectOffline,
 		}
 		conn.authedClient = cfg.Client(ctx, token)
@@ -226,11 +307,37 @@ func (c *CmdG) setupClients() error {
 	return nil
 }
 
-func wrapLogRPC(fn string, cb func() error, af string, args ...interface{}) error {
-	st := time.Now()
-	err := cb()
-	logRPC(st, err, fmt.Sprintf("%s(%s)", fn, af), args...)
-	return err
+func (c *CmdG) wrapLogRPC(ctx context.Context, fn string, cb func() error, af string, args ...interface{}) error {
+	return c.wrapLogRPCN(ctx, fn, 1, cb, af, args...)
+}
+
+// wrapLogRPCN runs and logs an RPC doing the work of `n` calls, for quota purposes.
+// Rate limiting and server errors are retried with backoff.
+func (c *CmdG) wrapLogRPCN(ctx context.Context, fn string, n int, cb func() error, af string, args ...interface{}) error {
+	units := rpcQuotaUnits(fn, n)
+	for attempt := 0; ; attempt++ {
+		if err := c.quota.wait(ctx, fn, units); err != nil {
+			return err
+		}
+		st := time.Now()
+		err := cb()
+		logRPC(st, err, fmt.Sprintf("%s(%s)", fn, af), args...)
+		if err == nil {
+			return nil
+		}
+		retry, after := retryable(fn, err)
+		if !retry || attempt >= *rpcRetries {
+			return err
+		}
+		d := backoff(attempt)
+		if after > d {
+			d = after
+		}
+		log.Warningf("RPC %s failed, retrying in %v: %v", fn, d, err)
+		if err2 := sleep(ctx, d); err2 != nil {
+			return err
+		}
+	}
 }
 
 func logRPC(st time.Time, err error, s string, args ...interface{}) {
@@ -243,8 +350,11 @@ func logRPC(st time.Time, err error, s string, args ...interface{}) {
 func (c *CmdG) LoadLabels(ctx context.Context) error {
 	// Load initial labels.
 	st := time.Now()
+	c.m.RLock()
+	gen := c.labelGen
+	c.m.RUnlock()
 	var res *gmail.ListLabelsResponse
-	err := wrapLogRPC("gmail.Users.Labels.List", func() (err error) {
+	err := c.wrapLogRPC(ctx, "gmail.Users.Labels.List", func() (err error) {
 		res, err = c.gmail.Users.Labels.List(email).Context(ctx).Do()
 		return
 	}, "email=%q", email)
@@ -252,15 +362,29 @@ func (c *CmdG) LoadLabels(ctx context.Context) error {
 		return err
 	}
 	log.Infof("Loaded labels in %v", time.Since(st))
-	c.m.Lock()
-	defer c.m.Unlock()
+	lc := make(map[string]*Label)
 	for _, l := range res.Labels {
-		c.labelCache[l.Id] = &Label{
+		lc[l.Id] = &Label{
 			ID:       l.Id,
 			Label:    l.Name,
 			Response: l,
 		}
 	}
+	// Replace the whole cache, so that labels deleted elsewhere go
+	// away. Except for labels changed here after listing started.
+	c.m.Lock()
+	defer c.m.Unlock()
+	for id, g := range c.labelChanged {
+		if g <= gen {
+			continue
+		}
+		if l, found := c.labelCache[id]; found {
+			lc[id] = l
+		} else {
+			delete(lc, id)
+		}
+	}
+	c.labelCache = lc
 	return nil
 }
 
@@ -287,7 +411,7 @@ func (c *CmdG) Labels() []*Label {
 // GetProfile returns the profile for the current user.
 func (c *CmdG) GetProfile(ctx context.Context) (*gmail.Profile, error) {
 	var ret *gmail.Profile
-	err := wrapLogRPC("gmail.Users.GetProfile", func() (err error) {
+	err := c.wrapLogRPC(ctx, "gmail.Users.GetProfile", func() (err error) {
 		ret, err = c.gmail.Users.GetProfile(email).Context(ctx).Do()
 		return
 	}, "email=%q", email)
@@ -344,6 +468,21 @@ func ParseUserMessage(in string) (mail.Header, *Part, error) {
 //   head:  Email header.
 //   parts: Email parts.
 func (c *CmdG) SendParts(ctx context.Context, threadID ThreadID, mp string, head mail.Header, parts []*Part) error {
+	if err := c.CheckWrite("sending"); err != nil {
+		return err
+	}
+	msgs, err := c.assembleParts(mp, head, parts)
+	if err != nil {
+		return err
+	}
+	log.Infof("Final message: %q", msgs)
+	return c.sendOrQueue(ctx, threadID, msgs)
+}
+
+// assembleParts turns headers and parts into a whole message, with
+// aliases and contact groups in the recipient headers expanded. Used
+// for both sending and drafts, so that they get the same addresses.
+func (c *CmdG) assembleParts(mp string, head mail.Header, parts []*Part) (string, error) {
 	var mbuf bytes.Buffer
 	w := multipart.NewWriter(&mbuf)
 
@@ -351,23 +490,31 @@ func (c *CmdG) SendParts(ctx context.Context, threadID ThreadID, mp string, head
 	for _, p := range parts {
 		p2, err := w.CreatePart(p.Header)
 		if err != nil {
-			return errors.Wrapf(err, "failed to create part")
+			return "", errors.Wrapf(err, "failed to create part")
 		}
 		if _, err := p2.Write([]byte(p.Contents)); err != nil {
-			return errors.Wrapf(err, "assembling part")
+			return "", errors.Wrapf(err, "assembling part")
 		}
 	}
 	if err := w.Close(); err != nil {
-		return errors.Wrapf(err, "closing multipart")
+		return "", errors.Wrapf(err, "closing multipart")
 	}
 
 	addrHeader := map[string]bool{
+		"from":     true,
 		"to":       true,
 		"cc":       true,
 		"bcc":      true,
 		"reply-to": true,
 	}
 
+	// Headers where aliases and groups are expanded.
+	recipientHeader := map[string]bool{
+		"to":  true,
+		"cc":  true,
+		"bcc": true,
+	}
+
 	// Add message headers for gmail.
 	var hlines []string
 	for k, vs := range head {
@@ -376,9 +523,23 @@ func (c *CmdG) SendParts(ctx context.Context, threadID ThreadID, mp string, head
 				if v == "" {
 					continue
 				}
+				if recipientHeader[strings.ToLower(k)] {
+					var err error
+					v, err = c.ExpandAddressList(v)
+					if err != nil {
+						return "", errors.Wrapf(err, "header %q", k)
+					}
+					if v == "" {
+						continue
+					}
+				}
 				as, err := mail.ParseAddressList(v)
 				if err != nil {
-					return errors.Wrapf(err, "parsing address list %q, which is %q", k, v)
+					return "", errors.Wrapf(err, "parsing address list %q, which is %q", k, v)
+				}
+				if len(as) == 0 {
+					// E.g. only an empty group.
+					continue
 				}
 				var ass []string
 				for _, a := range as {
@@ -400,27 +561,58 @@ func (c *CmdG) SendParts(ctx context.Context, threadID ThreadID, mp string, head
 	sort.Strings(hlines)
 	hlines = append(hlines, fmt.Sprintf(`Content-Type: multipart/%s; boundary="%s"`, mp, w.Boundary()))
 	hlines = append(hlines, `Content-Disposition: inline`)
-	msgs := strings.Join(hlines, "\r\n") + "\r\n\r\n" + mbuf.String()
+	return strings.Join(hlines, "\r\n") + "\r\n\r\n" + mbuf.String(), nil
+}
 
-	log.Infof("Final message: %q", msgs)
-	return c.send(ctx, threadID, msgs)
+// sendOrQueue sends the message, or puts it in the journal if the network is down.
+func (c *CmdG) sendOrQueue(ctx context.Context, threadID ThreadID, msg string) error {
+	e := &journalEntry{
+		Op:       journalSend,
+		ThreadID: threadID,
+		Message:  msg,
+	}
+	if c.journal != nil && c.journal.len() > 0 {
+		log.Infof("Journal not empty, queueing message")
+		if err := c.journal.add(e); err != nil {
+			return err
+		}
+		return ErrQueued
+	}
+	err := c.send(ctx, threadID, msg)
+	// Only if it can't have been sent, or it may be sent twice.
+	if err != nil && c.journal != nil && neverSent(err) {
+		log.Warningf("Sending failed, journalling for later: %v", err)
+		if err := c.journal.add(e); err != nil {
+			return err
+		}
+		return ErrQueued
+	}
+	return err
 }
 
 func (c *CmdG) send(ctx context.Context, threadID ThreadID, msg string) (err error) {
-	return wrapLogRPC("gmail.Users.Messages.Send", func() error {
-		_, err = c.gmail.Users.Messages.Send(email, &gmail.Message{
+	var r *gmail.Message
+	if err := c.wrapLogRPC(ctx, "gmail.Users.Messages.Send", func() error {
+		r, err = c.gmail.Users.Messages.Send(email, &gmail.Message{
 			Raw:      MIMEEncode(msg),
 			ThreadId: string(threadID),
 		}).Context(ctx).Do()
 		return err
-	}, "email=%q threadID=%q msg=%q", email, threadID, msg)
+	}, "email=%q threadID=%q msg=%q", email, threadID, msg); err != nil {
+		return err
+	}
+	c.recordSent(r.Id, msg)
+	return nil
 }
 
 // PutFile uploads a file into the config dir on Google drive.
 func (c *CmdG) PutFile(ctx context.Context, fn string, contents []byte) error {
+	if err := c.CheckWrite("uploading file"); err != nil {
+		return err
+	}
 	const name = "signature.txt"
 	const folder = appDataFolder
-	err := wrapLogRPC("drive.Files.Create", func() error {
+	err := c.wrapLogRPC(ctx, "drive.Files.Create", func() error {
 		_, err := c.drive.Files.Create(&drive.File{
 			Name:    name,
 			Parents: []string{folder},
@@ -437,7 +629,7 @@ func (c *CmdG) getFileID(ctx context.Context, fn string) (string, error) {
 	var token string
 	for {
 		var l *drive.FileList
-		err := wrapLogRPC("drive.Files.List", func() (err error) {
+		err := c.wrapLogRPC(ctx, "drive.Files.List", func() (err error) {
 			l, err = c.drive.Files.List().Context(ctx).Spaces(appDataFolder).PageToken(token).Do()
 			return
 		}, "folder=%q token=%q", appDataFolder, token)
@@ -459,10 +651,13 @@ func (c *CmdG) getFileID(ctx context.Context, fn string) (string, error) {
 
 // UpdateFile updates an existing file on Google drive in the config folder..
 func (c *CmdG) UpdateFile(ctx context.Context, fn string, contents []byte) error {
+	if err := c.CheckWrite("updating file"); err != nil {
+		return err
+	}
 	id, err := c.getFileID(ctx, fn)
 	if err != nil {
 		if err == os.ErrNotExist {
-			if err := wrapLogRPC("drive.Files.Create", func() error {
+			if err := c.wrapLogRPC(ctx, "drive.Files.Create", func() error {
 				_, err := c.drive.Files.Create(&drive.File{
 					Name:    fn,
 					Parents: []string{appDataFolder},
@@ -476,7 +671,7 @@ func (c *CmdG) UpdateFile(ctx context.Context, fn string, contents []byte) error
 		return errors.Wrapf(err, "getting file ID for %q", fn)
 	}
 
-	if err := wrapLogRPC("drive.Files.Update", func() error {
+	if err := c.wrapLogRPC(ctx, "drive.Files.Update", func() error {
 		_, err := c.drive.Files.Update(id, &drive.File{
 			Name: fn,
 		}).Context(ctx).Media(bytes.NewBuffer(contents)).Do()
@@ -492,7 +687,7 @@ func (c *CmdG) GetFile(ctx context.Context, fn string) ([]byte, error) {
 	var token string
 	for {
 		var l *drive.FileList
-		err := wrapLogRPC("drive.Files.List", func() (err error) {
+		err := c.wrapLogRPC(ctx, "drive.Files.List", func() (err error) {
 			l, err = c.drive.Files.List().Context(ctx).Spaces(appDataFolder).PageToken(token).Do()
 			return
 		}, "spaces=%q token=%q", appDataFolder, token)
@@ -502,7 +697,7 @@ func (c *CmdG) GetFile(ctx context.Context, fn string) ([]byte, error) {
 		for _, f := range l.Files {
 			if f.Name == fn {
 				var r *http.Response
-				err := wrapLogRPC("drive.Files.Get", func() (err error) {
+				err := c.wrapLogRPC(ctx, "drive.Files.Get", func() (err error) {
 					r, err = c.drive.Files.Get(f.Id).Context(ctx).Download()
 					return
 				}, "fileID=%v", f.Id)
@@ -522,9 +717,16 @@ func (c *CmdG) GetFile(ctx context.Context, fn string) ([]byte, error) {
 	return nil, os.ErrNotExist
 }
 
-// MakeDraft creates a new draft.
-func (c *CmdG) MakeDraft(ctx context.Context, msg string) error {
-	return wrapLogRPC("gmail.Users.Drafts.Create", func() error {
+// MakeDraft creates a new draft. Args are like for SendParts.
+func (c *CmdG) MakeDraft(ctx context.Context, mp string, head mail.Header, parts []*Part) error {
+	if err := c.CheckWrite("saving draft"); err != nil {
+		return err
+	}
+	msg, err := c.assembleParts(mp, head, parts)
+	if err != nil {
+		return err
+	}
+	return c.wrapLogRPC(ctx, "gmail.Users.Drafts.Create", func() error {
 		_, err := c.gmail.Users.Drafts.Create(email, &gmail.Draft{
 			Message: &gmail.Message{
 				Raw: MIMEEncode(msg),
@@ -536,12 +738,26 @@ func (c *CmdG) MakeDraft(ctx context.Context, msg string) error {
 
 // BatchArchive archives all the given message IDs.
 func (c *CmdG) BatchArchive(ctx context.Context, ids []string) error {
-	return wrapLogRPC("gmail.Users.Messages.BatchModify", func() error {
-		return c.gmail.Users.Messages.BatchModify(email, &gmail.BatchModifyMessagesRequest{
-			Ids:            ids,
-			RemoveLabelIds: []string{Inbox},
-		}).Context(ctx).Do()
-	}, "email=%q remove=INBOX ids=%v)", email, ids)
+	return c.batchModify(ctx, ids, nil, []string{Inbox})
+}
+
+// BatchSpam reports the messages as spam, moving them out of the inbox.
+func (c *CmdG) BatchSpam(ctx context.Context, ids []string) error {
+	return c.batchModify(ctx, ids, []string{Spam}, []string{Inbox})
+}
+
+// BatchNotSpam marks the messages as not spam, moving them back to the inbox.
+func (c *CmdG) BatchNotSpam(ctx context.Context, ids []string) error {
+	return c.batchModify(ctx, ids, []string{Inbox}, []string{Spam})
+}
+
+// BatchMarkRead removes the UNREAD label from the messages. Does
+// nothing in read-only mode, like MarkRead.
+func (c *CmdG) BatchMarkRead(ctx context.Context, ids []string) error {
+	if c.ReadOnly() {
+		return nil
+	}
+	return c.BatchUnlabel(ctx, ids, Unread)
 }
 
 // BatchDelete deletes. Does not put in trash. Does not pass go:
@@ -550,7 +766,10 @@ func (c *CmdG) BatchArchive(ctx context.Context, ids []string) error {
 // cmdg doesn't actually request oauth permission to do this, so this function is never used.
 // Instead BatchTrash is used.
 func (c *CmdG) BatchDelete(ctx context.Context, ids []string) error {
-	return wrapLogRPC("gmail.Users.Messages.BatchDelete", func() error {
+	if err := c.CheckWrite("deleting messages"); err != nil {
+		return err
+	}
+	return c.wrapLogRPC(ctx, "gmail.Users.Messages.BatchDelete", func() error {
 		return c.gmail.Users.Messages.BatchDelete(email, &gmail.BatchDeleteMessagesRequest{
 			Ids: ids,
 		}).Context(ctx).Do()
@@ -566,28 +785,18 @@ func (c *CmdG) BatchTrash(ctx context.Context, ids []string) error {
 
 // BatchLabel adds one new label to many messages.
 func (c *CmdG) BatchLabel(ctx context.Context, ids []string, labelID string) error {
-	return wrapLogRPC("gmail.Users.Messages.BatchModify", func() error {
-		return c.gmail.Users.Messages.BatchModify(email, &gmail.BatchModifyMessagesRequest{
-			Ids:         ids,
-			AddLabelIds: []string{labelID},
-		}).Context(ctx).Do()
-	}, "email=%q add_labelID=%v ids=%v", email, labelID, ids)
+	return c.batchModify(ctx, ids, []string{labelID}, nil)
 }
 
 // BatchUnlabel removes one label from many messages.
-func (c *CmdG) BatchUnlabel(ctx context.Context, ids []string, labelID string) (err error) {
-	return wrapLogRPC("gmail.Users.Messages.BatchModify", func() error {
-		return c.gmail.Users.Messages.BatchModify(email, &gmail.BatchModifyMessagesRequest{
-			Ids:            ids,
-			RemoveLabelIds: []string{labelID},
-		}).Context(ctx).Do()
-	}, "email=%q remove_labelID=%v ids=%v", email, labelID, ids)
+func (c *CmdG) BatchUnlabel(ctx context.Context, ids []string, labelID string) error {
+	return c.batchModify(ctx, ids, nil, []string{labelID})
 }
 
 // HistoryID returns the current history ID.
 func (c *CmdG) HistoryID(ctx context.Context) (HistoryID, error) {
 	var p *gmail.Profile
-	err := wrapLogRPC("gmail.Users.GetProfile", func() (err error) {
+	err := c.wrapLogRPC(ctx, "gmail.Users.GetProfile", func() (err error) {
 		p, err = c.gmail.Users.GetProfile(email).Context(ctx).Do()
 		return
 	}, "email=%q", email)
@@ -601,7 +810,7 @@ func (c *CmdG) HistoryID(ctx context.Context) (HistoryID, error) {
 func (c *CmdG) MoreHistory(ctx context.Context, start HistoryID, labelID string) (bool, error) {
 	log.Infof("History for %d %s", start, labelID)
 	var r *gmail.ListHistoryResponse
-	err := wrapLogRPC("gmail.Users.History.List", func() (err error) {
+	err := c.wrapLogRPC(ctx, "gmail.Users.History.List", func() (err error) {
 
 		r, err = c.gmail.Users.History.List(email).Context(ctx).StartHistoryId(uint64(start)).LabelId(labelID).Do()
 		return
@@ -617,15 +826,32 @@ func (c *CmdG) History(ctx context.Context, startID HistoryID, labelID string) (
 	log.Infof("History for %d %s", startID, labelID)
 	var ret []*gmail.History
 	var h HistoryID
-	err := wrapLogRPC("gmail.Users.History.List", func() error {
-		return c.gmail.Users.History.List(email).Context(ctx).StartHistoryId(uint64(startID)).LabelId(labelID).Pages(ctx, func(r *gmail.ListHistoryResponse) error {
-			ret = append(ret, r.History...)
-			h = HistoryID(r.HistoryId)
-			return nil
-		})
-	}, "email=%q historyID=%v labelID=%q", email, startID, labelID)
-	if err != nil {
-		return nil, 0, err
+	q := c.gmail.Users.History.List(email).Context(ctx).StartHistoryId(uint64(startID))
+	if labelID != "" {
+		q = q.LabelId(labelID)
+	}
+	// One page at a time, so that retries don't start over.
+	token := ""
+	for {
+		var r *gmail.ListHistoryResponse
+		err := c.wrapLogRPC(ctx, "gmail.Users.History.List", func() (err error) {
+			r, err = q.PageToken(token).Do()
+			return
+		}, "email=%q historyID=%v labelID=%q token=%q", email, startID, labelID, token)
+		if err != nil {
+			return nil, 0, err
+		}
+		ret = append(ret, r.History...)
+		h = HistoryID(r.HistoryId)
+		token = r.NextPageToken
+		if token == "" {
+			break
+		}
+	}
+	if c.cache != nil {
+		for _, id := range historyMessageIDs(ret) {
+			c.cache.invalidate(id)
+		}
 	}
 	return ret, h, nil
 }
@@ -647,7 +873,7 @@ func (c *CmdG) ListMessages(ctx context.Context, label, query, token string) (*P
 		q = q.LabelIds(label)
 	}
 	var res *gmail.ListMessagesResponse
-	err := wrapLogRPC("gmail.Users.Messages.List", func() (err error) {
+	err := c.wrapLogRPC(ctx, "gmail.Users.Messages.List", func() (err error) {
 		res, err = q.Do()
 		return
 	}, "email=%q token=%v labelID=%q query=%q size=%d fields=%q)", email, token, label, query, nres, fields)
@@ -670,21 +896,29 @@ func (c *CmdG) ListMessages(ctx context.Context, label, query, token string) (*P
 // ListDrafts lists all drafts.
 func (c *CmdG) ListDrafts(ctx context.Context) ([]*Draft, error) {
 	var ret []*Draft
-	if err := wrapLogRPC("gmail.Users.Drafts.List", func() error {
-		return c.gmail.Users.Drafts.List(email).Pages(ctx, func(r *gmail.ListDraftsResponse) error {
-			for _, d := range r.Drafts {
-				nd := NewDraft(c, d.Id)
-				ret = append(ret, nd)
-				go func() {
-					if err := nd.load(ctx, LevelMetadata); err != nil {
-						log.Errorf("Loading a draft: %v", err)
-					}
-				}()
-			}
-			return nil
-		})
-	}, "email=%q", email); err != nil {
-		return nil, err
+	// One page at a time, so that retries don't start over.
+	token := ""
+	for {
+		var r *gmail.ListDraftsResponse
+		if err := c.wrapLogRPC(ctx, "gmail.Users.Drafts.List", func() (err error) {
+			r, err = c.gmail.Users.Drafts.List(email).PageToken(token).Context(ctx).Do()
+			return
+		}, "email=%q token=%q", email, token); err != nil {
+			return nil, err
+		}
+		for _, d := range r.Drafts {
+			nd := NewDraft(c, d.Id)
+			ret = append(ret, nd)
+			go func() {
+				if err := nd.load(ctx, LevelMetadata); err != nil {
+					log.Errorf("Loading a draft: %v", err)
+				}
+			}()
+		}
+		token = r.NextPageToken
+		if token == "" {
+			break
+		}
 	}
 	return ret, nil
 }
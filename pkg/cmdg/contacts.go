@@ -2,18 +2,28 @@ package cmdg
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"regexp"
-	"sort"
 	"strings"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
 	people "google.golang.org/api/people/v1"
 )
 
 const (
 	maxContacts      = 10000
 	contactBatchSize = 2000
+
+	contactsFileName = "contacts.json"
+
+	// Fields to download for each contact. If this changes then the
+	// local store is thrown away, and a full sync done.
+	contactPersonFields = "names,emailAddresses,nicknames,organizations,memberships"
 )
 
 var (
@@ -23,25 +33,308 @@ var (
 	rfc5322commentRE = regexp.MustCompile(`^[A-Za-z0-9]+$`)
 )
 
-// Contacts returns a list of all contacts.
-func (c *CmdG) Contacts() []string {
+// contactStore is the local copy of all contacts, kept in sync incrementally.
+type contactStore struct {
+	PersonFields string                    `json:"person_fields"`
+	SyncToken    string                    `json:"sync_token"`
+	People       map[string]*people.Person `json:"people"`
+
+	// Contact group resource name to group name.
+	Groups map[string]string `json:"groups"`
+}
+
+// Contact is a person in the address book.
+type Contact struct {
+	Name         string
+	Emails       []string
+	Nickname     string
+	Organization string
+	Groups       []string
+}
+
+// Address returns the email address in "Name Name <email@example.com>" format.
+func (c *Contact) Address(email string) string {
+	if strings.Contains(email, " ") {
+		// Name already there.
+		return email
+	}
+	if c.Name == "" {
+		return email
+	}
+	return fmt.Sprintf(`%s <%s>`, quoteNameIfNeeded(c.Name), email)
+}
+
+// Addresses returns all email addresses of the contact, in "Name Name <email@example.com>" format.
+func (c *Contact) Addresses() []string {
+	var ret []string
+	for _, e := range c.Emails {
+		ret = append(ret, c.Address(e))
+	}
+	return ret
+}
+
+// Contacts returns all contacts that have an email address, from Google
+// and local address books, sorted by name.
+func (c *CmdG) Contacts() []*Contact {
 	c.m.RLock()
 	defer c.m.RUnlock()
-	return append([]string{"me"}, c.contacts...)
+	return c.contacts
+}
+
+// ContactByNickname returns the contact with the given nickname, or nil if none.
+func (c *CmdG) ContactByNickname(nick string) *Contact {
+	if nick == "" {
+		return nil
+	}
+	for _, co := range c.Contacts() {
+		if strings.EqualFold(co.Nickname, nick) {
+			return co
+		}
+	}
+	return nil
+}
+
+// readContactStore reads the contact store from disk.
+// Returns nil if there is none, or it's not usable.
+func readContactStore(fn string) *contactStore {
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Errorf("Failed to read contacts file %q: %v", fn, err)
+		return nil
+	}
+	var s contactStore
+	if err := json.Unmarshal(b, &s); err != nil {
+		log.Errorf("Corrupt contacts file %q, ignoring: %v", fn, err)
+		return nil
+	}
+	if s.PersonFields != contactPersonFields || s.People == nil {
+		log.Infof("Contacts file %q has other fields (%q), ignoring", fn, s.PersonFields)
+		return nil
+	}
+	return &s
+}
+
+// copy returns a copy that can be changed without affecting the original.
+// The people themselves are not copied.
+func (s *contactStore) copy() *contactStore {
+	ns := *s
+	ns.People = make(map[string]*people.Person, len(s.People))
+	for k, v := range s.People {
+		ns.People[k] = v
+	}
+	return &ns
+}
+
+func (s *contactStore) write(fn string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fn, b)
+}
+
+// isExpiredSyncToken returns true if the error means a full sync is needed.
+func isExpiredSyncToken(err error) bool {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	return e.Code == 410 || (e.Code == 400 && strings.Contains(e.Message, "EXPIRED_SYNC_TOKEN")) ||
+		(e.Code == 400 && strings.Contains(strings.ToLower(e.Message), "sync token"))
+}
+
+// loadContactGroups gets the names of all contact groups.
+func (c *CmdG) loadContactGroups(ctx context.Context) (map[string]string, error) {
+	ret := make(map[string]string)
+	err := c.wrapLogRPC(ctx, "people.ContactGroups.List", func() error {
+		return c.people.ContactGroups.List().PageSize(contactBatchSize).Pages(ctx, func(r *people.ListContactGroupsResponse) error {
+			for _, g := range r.ContactGroups {
+				name := g.FormattedName
+				if name == "" {
+					name = g.Name
+				}
+				ret[g.ResourceName] = name
+			}
+			return nil
+		})
+	}, "")
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// syncPeople downloads contacts changed since the sync token, or all
+// of them if the token is empty. Applies them to the store `s`.
+func (c *CmdG) syncPeople(ctx context.Context, s *contactStore) error {
+	full := s.SyncToken == ""
+	if full {
+		s.People = make(map[string]*people.Person)
+	}
+	changed := 0
+	err := c.wrapLogRPC(ctx, "people.People.Connections.List", func() error {
+		call := c.people.People.Connections.List("people/me").
+			Context(ctx).
+			PageSize(contactBatchSize).
+			PersonFields(contactPersonFields).
+			RequestSyncToken(true)
+		if !full {
+			call = call.SyncToken(s.SyncToken)
+		}
+		return call.Pages(ctx, func(r *people.ListConnectionsResponse) error {
+			log.Infof("Got batch of %d contacts, total %d", len(r.Connections), r.TotalItems)
+			for _, p := range r.Connections {
+				changed++
+				if p.Metadata != nil && p.Metadata.Deleted {
+					delete(s.People, p.ResourceName)
+					continue
+				}
+				s.People[p.ResourceName] = p
+			}
+			if r.NextSyncToken != "" {
+				s.SyncToken = r.NextSyncToken
+			}
+			return nil
+		})
+	}, "full=%v", full)
+	if err != nil {
+		return err
+	}
+	log.Infof("Contact sync (full=%v) got %d changes, now have %d contacts", full, changed, len(s.People))
+	return nil
 }
 
-// LoadContacts reads all contacts from the cloud.
+// LoadContacts brings the contact list up to date. Only changes since
+// last time are downloaded, and the list is kept on disk between runs.
+// Local address books are reread and merged in. In read-only mode only
+// local address books are used.
 func (c *CmdG) LoadContacts(ctx context.Context) error {
-	co, err := c.GetContacts(ctx)
+	if c.readOnly {
+		// No contacts scope, and nobody to send to anyway.
+		co := mergeContacts(nil, c.loadAddressBooks())
+		c.m.Lock()
+		defer c.m.Unlock()
+		c.contacts = co
+		return nil
+	}
+	c.m.RLock()
+	s := c.contactStore
+	c.m.RUnlock()
+
+	if s == nil && c.contactsFile != "" {
+		s = readContactStore(c.contactsFile)
+	}
+	if s == nil {
+		s = &contactStore{PersonFields: contactPersonFields}
+	} else {
+		// Don't change the copy others may be reading.
+		s = s.copy()
+	}
+
+	err := c.syncPeople(ctx, s)
+	if s.SyncToken != "" && isExpiredSyncToken(err) {
+		log.Infof("Contacts sync token expired, doing full sync: %v", err)
+		s.SyncToken = ""
+		err = c.syncPeople(ctx, s)
+	}
 	if err != nil {
+		return errors.Wrap(err, "syncing contacts")
+	}
+	if g, err := c.loadContactGroups(ctx); err != nil {
+		// Not fatal, groups just won't show names.
+		log.Errorf("Failed to load contact groups: %v", err)
+	} else {
+		s.Groups = g
+	}
+	if c.contactsFile != "" {
+		if err := s.write(c.contactsFile); err != nil {
+			log.Errorf("Failed to save contacts to %q: %v", c.contactsFile, err)
+		}
+	}
+	co := mergeContacts(s.contacts(), c.loadAddressBooks())
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.contactStore = s
+	c.contacts = co
+	return nil
+}
+
+// splitName splits a full name into given and family name, for
+// creating contacts. The family name is the last word, unless the
+// name is written "Family, Given".
+func splitName(name string) (string, string) {
+	name = strings.TrimSpace(name)
+	if n := strings.Index(name, ","); n >= 0 {
+		return strings.TrimSpace(name[n+1:]), strings.TrimSpace(name[:n])
+	}
+	fs := strings.Fields(name)
+	if len(fs) < 2 {
+		return name, ""
+	}
+	return strings.Join(fs[:len(fs)-1], " "), fs[len(fs)-1]
+}
+
+// CreateContact creates a Google contact, and adds it to the contacts
+// right away, without waiting for the next sync.
+func (c *CmdG) CreateContact(ctx context.Context, name, addr string) error {
+	if err := c.CheckWrite("creating contact"); err != nil {
 		return err
 	}
+	p := &people.Person{
+		EmailAddresses: []*people.EmailAddress{{Value: addr}},
+	}
+	if name != "" {
+		given, family := splitName(name)
+		p.Names = []*people.Name{{GivenName: given, FamilyName: family}}
+	}
+	var r *people.Person
+	err := c.wrapLogRPC(ctx, "people.People.CreateContact", func() (err error) {
+		r, err = c.people.People.CreateContact(p).Context(ctx).Do()
+		return
+	}, "name=%q email=%q", name, addr)
+	if err != nil {
+		return errors.Wrapf(err, "creating contact %q", addr)
+	}
+	if len(r.Names) == 0 && name != "" {
+		r.Names = []*people.Name{{DisplayName: name}}
+	}
+
+	c.m.RLock()
+	s := c.contactStore
+	c.m.RUnlock()
+	if s == nil {
+		s = &contactStore{PersonFields: contactPersonFields}
+	}
+	ns := s.copy()
+	ns.People[r.ResourceName] = r
+	if c.contactsFile != "" {
+		if err := ns.write(c.contactsFile); err != nil {
+			log.Errorf("Failed to save contacts to %q: %v", c.contactsFile, err)
+		}
+	}
+	co := mergeContacts(ns.contacts(), c.loadAddressBooks())
 	c.m.Lock()
 	defer c.m.Unlock()
+	c.contactStore = ns
 	c.contacts = co
 	return nil
 }
 
+// IsContact returns true if the email address belongs to a contact.
+func (c *CmdG) IsContact(addr string) bool {
+	for _, co := range c.Contacts() {
+		for _, e := range co.Emails {
+			if strings.EqualFold(e, addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func quoteNameIfNeeded(s string) string {
 	if rfc5322commentRE.MatchString(s) {
 		return s
@@ -49,38 +342,55 @@ func quoteNameIfNeeded(s string) string {
 	return fmt.Sprintf("%q", s)
 }
 
-// GetContacts gets all contact's email addresses in "Name Name <email@example.com>" format.
-func (c *CmdG) GetContacts(ctx context.Context) ([]string, error) {
-	// TODO: get a sync token and only do incremental download.
-	var ret []string
-	if err := c.people.People.Connections.List("people/me").Context(ctx).PageSize(contactBatchSize).PersonFields("names,emailAddresses").Pages(ctx, func(r *people.ListConnectionsResponse) error {
-		log.Infof("Got batch of %d contacts, total %d", len(r.Connections), r.TotalItems)
-		for _, p := range r.Connections {
-			// Use name first listed.
-			var name string
-			if len(p.Names) > 0 {
-				name = p.Names[0].DisplayName
+// contacts converts the stored people to contacts, sorted by name.
+func (s *contactStore) contacts() []*Contact {
+	var ret []*Contact
+	for _, p := range s.People {
+		co := &Contact{}
+		// Use name first listed.
+		if len(p.Names) > 0 {
+			co.Name = p.Names[0].DisplayName
+		}
+		if len(p.Nicknames) > 0 {
+			co.Nickname = p.Nicknames[0].Value
+		}
+		if len(p.Organizations) > 0 {
+			co.Organization = p.Organizations[0].Name
+		}
+		for _, e := range p.EmailAddresses {
+			if strings.Contains(e.Value, " ") {
+				log.Warningf("Contact email address contains a space: %q", e.Value)
 			}
-			for _, e := range p.EmailAddresses {
-				if strings.Contains(e.Value, " ") {
-					// Name already there.
-					log.Warningf("Contact email address contains a space: %q", e.Value)
-					ret = append(ret, e.Value)
-				} else {
-					if len(name) > 0 {
-						ret = append(ret, fmt.Sprintf(`%s <%s>`, quoteNameIfNeeded(name), e.Value))
-					} else {
-						ret = append(ret, e.Value)
-					}
-				}
+			co.Emails = append(co.Emails, e.Value)
+		}
+		for _, m := range p.Memberships {
+			if m.ContactGroupMembership == nil {
+				continue
+			}
+			if g, found := s.Groups[m.ContactGroupMembership.ContactGroupResourceName]; found {
+				co.Groups = append(co.Groups, g)
 			}
 		}
-		return nil
-	}); err != nil {
+		if len(co.Emails) == 0 {
+			continue
+		}
+		ret = append(ret, co)
+	}
+	sortContacts(ret)
+	return ret
+}
+
+// GetContacts gets all contacts.
+// Always downloads everything. Use LoadContacts and Contacts to only get changes.
+func (c *CmdG) GetContacts(ctx context.Context) ([]*Contact, error) {
+	s := &contactStore{PersonFields: contactPersonFields}
+	if err := c.syncPeople(ctx, s); err != nil {
 		return nil, err
 	}
-	sort.Slice(ret, func(i, j int) bool {
-		return strings.TrimLeft(ret[i], `"`) < strings.TrimLeft(ret[j], `"`)
-	})
-	return ret, nil
+	g, err := c.loadContactGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.Groups = g
+	return s.contacts(), nil
 }
@@ -0,0 +1,176 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+
+	people "google.golang.org/api/people/v1"
+)
+
+func TestSplitName(t *testing.T) {
+	for _, test := range []struct {
+		name, given, family string
+	}{
+		{"", "", ""},
+		{"Madonna", "Madonna", ""},
+		{"Alice Smith", "Alice", "Smith"},
+		{"  Mary Ann  Jones ", "Mary Ann", "Jones"},
+		{"Smith, Alice", "Alice", "Smith"},
+		{"van Rossum, Guido", "Guido", "van Rossum"},
+	} {
+		given, family := splitName(test.name)
+		if given != test.given || family != test.family {
+			t.Errorf("splitName(%q): got %q %q, want %q %q", test.name, given, family, test.given, test.family)
+		}
+	}
+}
+
+// fakePeople serves contact syncs. Each sync token maps to the changes
+// since then, and expired tokens get 410 Gone.
+type fakePeople struct {
+	m       sync.Mutex
+	t       *testing.T
+	syncs   map[string]*people.ListConnectionsResponse
+	expired map[string]bool
+	tokens  []string // Sync tokens used, in order.
+}
+
+func (f *fakePeople) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	var resp interface{}
+	switch r.URL.Path {
+	case "/v1/contactGroups":
+		resp = &people.ListContactGroupsResponse{}
+	case "/v1/people/me/connections":
+		token := r.FormValue("syncToken")
+		f.tokens = append(f.tokens, token)
+		if f.expired[token] {
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprint(w, `{"error": {"code": 410, "message": "Sync token is expired."}}`)
+			return
+		}
+		var found bool
+		if resp, found = f.syncs[token]; !found {
+			f.t.Errorf("Unknown sync token %q", token)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	default:
+		f.t.Errorf("Unexpected request for %q", r.URL.Path)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		f.t.Error(err)
+	}
+}
+
+func person(id, name, addr string) *people.Person {
+	return &people.Person{
+		ResourceName:   "people/" + id,
+		Names:          []*people.Name{{DisplayName: name}},
+		EmailAddresses: []*people.EmailAddress{{Value: addr}},
+	}
+}
+
+func contactNames(c *CmdG) string {
+	var ret []string
+	for _, co := range c.Contacts() {
+		ret = append(ret, co.Name)
+	}
+	sort.Strings(ret)
+	return fmt.Sprint(ret)
+}
+
+func TestLoadContacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := &fakePeople{
+		t: t,
+		syncs: map[string]*people.ListConnectionsResponse{
+			"": {
+				Connections:   []*people.Person{person("1", "Alice", "alice@example.com"), person("2", "Bob", "bob@example.com")},
+				NextSyncToken: "t1",
+			},
+			"t1": {
+				Connections: []*people.Person{
+					{ResourceName: "people/2", Metadata: &people.PersonMetadata{Deleted: true}},
+					person("3", "Carol", "carol@example.com"),
+				},
+				NextSyncToken: "t2",
+			},
+		},
+		expired: make(map[string]bool),
+	}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	ctx := context.Background()
+	connect := func() *CmdG {
+		c, err := NewFake(ts.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.people.BasePath = ts.URL + "/"
+		c.contactsFile = path.Join(dir, contactsFileName)
+		return c
+	}
+
+	// First time, a full sync.
+	c := connect()
+	if err := c.LoadContacts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contactNames(c), "[Alice Bob]"; got != want {
+		t.Errorf("Full sync: got %s, want %s", got, want)
+	}
+	if s := readContactStore(c.contactsFile); s == nil || s.SyncToken != "t1" {
+		t.Errorf("Sync token not saved: %+v", s)
+	}
+
+	// Next run continues from the saved sync token.
+	c = connect()
+	if err := c.LoadContacts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contactNames(c), "[Alice Carol]"; got != want {
+		t.Errorf("Incremental sync: got %s, want %s", got, want)
+	}
+
+	// Expired token means starting over.
+	fake.m.Lock()
+	fake.expired["t2"] = true
+	fake.syncs[""] = &people.ListConnectionsResponse{
+		Connections:   []*people.Person{person("4", "Dave", "dave@example.com")},
+		NextSyncToken: "t3",
+	}
+	fake.m.Unlock()
+	if err := c.LoadContacts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contactNames(c), "[Dave]"; got != want {
+		t.Errorf("Sync after expired token: got %s, want %s", got, want)
+	}
+	if s := readContactStore(c.contactsFile); s == nil || s.SyncToken != "t3" {
+		t.Errorf("New sync token not saved: %+v", s)
+	}
+
+	fake.m.Lock()
+	defer fake.m.Unlock()
+	if got, want := fmt.Sprintf("%q", fake.tokens), `["" "t1" "t2" ""]`; got != want {
+		t.Errorf("Got sync tokens %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,290 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	cacheDirName       = "messages"
+	cacheHistoryIDFile = "historyid"
+)
+
+// diskCache stores message API responses across runs.
+//
+// Messages are immutable except for their labels, so the whole cache is
+// valid as of a history ID. SyncCache uses the History API to drop
+// anything that has changed since then.
+//
+// A fetch that was running while its message was dropped may have
+// old labels, so writes say which generation they were fetched at,
+// and are ignored if the message was dropped after that.
+type diskCache struct {
+	m   sync.Mutex
+	dir string
+
+	gen     uint64            // Bumped on every drop.
+	dropped map[string]uint64 // Generation each message was last dropped at.
+	wiped   uint64            // Generation everything was last dropped at.
+}
+
+func newDiskCache(dir string) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "creating message cache directory %q", dir)
+	}
+	return &diskCache{
+		dir:     dir,
+		dropped: make(map[string]uint64),
+	}, nil
+}
+
+// generation returns the current generation. Get it before fetching
+// what's to be written with putMessage.
+func (d *diskCache) generation() uint64 {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.gen
+}
+
+// stale returns true if data fetched at generation `gen` may be out
+// of date. Called with lock held.
+func (d *diskCache) stale(id string, gen uint64) bool {
+	return d.wiped > gen || d.dropped[id] > gen
+}
+
+// stateDirFor returns the directory for local state of the account configured in fn.
+// E.g. ~/.cmdg/cmdg.conf has its state in ~/.cmdg/state/cmdg.
+func stateDirFor(fn string) string {
+	base := strings.TrimSuffix(path.Base(fn), path.Ext(fn))
+	return path.Join(path.Dir(fn), "state", base)
+}
+
+// writeFileAtomic writes the file so that readers never see a partial file.
+func writeFileAtomic(fn string, data []byte) error {
+	f, err := ioutil.TempFile(path.Dir(fn), ".tmp-"+path.Base(fn)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+func (d *diskCache) filename(id, kind string) string {
+	// Spread out files a bit, so directories don't get huge.
+	shard := id
+	if len(id) > 2 {
+		shard = id[len(id)-2:]
+	}
+	return path.Join(d.dir, shard, id+"."+kind)
+}
+
+func (d *diskCache) write(id, kind string, data []byte) {
+	fn := d.filename(id, kind)
+	if err := os.MkdirAll(path.Dir(fn), 0700); err != nil {
+		log.Errorf("Failed to create cache dir for %q: %v", fn, err)
+		return
+	}
+	if err := writeFileAtomic(fn, data); err != nil {
+		log.Errorf("Failed to write cache file %q: %v", fn, err)
+	}
+}
+
+// getMessage returns a cached message that has at least `level` data.
+func (d *diskCache) getMessage(id string, level DataLevel) *gmail.Message {
+	for _, l := range []DataLevel{LevelMinimal, LevelMetadata, LevelFull} {
+		if !hasData(l, level) {
+			continue
+		}
+		b, err := ioutil.ReadFile(d.filename(id, string(l)))
+		if err != nil {
+			continue
+		}
+		var m gmail.Message
+		if err := json.Unmarshal(b, &m); err != nil {
+			log.Warningf("Corrupt cache entry for %q level %q: %v", id, l, err)
+			continue
+		}
+		return &m
+	}
+	return nil
+}
+
+// putMessage caches the message, unless it was dropped since
+// generation `gen`, when it was fetched.
+func (d *diskCache) putMessage(id string, level DataLevel, m *gmail.Message, gen uint64) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		log.Errorf("Failed to marshal message %q for cache: %v", id, err)
+		return
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.stale(id, gen) {
+		log.Debugf("Not caching message %q, changed while it was fetched", id)
+		return
+	}
+	d.write(id, string(level), b)
+}
+
+func (d *diskCache) getRaw(id string) (string, bool) {
+	b, err := ioutil.ReadFile(d.filename(id, levelRaw))
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+func (d *diskCache) putRaw(id, raw string) {
+	d.write(id, levelRaw, []byte(raw))
+}
+
+// invalidate removes all cached data for a message.
+func (d *diskCache) invalidate(id string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.gen++
+	d.dropped[id] = d.gen
+	for _, kind := range []string{string(LevelMinimal), string(LevelMetadata), string(LevelFull), levelRaw} {
+		if err := os.Remove(d.filename(id, kind)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to invalidate cache entry %q: %v", d.filename(id, kind), err)
+		}
+	}
+}
+
+// wipe removes everything from the cache.
+func (d *diskCache) wipe() error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.gen++
+	d.wiped = d.gen
+	// Older drops are covered by this one.
+	d.dropped = make(map[string]uint64)
+	fis, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if err := os.RemoveAll(path.Join(d.dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *diskCache) historyID() HistoryID {
+	d.m.Lock()
+	defer d.m.Unlock()
+	b, err := ioutil.ReadFile(path.Join(d.dir, cacheHistoryIDFile))
+	if err != nil {
+		return 0
+	}
+	h, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		log.Warningf("Corrupt cache history ID %q: %v", string(b), err)
+		return 0
+	}
+	return HistoryID(h)
+}
+
+func (d *diskCache) setHistoryID(h HistoryID) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return writeFileAtomic(path.Join(d.dir, cacheHistoryIDFile), []byte(strconv.FormatUint(uint64(h), 10)))
+}
+
+// historyMessageIDs returns the IDs of all messages touched by history entries.
+func historyMessageIDs(hists []*gmail.History) []string {
+	seen := make(map[string]bool)
+	var ret []string
+	add := func(m *gmail.Message) {
+		if m == nil || seen[m.Id] {
+			return
+		}
+		seen[m.Id] = true
+		ret = append(ret, m.Id)
+	}
+	for _, h := range hists {
+		for _, m := range h.Messages {
+			add(m)
+		}
+		for _, m := range h.MessagesDeleted {
+			add(m.Message)
+		}
+		for _, m := range h.LabelsAdded {
+			add(m.Message)
+		}
+		for _, m := range h.LabelsRemoved {
+			add(m.Message)
+		}
+	}
+	return ret
+}
+
+// DisableDiskCache stops using the on-disk message cache. Batch modes
+// like export and backup call this right after New, since they may
+// run from cron at the same time as the UI, which owns the cache.
+func (c *CmdG) DisableDiskCache() {
+	c.cache = nil
+}
+
+// SyncCache brings the on-disk message cache up to date, dropping
+// every message that changed since the cache was last synced.
+// If the history is too old to be available then the whole cache is dropped.
+func (c *CmdG) SyncCache(ctx context.Context) error {
+	if c.cache == nil {
+		return nil
+	}
+	start := c.cache.historyID()
+	if start == 0 {
+		h, err := c.HistoryID(ctx)
+		if err != nil {
+			return err
+		}
+		// The cache may have entries from before, with unknown validity.
+		if err := c.cache.wipe(); err != nil {
+			return errors.Wrap(err, "wiping message cache")
+		}
+		return c.cache.setHistoryID(h)
+	}
+
+	hists, h, err := c.History(ctx, start, "")
+	if e, ok := errors.Cause(err).(*googleapi.Error); ok && e.Code == 404 {
+		log.Infof("Cache history ID %d too old, dropping message cache", start)
+		h, err := c.HistoryID(ctx)
+		if err != nil {
+			return err
+		}
+		if err := c.cache.wipe(); err != nil {
+			return errors.Wrap(err, "wiping message cache")
+		}
+		return c.cache.setHistoryID(h)
+	}
+	if err != nil {
+		return err
+	}
+	// History() already invalidated the changed messages.
+	log.Infof("Message cache synced from history %d to %d, %d changes", start, h, len(hists))
+	if h == 0 {
+		return nil
+	}
+	return c.cache.setHistoryID(h)
+}
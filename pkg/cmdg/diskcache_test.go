@@ -0,0 +1,203 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func newTestDiskCache(t *testing.T) (*diskCache, func()) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDiskCache(path.Join(dir, cacheDirName))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return d, func() { os.RemoveAll(dir) }
+}
+
+func cachedLabels(d *diskCache, id string, level DataLevel) string {
+	m := d.getMessage(id, level)
+	if m == nil {
+		return "<nil>"
+	}
+	return fmt.Sprint(m.LabelIds)
+}
+
+func TestDiskCache(t *testing.T) {
+	d, done := newTestDiskCache(t)
+	defer done()
+
+	d.putMessage("a", LevelMetadata, &gmail.Message{Id: "a", LabelIds: []string{Inbox}}, d.generation())
+	for _, test := range []struct {
+		level DataLevel
+		want  string
+	}{
+		{LevelMinimal, "[INBOX]"},
+		{LevelMetadata, "[INBOX]"},
+		{LevelFull, "<nil>"},
+	} {
+		if got := cachedLabels(d, "a", test.level); got != test.want {
+			t.Errorf("Level %q: got %s, want %s", test.level, got, test.want)
+		}
+	}
+
+	d.putRaw("a", "raw message")
+	if got, found := d.getRaw("a"); !found || got != "raw message" {
+		t.Errorf("Got raw %q %v", got, found)
+	}
+	d.invalidate("a")
+	if got := cachedLabels(d, "a", LevelMinimal); got != "<nil>" {
+		t.Errorf("Invalidated message still cached: %s", got)
+	}
+	if _, found := d.getRaw("a"); found {
+		t.Errorf("Invalidated raw message still cached")
+	}
+
+	if got := d.historyID(); got != 0 {
+		t.Errorf("New cache has history ID %d", got)
+	}
+	if err := d.setHistoryID(123); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.historyID(); got != 123 {
+		t.Errorf("Got history ID %d, want 123", got)
+	}
+}
+
+func TestDiskCacheStaleWrite(t *testing.T) {
+	d, done := newTestDiskCache(t)
+	defer done()
+
+	// Message changes while being fetched.
+	gen := d.generation()
+	d.invalidate("a")
+	d.putMessage("a", LevelMinimal, &gmail.Message{Id: "a", LabelIds: []string{Inbox}}, gen)
+	if got := cachedLabels(d, "a", LevelMinimal); got != "<nil>" {
+		t.Errorf("Stale write cached: %s", got)
+	}
+
+	// Other messages are not affected.
+	d.putMessage("b", LevelMinimal, &gmail.Message{Id: "b", LabelIds: []string{Inbox}}, gen)
+	if got := cachedLabels(d, "b", LevelMinimal); got != "[INBOX]" {
+		t.Errorf("Got %s, want [INBOX]", got)
+	}
+
+	// Fetched after the change.
+	d.putMessage("a", LevelMinimal, &gmail.Message{Id: "a", LabelIds: []string{Starred}}, d.generation())
+	if got := cachedLabels(d, "a", LevelMinimal); got != "[STARRED]" {
+		t.Errorf("Got %s, want [STARRED]", got)
+	}
+
+	// Whole cache dropped while fetching.
+	gen = d.generation()
+	if err := d.wipe(); err != nil {
+		t.Fatal(err)
+	}
+	d.putMessage("c", LevelMinimal, &gmail.Message{Id: "c"}, gen)
+	if got := cachedLabels(d, "c", LevelMinimal); got != "<nil>" {
+		t.Errorf("Write from before wipe cached: %s", got)
+	}
+	if got := cachedLabels(d, "b", LevelMinimal); got != "<nil>" {
+		t.Errorf("Wiped message still cached: %s", got)
+	}
+}
+
+func TestSyncCache(t *testing.T) {
+	d, done := newTestDiskCache(t)
+	defer done()
+
+	var m sync.Mutex
+	expired := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		var resp interface{}
+		switch r.URL.Path {
+		case "/me/profile":
+			resp = &gmail.Profile{HistoryId: 300}
+		case "/me/history":
+			if expired {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error": {"code": 404, "message": "Not Found"}}`)
+				return
+			}
+			resp = &gmail.ListHistoryResponse{
+				HistoryId: 200,
+				History: []*gmail.History{
+					{Id: 150, LabelsAdded: []*gmail.HistoryLabelAdded{{Message: &gmail.Message{Id: "a"}}}},
+				},
+			}
+		default:
+			t.Errorf("Unexpected request for %q", r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+	c, err := NewFake(ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.gmail.BasePath = ts.URL + "/"
+	c.cache = d
+	ctx := context.Background()
+
+	// First sync drops whatever was there.
+	d.putMessage("old", LevelMinimal, &gmail.Message{Id: "old"}, d.generation())
+	if err := c.SyncCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedLabels(d, "old", LevelMinimal); got != "<nil>" {
+		t.Errorf("Message from before first sync still cached: %s", got)
+	}
+	if got := d.historyID(); got != 300 {
+		t.Errorf("Got history ID %d, want 300", got)
+	}
+
+	// Then changed messages are dropped.
+	for _, id := range []string{"a", "b"} {
+		d.putMessage(id, LevelMinimal, &gmail.Message{Id: id}, d.generation())
+	}
+	if err := c.SyncCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedLabels(d, "a", LevelMinimal); got != "<nil>" {
+		t.Errorf("Changed message still cached: %s", got)
+	}
+	if got := cachedLabels(d, "b", LevelMinimal); got != "[]" {
+		t.Errorf("Unchanged message dropped: %s", got)
+	}
+	if got := d.historyID(); got != 200 {
+		t.Errorf("Got history ID %d, want 200", got)
+	}
+
+	// Too old history drops everything.
+	m.Lock()
+	expired = true
+	m.Unlock()
+	if err := c.SyncCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedLabels(d, "b", LevelMinimal); got != "<nil>" {
+		t.Errorf("Message still cached after expired history: %s", got)
+	}
+	if got := d.historyID(); got != 300 {
+		t.Errorf("Got history ID %d, want 300", got)
+	}
+}
@@ -0,0 +1,434 @@
+package cmdg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// Export formats.
+const (
+	FormatMbox    = "mbox"
+	FormatMaildir = "maildir"
+)
+
+const (
+	// Header with a comma separated list of label names, like Google Takeout.
+	labelsHeader = "X-Gmail-Labels"
+
+	// Raw messages downloaded in parallel.
+	exportConcurrency = 10
+
+	// Remembers what's been exported, so that export can resume.
+	// For mbox it's next to the file, for Maildir inside it.
+	exportProgressSuffix = ".cmdg-export"
+	exportProgressName   = ".cmdg-export"
+)
+
+var mboxFromRE = regexp.MustCompile(`(?m)^(>*From )`)
+
+// exportMessage is a message ready to be written.
+type exportMessage struct {
+	ID       string
+	Date     time.Time
+	LabelIDs []string
+	Labels   []string // Label names.
+	Raw      string
+}
+
+func (m *exportMessage) hasLabel(id string) bool {
+	for _, l := range m.LabelIDs {
+		if l == id {
+			return true
+		}
+	}
+	return false
+}
+
+// content returns the message with Unix line endings, and the labels
+// in a header. Any old labels header is replaced.
+func (m *exportMessage) content() string {
+	raw := strings.Replace(m.Raw, "\r\n", "\n", -1)
+	head, body := raw, ""
+	if n := strings.Index(raw, "\n\n"); n >= 0 {
+		head, body = raw[:n+1], raw[n+1:]
+	}
+	var lines []string
+	skip := false
+	for _, l := range strings.SplitAfter(head, "\n") {
+		if skip && (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) {
+			continue
+		}
+		skip = strings.HasPrefix(strings.ToLower(l), strings.ToLower(labelsHeader)+":")
+		if !skip {
+			lines = append(lines, l)
+		}
+	}
+	return fmt.Sprintf("%s: %s\n%s%s", labelsHeader, strings.Join(m.Labels, ","), strings.Join(lines, ""), body)
+}
+
+// exportSink is somewhere to write exported messages.
+type exportSink interface {
+	// has returns true if the message was written by an earlier run.
+	has(id string) bool
+	write(m *exportMessage) error
+	Close() error
+}
+
+// exportProgress is a file with one line per exported message, with
+// its ID and for mbox the file size after writing it.
+type exportProgress struct {
+	f      *os.File
+	done   map[string]bool
+	offset int64
+}
+
+func openExportProgress(fn string) (*exportProgress, error) {
+	p := &exportProgress{done: make(map[string]bool)}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// A last line without newline was cut off mid-write, and is
+	// dropped so that the next line doesn't get appended to it.
+	complete := b[:bytes.LastIndexByte(b, '\n')+1]
+	s := bufio.NewScanner(bytes.NewReader(complete))
+	for s.Scan() {
+		fs := strings.Fields(s.Text())
+		if len(fs) != 2 {
+			return nil, errors.Errorf("bad line in %q: %q", fn, s.Text())
+		}
+		o, err := strconv.ParseInt(fs[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad line in %q: %q", fn, s.Text())
+		}
+		if o < p.offset {
+			return nil, errors.Errorf("offset going backwards in %q: %q after %d", fn, s.Text(), p.offset)
+		}
+		p.done[fs[0]] = true
+		p.offset = o
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrapf(err, "reading %q", fn)
+	}
+	p.f, err = os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if len(complete) < len(b) {
+		if err := p.f.Truncate(int64(len(complete))); err != nil {
+			p.f.Close()
+			return nil, errors.Wrapf(err, "dropping partial line from %q", fn)
+		}
+	}
+	return p, nil
+}
+
+func (p *exportProgress) has(id string) bool {
+	return p.done[id]
+}
+
+func (p *exportProgress) add(id string, offset int64) error {
+	if _, err := fmt.Fprintf(p.f, "%s %d\n", id, offset); err != nil {
+		return err
+	}
+	p.done[id] = true
+	p.offset = offset
+	return nil
+}
+
+func (p *exportProgress) Close() error {
+	return p.f.Close()
+}
+
+// mboxSink writes mboxrd.
+type mboxSink struct {
+	*exportProgress
+	f *os.File
+}
+
+func openMbox(fn string) (*mboxSink, error) {
+	p, err := openExportProgress(fn + exportProgressSuffix)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		p.Close()
+		return nil, err
+	}
+	if len(p.done) > 0 {
+		if st.Size() < p.offset {
+			f.Close()
+			p.Close()
+			return nil, fmt.Errorf("%q is smaller than when last exported to (%d < %d)", fn, st.Size(), p.offset)
+		}
+		// Remove any message cut off by interruption.
+		if err := f.Truncate(p.offset); err != nil {
+			f.Close()
+			p.Close()
+			return nil, err
+		}
+	} else {
+		p.offset = st.Size()
+	}
+	if _, err := f.Seek(p.offset, 0); err != nil {
+		f.Close()
+		p.Close()
+		return nil, err
+	}
+	return &mboxSink{exportProgress: p, f: f}, nil
+}
+
+func (s *mboxSink) write(m *exportMessage) error {
+	c := mboxFromRE.ReplaceAllString(m.content(), ">$1")
+	if !strings.HasSuffix(c, "\n") {
+		c += "\n"
+	}
+	e := fmt.Sprintf("From MAILER-DAEMON %s\n%s\n", m.Date.UTC().Format(time.ANSIC), c)
+	if _, err := s.f.WriteString(e); err != nil {
+		return err
+	}
+	return s.add(m.ID, s.offset+int64(len(e)))
+}
+
+func (s *mboxSink) Close() error {
+	err := s.f.Close()
+	if err2 := s.exportProgress.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// maildirSink writes a Maildir, with read and starred as flags.
+type maildirSink struct {
+	*exportProgress
+	dir string
+}
+
+func openMaildir(dir string) (*maildirSink, error) {
+	for _, d := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(path.Join(dir, d), 0700); err != nil {
+			return nil, err
+		}
+	}
+	p, err := openExportProgress(path.Join(dir, exportProgressName))
+	if err != nil {
+		return nil, err
+	}
+	return &maildirSink{exportProgress: p, dir: dir}, nil
+}
+
+// maildirName returns the file name for the message. The same message
+// always gets the same name, so writing it again replaces it.
+func maildirName(m *exportMessage) string {
+	flags := ""
+	if m.hasLabel(Starred) {
+		flags += "F"
+	}
+	if !m.hasLabel(Unread) {
+		flags += "S"
+	}
+	return fmt.Sprintf("%d.%s.cmdg:2,%s", m.Date.Unix(), m.ID, flags)
+}
+
+// writeMaildir writes the message into cur, via tmp.
+func writeMaildir(dir string, m *exportMessage) error {
+	fn := maildirName(m)
+	tmp := path.Join(dir, "tmp", fn)
+	if err := ioutil.WriteFile(tmp, []byte(m.content()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, "cur", fn))
+}
+
+func (s *maildirSink) write(m *exportMessage) error {
+	if err := writeMaildir(s.dir, m); err != nil {
+		return err
+	}
+	return s.add(m.ID, 0)
+}
+
+func openExport(format, fn string) (exportSink, error) {
+	switch format {
+	case FormatMbox:
+		return openMbox(fn)
+	case FormatMaildir:
+		return openMaildir(fn)
+	}
+	return nil, fmt.Errorf("unknown export format %q, want %q or %q", format, FormatMbox, FormatMaildir)
+}
+
+// LabelID returns the ID of a label given its ID or name. Names are
+// matched case insensitively. Labels must be loaded.
+func (c *CmdG) LabelID(s string) (string, error) {
+	for _, l := range c.Labels() {
+		if l.ID == s {
+			return l.ID, nil
+		}
+	}
+	for _, l := range c.Labels() {
+		if strings.EqualFold(l.Label, s) {
+			return l.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no such label %q", s)
+}
+
+// labelNames returns the names of label IDs.
+func (c *CmdG) labelNames(ids []string) []string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	var ret []string
+	for _, id := range ids {
+		if l, found := c.labelCache[id]; found {
+			ret = append(ret, l.Label)
+		} else {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// forgetMessage drops a message from the in-memory cache, so that
+// going through the whole mailbox doesn't keep it all in memory.
+func (c *CmdG) forgetMessage(id string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.messageCache, id)
+}
+
+func isNotFound(err error) bool {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	return ok && e.Code == 404
+}
+
+// exportMessages downloads the labels and raw content of the
+// messages. Messages deleted since being listed are left out. Raw
+// content is not cached, since it's only needed once.
+func (c *CmdG) exportMessages(ctx context.Context, msgs []*Message) ([]*exportMessage, error) {
+	if err := c.BatchPreload(ctx, msgs, LevelMinimal); err != nil {
+		// Failures are retried one by one below.
+		log.Warningf("Failed to batch load labels: %v", err)
+	}
+	ret := make([]*exportMessage, len(msgs))
+	errs := make([]error, len(msgs))
+	sem := make(chan struct{}, exportConcurrency)
+	var wg sync.WaitGroup
+	for n, m := range msgs {
+		n, m := n, m
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			raw, err := m.fetchRaw(ctx)
+			if err == nil {
+				err = m.Preload(ctx, LevelMinimal)
+			}
+			if isNotFound(err) {
+				log.Warningf("Message %q deleted while exporting", m.ID)
+				return
+			} else if err != nil {
+				errs[n] = errors.Wrapf(err, "downloading message %q", m.ID)
+				return
+			}
+			m.m.RLock()
+			defer m.m.RUnlock()
+			ret[n] = &exportMessage{
+				ID:       m.ID,
+				Date:     time.Unix(0, m.Response.InternalDate*int64(time.Millisecond)),
+				LabelIDs: m.Response.LabelIds,
+				Labels:   c.labelNames(m.Response.LabelIds),
+				Raw:      raw,
+			}
+		}()
+	}
+	wg.Wait()
+	var found []*exportMessage
+	for n, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+		if ret[n] != nil {
+			found = append(found, ret[n])
+		}
+	}
+	return found, nil
+}
+
+// Export writes every message in a label (ID or name) and/or matching
+// a query to an mbox file or a Maildir. Labels are kept in an
+// X-Gmail-Labels header. Messages written by an earlier run are
+// skipped, so an interrupted export is resumed by running it again.
+//
+// Returns the number of messages written.
+func (c *CmdG) Export(ctx context.Context, label, query, format, fn string) (written int, err error) {
+	sink, err := openExport(format, fn)
+	if err != nil {
+		return 0, errors.Wrapf(err, "opening %q", fn)
+	}
+	defer func() {
+		if err2 := sink.Close(); err == nil {
+			err = err2
+		}
+	}()
+	if err := c.LoadLabels(ctx); err != nil {
+		return 0, errors.Wrap(err, "loading labels")
+	}
+	if label != "" {
+		if label, err = c.LabelID(label); err != nil {
+			return 0, err
+		}
+	}
+
+	token := ""
+	for {
+		page, err := c.ListMessages(ctx, label, query, token)
+		if err != nil {
+			return written, err
+		}
+		var todo []*Message
+		for _, m := range page.Messages {
+			if !sink.has(m.ID) {
+				todo = append(todo, m)
+			}
+		}
+		ms, err := c.exportMessages(ctx, todo)
+		if err != nil {
+			return written, err
+		}
+		for _, m := range ms {
+			if err := sink.write(m); err != nil {
+				return written, errors.Wrapf(err, "writing message %q", m.ID)
+			}
+			c.forgetMessage(m.ID)
+			written++
+		}
+		log.Infof("Exported %d messages, skipped %d already exported", written, len(page.Messages)-len(todo))
+		token = page.Response.NextPageToken
+		if token == "" {
+			break
+		}
+	}
+	return written, nil
+}
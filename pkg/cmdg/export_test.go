@@ -0,0 +1,159 @@
+package cmdg
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestExportContent(t *testing.T) {
+	m := &exportMessage{
+		Labels: []string{"INBOX", "Work"},
+		Raw:    "X-Gmail-Labels: old,\r\n stuff\r\nSubject: hi\r\n\r\nbody\r\nX-Gmail-Labels: in body\r\n",
+	}
+	want := "X-Gmail-Labels: INBOX,Work\nSubject: hi\n\nbody\nX-Gmail-Labels: in body\n"
+	if got := m.content(); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestExportProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "progress")
+
+	// Cut off while writing the last line.
+	if err := ioutil.WriteFile(fn, []byte("a 10\nb 20\nc 3"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := openExportProgress(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.has("a") || !p.has("b") || p.has("c") || p.offset != 20 {
+		t.Errorf("Got done %v offset %d, want a and b at 20", p.done, p.offset)
+	}
+	if err := p.add("c", 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "a 10\nb 20\nc 30\n"; got != want {
+		t.Errorf("Got progress file %q, want %q", got, want)
+	}
+
+	if err := ioutil.WriteFile(fn, []byte("a 10\nb 5\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openExportProgress(fn); err == nil {
+		t.Errorf("Offset going backwards not detected")
+	}
+}
+
+func TestExportMbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "out.mbox")
+	date := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	s, err := openMbox(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.write(&exportMessage{ID: "a", Date: date, Labels: []string{"INBOX"}, Raw: "Subject: a\r\n\r\nFrom here\r\n>From there"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate being interrupted while writing the next message.
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("From MAILER-DAEMON half a mess"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s, err = openMbox(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.has("a") || s.has("b") {
+		t.Errorf("Wrong progress: %v", s.done)
+	}
+	if err := s.write(&exportMessage{ID: "b", Date: date, Raw: "Subject: b\r\n\r\nbody"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `From MAILER-DAEMON Wed Mar  4 05:06:07 2020
+X-Gmail-Labels: INBOX
+Subject: a
+
+>From here
+>>From there
+
+From MAILER-DAEMON Wed Mar  4 05:06:07 2020
+X-Gmail-Labels: 
+Subject: b
+
+body
+
+`
+	if got := string(b); got != want {
+		t.Errorf("Got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestExportMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := openMaildir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &exportMessage{
+		ID:       "abc",
+		Date:     time.Unix(1000, 0),
+		LabelIDs: []string{Inbox, Starred},
+		Raw:      "Subject: x\r\n\r\nbody",
+	}
+	if err := s.write(m); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err := os.Stat(path.Join(dir, "cur", "1000.abc.cmdg:2,FS")); err != nil {
+		t.Error(err)
+	}
+	s, err = openMaildir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !s.has("abc") {
+		t.Errorf("Maildir export progress lost")
+	}
+}
@@ -0,0 +1,163 @@
+package cmdg
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// ListFilters returns all server side filters.
+func (c *CmdG) ListFilters(ctx context.Context) ([]*gmail.Filter, error) {
+	var r *gmail.ListFiltersResponse
+	err := c.wrapLogRPC(ctx, "gmail.Users.Settings.Filters.List", func() (err error) {
+		r, err = c.gmail.Users.Settings.Filters.List(email).Context(ctx).Do()
+		return
+	}, "email=%q", email)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing filters")
+	}
+	return r.Filter, nil
+}
+
+// CreateFilter creates a server side filter. Only future messages are affected.
+func (c *CmdG) CreateFilter(ctx context.Context, f *gmail.Filter) (*gmail.Filter, error) {
+	if err := c.CheckWrite("creating filter"); err != nil {
+		return nil, err
+	}
+	var r *gmail.Filter
+	err := c.wrapLogRPC(ctx, "gmail.Users.Settings.Filters.Create", func() (err error) {
+		r, err = c.gmail.Users.Settings.Filters.Create(email, f).Context(ctx).Do()
+		return
+	}, "email=%q criteria=%+v action=%+v", email, f.Criteria, f.Action)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating filter")
+	}
+	return r, nil
+}
+
+// DeleteFilter deletes a server side filter.
+func (c *CmdG) DeleteFilter(ctx context.Context, id string) error {
+	if err := c.CheckWrite("deleting filter"); err != nil {
+		return err
+	}
+	err := c.wrapLogRPC(ctx, "gmail.Users.Settings.Filters.Delete", func() error {
+		return c.gmail.Users.Settings.Filters.Delete(email, id).Context(ctx).Do()
+	}, "email=%q filterID=%q", email, id)
+	return errors.Wrapf(err, "deleting filter %q", id)
+}
+
+// labelName returns the name of the label ID, or the ID itself if not known.
+func (c *CmdG) labelName(id string) string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if l, found := c.labelCache[id]; found {
+		return l.Label
+	}
+	return id
+}
+
+// DescribeFilterCriteria returns a one line description of what the filter matches.
+func DescribeFilterCriteria(fc *gmail.FilterCriteria) string {
+	if fc == nil {
+		return "<nothing>"
+	}
+	var ret []string
+	add := func(k, v string) {
+		if v != "" {
+			ret = append(ret, fmt.Sprintf("%s:%q", k, v))
+		}
+	}
+	add("from", fc.From)
+	add("to", fc.To)
+	add("subject", fc.Subject)
+	add("query", fc.Query)
+	add("not", fc.NegatedQuery)
+	if fc.HasAttachment {
+		ret = append(ret, "has:attachment")
+	}
+	if len(ret) == 0 {
+		return "<nothing>"
+	}
+	return strings.Join(ret, " ")
+}
+
+// DescribeFilterAction returns a one line description of what the filter does.
+func (c *CmdG) DescribeFilterAction(fa *gmail.FilterAction) string {
+	if fa == nil {
+		return "<nothing>"
+	}
+	var ret []string
+	for _, l := range fa.AddLabelIds {
+		switch l {
+		case Starred:
+			ret = append(ret, "star")
+		case Trash:
+			ret = append(ret, "delete")
+		default:
+			ret = append(ret, "label "+c.labelName(l))
+		}
+	}
+	for _, l := range fa.RemoveLabelIds {
+		switch l {
+		case Inbox:
+			ret = append(ret, "skip inbox")
+		case Unread:
+			ret = append(ret, "mark read")
+		default:
+			ret = append(ret, "unlabel "+c.labelName(l))
+		}
+	}
+	if fa.Forward != "" {
+		ret = append(ret, "forward to "+fa.Forward)
+	}
+	if len(ret) == 0 {
+		return "<nothing>"
+	}
+	sort.Strings(ret)
+	return strings.Join(ret, ", ")
+}
+
+// DescribeFilter returns a one line description of the filter.
+func (c *CmdG) DescribeFilter(f *gmail.Filter) string {
+	return DescribeFilterCriteria(f.Criteria) + " → " + c.DescribeFilterAction(f.Action)
+}
+
+// listID returns the ID part of a List-Id header, which is typically
+// `Some list <list.example.com>`.
+func listID(s string) string {
+	if st, en := strings.LastIndex(s, "<"), strings.LastIndex(s, ">"); st >= 0 && en > st {
+		s = s[st+1 : en]
+	}
+	return strings.TrimSpace(s)
+}
+
+// FilterCriteria returns filter criteria matching messages like this one:
+// Same sender, same mailing list if any, and same subject. All are
+// filled in, for the user to clear what they don't want.
+func (msg *Message) FilterCriteria(ctx context.Context) (*gmail.FilterCriteria, error) {
+	if err := msg.Preload(ctx, LevelMetadata); err != nil {
+		return nil, err
+	}
+	ret := &gmail.FilterCriteria{}
+	if s, err := msg.GetHeader(ctx, "From"); err == nil {
+		if a, err := mail.ParseAddress(s); err == nil {
+			ret.From = a.Address
+		} else {
+			ret.From = s
+		}
+	}
+	if s, err := msg.GetHeader(ctx, "List-Id"); err == nil {
+		if id := listID(s); id != "" {
+			ret.Query = "list:" + id
+		}
+	}
+	if s, err := msg.GetSubject(ctx); err == nil {
+		ret.Subject = s
+	}
+	return ret, nil
+}
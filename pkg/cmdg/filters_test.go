@@ -0,0 +1,20 @@
+package cmdg
+
+import (
+	"testing"
+)
+
+func TestListID(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"Some list <list.example.com>", "list.example.com"},
+		{"<list.example.com>", "list.example.com"},
+		{" list.example.com ", "list.example.com"},
+	} {
+		if got := listID(test.in); got != test.want {
+			t.Errorf("listID(%q): got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package cmdg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// Default file names next to what's imported.
+	importProgressSuffix = ".cmdg-import"
+	importReportSuffix   = ".cmdg-import-failed"
+
+	defaultImportConcurrency = 4
+)
+
+var mboxEscapedFromRE = regexp.MustCompile(`^>(>*From )`)
+
+// ImportOptions controls an import.
+type ImportOptions struct {
+	// Label name or ID to put the messages in. Created if it
+	// doesn't exist. Empty means only "All Mail".
+	Label string
+
+	// Files to remember what's been imported, and to list what
+	// failed. Defaults to next to the mbox file or Maildir.
+	Progress string
+	Report   string
+
+	// Number of uploads at the same time.
+	Concurrency int
+}
+
+// ImportResult is what happened during an import.
+type ImportResult struct {
+	Imported int
+	Skipped  int // Imported by an earlier run.
+	Failed   int
+}
+
+// importMessage is a message read from an mbox file or Maildir.
+type importMessage struct {
+	// Where in the source it is, for the failure report.
+	Location string
+	Raw      []byte
+}
+
+// key identifies the message in the progress file.
+func (m *importMessage) key() string {
+	return fmt.Sprintf("%x", sha256.Sum256(m.Raw))
+}
+
+// describe returns something to recognize the message by in the report.
+func (m *importMessage) describe() string {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Raw))
+	if err != nil {
+		return "(unparsable)"
+	}
+	if id := msg.Header.Get("Message-ID"); id != "" {
+		return id
+	}
+	return msg.Header.Get("Subject")
+}
+
+// readMbox calls cb for every message in an mboxrd or mboxo file.
+func readMbox(r io.Reader, cb func(*importMessage) error) error {
+	br := bufio.NewReader(r)
+	var cur *importMessage
+	var buf bytes.Buffer
+	var offset int64
+	flush := func() error {
+		if cur == nil {
+			return nil
+		}
+		// Drop the empty line separating messages.
+		cur.Raw = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+		cur.Raw = append([]byte{}, cur.Raw...)
+		buf.Reset()
+		return cb(cur)
+	}
+	prevEmpty := true
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			trimmed := strings.TrimRight(line, "\r\n")
+			switch {
+			case prevEmpty && strings.HasPrefix(line, "From "):
+				if err := flush(); err != nil {
+					return err
+				}
+				cur = &importMessage{Location: fmt.Sprintf("offset %d", offset)}
+			case cur == nil:
+				if trimmed != "" {
+					return fmt.Errorf("not an mbox file, starts with %q", trimmed)
+				}
+			default:
+				buf.WriteString(mboxEscapedFromRE.ReplaceAllString(line, "$1"))
+			}
+			prevEmpty = trimmed == ""
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			return flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readMaildir calls cb for every message in the Maildir, oldest first.
+func readMaildir(dir string, cb func(*importMessage) error) error {
+	var fns []string
+	for _, sub := range []string{"cur", "new"} {
+		fs, err := ioutil.ReadDir(path.Join(dir, sub))
+		if err != nil {
+			return err
+		}
+		for _, f := range fs {
+			if f.Mode().IsRegular() && !strings.HasPrefix(f.Name(), ".") {
+				fns = append(fns, path.Join(sub, f.Name()))
+			}
+		}
+	}
+	// Names start with the time of delivery.
+	sort.Slice(fns, func(i, j int) bool { return path.Base(fns[i]) < path.Base(fns[j]) })
+	for _, fn := range fns {
+		b, err := ioutil.ReadFile(path.Join(dir, fn))
+		if err != nil {
+			return err
+		}
+		if err := cb(&importMessage{Location: fn, Raw: b}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readImport reads a Maildir if fn is a directory, otherwise an mbox file.
+func readImport(fn string, cb func(*importMessage) error) error {
+	st, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return readMaildir(fn, cb)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readMbox(f, cb)
+}
+
+// importLabel returns the ID of the label, creating it if needed.
+func (c *CmdG) importLabel(ctx context.Context, name string) (string, error) {
+	if err := c.LoadLabels(ctx); err != nil {
+		return "", errors.Wrap(err, "loading labels")
+	}
+	if id, err := c.LabelID(name); err == nil {
+		return id, nil
+	}
+	l, err := c.CreateLabel(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return l.ID, nil
+}
+
+// importOne uploads one message, dated by its Date header.
+func (c *CmdG) importOne(ctx context.Context, m *importMessage, labels []string) error {
+	return c.wrapLogRPC(ctx, "gmail.Users.Messages.Import", func() error {
+		_, err := c.gmail.Users.Messages.Import(email, &gmail.Message{LabelIds: labels}).
+			InternalDateSource("dateHeader").
+			NeverMarkSpam(true).
+			Media(bytes.NewReader(m.Raw), googleapi.ContentType("message/rfc822")).
+			Context(ctx).
+			Do()
+		return err
+	}, "email=%q location=%q size=%d labels=%v", email, m.Location, len(m.Raw), labels)
+}
+
+// Import uploads all messages in an mbox file or Maildir into Gmail.
+// Messages imported by an earlier run are skipped, so an interrupted
+// or partly failed import is continued by running it again. Messages
+// that fail are listed in the report file.
+func (c *CmdG) Import(ctx context.Context, fn string, opts ImportOptions) (*ImportResult, error) {
+	if err := c.CheckWrite("importing"); err != nil {
+		return nil, err
+	}
+	if opts.Progress == "" {
+		opts.Progress = strings.TrimSuffix(fn, "/") + importProgressSuffix
+	}
+	if opts.Report == "" {
+		opts.Report = strings.TrimSuffix(fn, "/") + importReportSuffix
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = defaultImportConcurrency
+	}
+	var labels []string
+	if opts.Label != "" {
+		id, err := c.importLabel(ctx, opts.Label)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting label %q", opts.Label)
+		}
+		labels = []string{id}
+	}
+
+	progress, err := openExportProgress(opts.Progress)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening progress file %q", opts.Progress)
+	}
+	defer progress.Close()
+	// Copy, since the progress is added to while reading.
+	done := make(map[string]bool)
+	for k := range progress.done {
+		done[k] = true
+	}
+	report, err := os.OpenFile(opts.Report, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating report %q", opts.Report)
+	}
+	defer report.Close()
+
+	type result struct {
+		msg *importMessage
+		key string
+		err error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	todo := make(chan *importMessage)
+	results := make(chan result)
+
+	// Upload.
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range todo {
+				results <- result{
+					msg: m,
+					key: m.key(),
+					err: c.importOne(ctx, m, labels),
+				}
+			}
+		}()
+	}
+
+	// Read.
+	ret := &ImportResult{}
+	var readErr error
+	go func() {
+		defer func() {
+			close(todo)
+			wg.Wait()
+			close(results)
+		}()
+		readErr = readImport(fn, func(m *importMessage) error {
+			// Skipped is only changed here until results is closed.
+			if done[m.key()] {
+				ret.Skipped++
+				return nil
+			}
+			select {
+			case todo <- m:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	// Record.
+	var writeErr error
+	for r := range results {
+		if writeErr != nil {
+			continue
+		}
+		if r.err != nil {
+			ret.Failed++
+			log.Warningf("Failed to import %s: %v", r.msg.Location, r.err)
+			_, writeErr = fmt.Fprintf(report, "%s\t%s\t%v\n", r.msg.Location, r.msg.describe(), r.err)
+		} else {
+			ret.Imported++
+			writeErr = progress.add(r.key, 0)
+		}
+		if writeErr != nil {
+			cancel()
+		}
+	}
+	if writeErr != nil {
+		return ret, errors.Wrap(writeErr, "recording import progress")
+	}
+	if readErr != nil {
+		return ret, errors.Wrapf(readErr, "reading %q", fn)
+	}
+	return ret, nil
+}
@@ -0,0 +1,138 @@
+package cmdg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadMbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "out.mbox")
+
+	// Read what export writes.
+	raws := []string{
+		"Subject: a\n\nFrom here\n>From there\n\nlast line\n",
+		"Subject: b\n\nbody\n",
+	}
+	s, err := openMbox(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, raw := range raws {
+		if err := s.write(&exportMessage{ID: fmt.Sprint(n), Date: time.Now(), Labels: []string{"INBOX"}, Raw: raw}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	var got []*importMessage
+	if err := readImport(fn, func(m *importMessage) error {
+		got = append(got, m)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(raws) {
+		t.Fatalf("Got %d messages, want %d", len(got), len(raws))
+	}
+	for n, raw := range raws {
+		if want := "X-Gmail-Labels: INBOX\n" + raw; string(got[n].Raw) != want {
+			t.Errorf("Message %d: got %q, want %q", n, got[n].Raw, want)
+		}
+	}
+	if got[0].Location != "offset 0" {
+		t.Errorf("Got location %q", got[0].Location)
+	}
+
+	if err := readMbox(strings.NewReader("Subject: not mbox\n"), func(*importMessage) error { return nil }); err == nil {
+		t.Errorf("Read non-mbox without error")
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "in.mbox")
+	if err := ioutil.WriteFile(fn, []byte("From x\nSubject: one\n\n1\n\nFrom x\nSubject: fail\nMessage-ID: <bad@example.com>\n\n2\n\nFrom x\nSubject: three\n\n3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var m sync.Mutex
+	var uploaded []string
+	fail := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/me/messages/import") {
+			t.Errorf("Unexpected request %q", r.URL.Path)
+		}
+		if got, want := r.FormValue("internalDateSource"), "dateHeader"; got != want {
+			t.Errorf("Got date source %q, want %q", got, want)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		m.Lock()
+		defer m.Unlock()
+		if strings.Contains(string(b), "Subject: fail") && fail {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": {"code": 400, "message": "bad message"}}`)
+			return
+		}
+		for _, s := range []string{"one", "fail", "three"} {
+			if strings.Contains(string(b), "Subject: "+s) {
+				uploaded = append(uploaded, s)
+			}
+		}
+		fmt.Fprint(w, `{"id": "new"}`)
+	}))
+	defer ts.Close()
+	c, err := NewFake(ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.gmail.BasePath = ts.URL + "/"
+
+	ctx := context.Background()
+	res, err := c.Import(ctx, fn, ImportOptions{Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != (ImportResult{Imported: 2, Failed: 1}) {
+		t.Errorf("Got result %+v", res)
+	}
+	report, err := ioutil.ReadFile(fn + importReportSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(report), "offset 24\t<bad@example.com>\t") {
+		t.Errorf("Bad report: %q", report)
+	}
+
+	// Only the failed one is imported again.
+	m.Lock()
+	fail = false
+	m.Unlock()
+	res, err = c.Import(ctx, fn, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *res != (ImportResult{Imported: 1, Skipped: 2}) {
+		t.Errorf("Got result %+v", res)
+	}
+	if got, want := len(uploaded), 3; got != want {
+		t.Errorf("Uploaded %d times, want %d: %q", got, want, uploaded)
+	}
+}
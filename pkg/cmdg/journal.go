@@ -0,0 +1,374 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	journalDirName       = "journal"
+	journalFailedDirName = "failed"
+
+	journalModify = "modify"
+	journalSend   = "send"
+
+	journalRetryMin = 15 * time.Second
+	journalRetryMax = 10 * time.Minute
+)
+
+var (
+	// ErrQueued is returned when an outgoing message could not be sent right now,
+	// but has been saved and will be sent once connectivity returns.
+	ErrQueued = fmt.Errorf("offline: queued for sending later")
+)
+
+// journalEntry is one pending mutation or outgoing message.
+type journalEntry struct {
+	Seq      uint64    `json:"seq"`
+	Created  time.Time `json:"created"`
+	Op       string    `json:"op"`
+	Attempts int       `json:"attempts,omitempty"`
+	LastErr  string    `json:"last_error,omitempty"`
+
+	// For journalModify.
+	IDs            []string `json:"ids,omitempty"`
+	AddLabelIDs    []string `json:"add_label_ids,omitempty"`
+	RemoveLabelIDs []string `json:"remove_label_ids,omitempty"`
+
+	// For journalSend.
+	ThreadID ThreadID `json:"thread_id,omitempty"`
+	Message  string   `json:"message,omitempty"`
+}
+
+// journal is a durable, ordered queue of things to do once the
+// network is back. One file per entry, named by sequence number.
+type journal struct {
+	m       sync.Mutex
+	dir     string
+	nextSeq uint64
+	entries []*journalEntry
+	kick    chan struct{}
+}
+
+func newJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "creating journal directory %q", dir)
+	}
+	j := &journal{
+		dir:     dir,
+		nextSeq: 1,
+		kick:    make(chan struct{}, 1),
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing journal directory %q", dir)
+	}
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading journal entry %q", fi.Name())
+		}
+		var e journalEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			log.Errorf("Skipping corrupt journal entry %q: %v", fi.Name(), err)
+			continue
+		}
+		j.entries = append(j.entries, &e)
+		if e.Seq >= j.nextSeq {
+			j.nextSeq = e.Seq + 1
+		}
+	}
+	sort.Slice(j.entries, func(a, b int) bool {
+		return j.entries[a].Seq < j.entries[b].Seq
+	})
+	if len(j.entries) > 0 {
+		log.Infof("Journal has %d pending entries", len(j.entries))
+	}
+	return j, nil
+}
+
+func (j *journal) filename(seq uint64) string {
+	return path.Join(j.dir, fmt.Sprintf("%020d.json", seq))
+}
+
+func (j *journal) write(e *journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.filename(e.Seq), b)
+}
+
+// add durably appends an entry to the journal.
+func (j *journal) add(e *journalEntry) error {
+	j.m.Lock()
+	defer j.m.Unlock()
+	e.Seq = j.nextSeq
+	e.Created = time.Now()
+	if err := j.write(e); err != nil {
+		return errors.Wrap(err, "writing journal entry")
+	}
+	j.nextSeq++
+	j.entries = append(j.entries, e)
+	select {
+	case j.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (j *journal) len() int {
+	j.m.Lock()
+	defer j.m.Unlock()
+	return len(j.entries)
+}
+
+func (j *journal) first() *journalEntry {
+	j.m.Lock()
+	defer j.m.Unlock()
+	if len(j.entries) == 0 {
+		return nil
+	}
+	return j.entries[0]
+}
+
+// remove removes the first entry, which must be `e`.
+// If `failed` then the entry is kept in the failed directory for the user to look at.
+func (j *journal) remove(e *journalEntry, failed bool) error {
+	j.m.Lock()
+	defer j.m.Unlock()
+	if len(j.entries) == 0 || j.entries[0] != e {
+		return fmt.Errorf("can't happen: journal entry %d is not first", e.Seq)
+	}
+	fn := j.filename(e.Seq)
+	if failed {
+		fdir := path.Join(j.dir, journalFailedDirName)
+		if err := os.MkdirAll(fdir, 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(fn, path.Join(fdir, path.Base(fn))); err != nil {
+			return err
+		}
+	} else if err := os.Remove(fn); err != nil {
+		return err
+	}
+	j.entries = j.entries[1:]
+	return nil
+}
+
+// labels returns `labels` with pending journalled label changes for the message applied.
+func (j *journal) labels(msgID string, labels []string) []string {
+	j.m.Lock()
+	defer j.m.Unlock()
+	for _, e := range j.entries {
+		if e.Op != journalModify {
+			continue
+		}
+		found := false
+		for _, id := range e.IDs {
+			if id == msgID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		have := make(map[string]bool)
+		var nl []string
+		for _, l := range labels {
+			if !inList(l, e.RemoveLabelIDs) {
+				nl = append(nl, l)
+				have[l] = true
+			}
+		}
+		for _, l := range e.AddLabelIDs {
+			if !have[l] {
+				nl = append(nl, l)
+			}
+		}
+		labels = nl
+	}
+	return labels
+}
+
+func inList(s string, l []string) bool {
+	for _, t := range l {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransient returns true if the error looks like it could go away
+// by itself, such as network being down or server errors. Other
+// errors, like bad requests or TLS failures, would just fail again.
+func isTransient(err error) bool {
+	err = errors.Cause(err)
+	if e, ok := err.(*googleapi.Error); ok {
+		return e.Code >= 500 || e.Code == 429
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	if e, ok := err.(net.Error); ok {
+		return e.Timeout() || e.Temporary()
+	}
+	return false
+}
+
+// neverSent returns true if the error shows that the request never
+// reached the server, so it's safe to send again. Unlike isTransient,
+// server errors and timeouts don't count, since a message may have
+// been sent anyway.
+func neverSent(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.As(err, &dnsErr)
+}
+
+// journalLabels returns the labels with pending changes applied, so that
+// the local optimistic view survives reloads from the server.
+func (c *CmdG) journalLabels(msgID string, labels []string) []string {
+	if c == nil || c.journal == nil {
+		return labels
+	}
+	return c.journal.labels(msgID, labels)
+}
+
+// PendingJournal returns the number of mutations and messages waiting to be sent to the server.
+func (c *CmdG) PendingJournal() int {
+	if c.journal == nil {
+		return 0
+	}
+	return c.journal.len()
+}
+
+// batchModify adds and removes labels on many messages.
+// If the network is down then the change is journalled and replayed later.
+func (c *CmdG) batchModify(ctx context.Context, ids, add, remove []string) error {
+	if err := c.CheckWrite("changing labels"); err != nil {
+		return err
+	}
+	e := &journalEntry{
+		Op:             journalModify,
+		IDs:            ids,
+		AddLabelIDs:    add,
+		RemoveLabelIDs: remove,
+	}
+	if c.journal != nil && c.journal.len() > 0 {
+		// Keep things in order. Queue up behind what's already waiting.
+		log.Infof("Journal not empty, queueing modification of %d messages", len(ids))
+		return c.journal.add(e)
+	}
+	err := c.batchModifyRPC(ctx, ids, add, remove)
+	if err != nil && c.journal != nil && isTransient(err) {
+		log.Warningf("Modification of %d messages failed, journalling for later: %v", len(ids), err)
+		return c.journal.add(e)
+	}
+	return err
+}
+
+func (c *CmdG) batchModifyRPC(ctx context.Context, ids, add, remove []string) error {
+	return c.wrapLogRPC(ctx, "gmail.Users.Messages.BatchModify", func() error {
+		return c.gmail.Users.Messages.BatchModify(email, &gmail.BatchModifyMessagesRequest{
+			Ids:            ids,
+			AddLabelIds:    add,
+			RemoveLabelIds: remove,
+		}).Context(ctx).Do()
+	}, "email=%q add=%v remove=%v ids=%v", email, add, remove, ids)
+}
+
+// ReplayJournal runs pending journal entries in order.
+// It stops at the first entry that fails in a way that may work later.
+func (c *CmdG) ReplayJournal(ctx context.Context) error {
+	if c.journal == nil || c.readOnly {
+		return nil
+	}
+	for {
+		e := c.journal.first()
+		if e == nil {
+			return nil
+		}
+		var err error
+		switch e.Op {
+		case journalModify:
+			err = c.batchModifyRPC(ctx, e.IDs, e.AddLabelIDs, e.RemoveLabelIDs)
+		case journalSend:
+			err = c.send(ctx, e.ThreadID, e.Message)
+		default:
+			err = fmt.Errorf("unknown journal op %q", e.Op)
+		}
+		retry := isTransient(err)
+		if e.Op == journalSend {
+			retry = neverSent(err)
+		}
+		if err != nil && retry {
+			e.Attempts++
+			e.LastErr = err.Error()
+			if err2 := c.journal.write(e); err2 != nil {
+				log.Errorf("Failed to update journal entry %d: %v", e.Seq, err2)
+			}
+			return errors.Wrapf(err, "replaying journal entry %d", e.Seq)
+		}
+		if err != nil {
+			log.Errorf("Journal entry %d (%s) failed permanently, moving to %q: %v", e.Seq, e.Op, journalFailedDirName, err)
+		} else {
+			log.Infof("Replayed journal entry %d (%s)", e.Seq, e.Op)
+		}
+		if err := c.journal.remove(e, err != nil); err != nil {
+			return errors.Wrapf(err, "removing journal entry %d", e.Seq)
+		}
+	}
+}
+
+// RunJournal replays the journal whenever something is added to it, retrying
+// with backoff while the network is down. It runs until the context is cancelled.
+func (c *CmdG) RunJournal(ctx context.Context) {
+	if c.journal == nil {
+		return
+	}
+	delay := journalRetryMin
+	for {
+		var timer <-chan time.Time
+		if c.journal.len() > 0 {
+			timer = time.After(delay)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.journal.kick:
+		case <-timer:
+		}
+		if err := c.ReplayJournal(ctx); err != nil {
+			log.Warningf("Journal replay failed, retrying in %v: %v", delay, err)
+			delay *= 2
+			if delay > journalRetryMax {
+				delay = journalRetryMax
+			}
+			continue
+		}
+		delay = journalRetryMin
+	}
+}
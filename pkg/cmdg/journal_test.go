@@ -0,0 +1,285 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+type fakeNetError struct {
+	timeout, temporary bool
+}
+
+func (e *fakeNetError) Error() string   { return "fake net error" }
+func (e *fakeNetError) Timeout() bool   { return e.timeout }
+func (e *fakeNetError) Temporary() bool { return e.temporary }
+
+func TestIsTransient(t *testing.T) {
+	dial := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://example.com/", Err: &net.OpError{
+			Op:  "dial",
+			Net: "tcp",
+			Err: os.NewSyscallError("connect", err),
+		}}
+	}
+	for _, test := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &googleapi.Error{Code: 503}, true},
+		{"rate limited", &googleapi.Error{Code: 429}, true},
+		{"bad request", &googleapi.Error{Code: 400}, false},
+		{"not found", errors.Wrap(&googleapi.Error{Code: 404}, "wrapped"), false},
+		{"connection refused", dial(syscall.ECONNREFUSED), true},
+		{"connection reset", errors.Wrap(dial(syscall.ECONNRESET), "wrapped"), true},
+		{"other dial error", dial(syscall.EACCES), false},
+		{"timeout", &url.Error{Op: "Post", URL: "https://example.com/", Err: &fakeNetError{timeout: true}}, true},
+		{"temporary", &fakeNetError{temporary: true}, true},
+		{"permanent net error", &fakeNetError{}, false},
+		{"TLS failure", &url.Error{Op: "Post", URL: "https://example.com/", Err: fmt.Errorf("x509: certificate signed by unknown authority")}, false},
+		{"cancelled", &url.Error{Op: "Post", URL: "https://example.com/", Err: context.Canceled}, false},
+		{"other", fmt.Errorf("something"), false},
+	} {
+		if got := isTransient(test.err); got != test.want {
+			t.Errorf("%s: isTransient(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestNeverSent(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", errors.Wrap(&url.Error{Op: "Post", URL: "https://example.com/", Err: &net.OpError{
+			Op:  "dial",
+			Net: "tcp",
+			Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+		}}, "wrapped"), true},
+		{"DNS failure", &url.Error{Op: "Post", URL: "https://example.com/", Err: &net.OpError{
+			Op:  "dial",
+			Net: "tcp",
+			Err: &net.DNSError{Err: "no such host", Name: "example.com"},
+		}}, true},
+		{"connection reset", &url.Error{Op: "Post", URL: "https://example.com/", Err: syscall.ECONNRESET}, false},
+		{"server error", &googleapi.Error{Code: 500}, false},
+		{"timeout", &url.Error{Op: "Post", URL: "https://example.com/", Err: &fakeNetError{timeout: true}}, false},
+	} {
+		if got := neverSent(test.err); got != test.want {
+			t.Errorf("%s: neverSent(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestSendOrQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var m sync.Mutex
+	sends := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		sends++
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error": {"code": 500, "message": "Backend Error"}}`)
+	}))
+	defer ts.Close()
+	count := func() int {
+		m.Lock()
+		defer m.Unlock()
+		return sends
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	c, err := NewFake(ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.journal, err = newJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// May have been sent, so it's not queued, or even retried.
+	c.gmail.BasePath = ts.URL + "/"
+	if err := c.sendOrQueue(ctx, "", "Subject: hi\r\n\r\nhello\r\n"); err == nil || err == ErrQueued {
+		t.Errorf("Got %v on server error, want the error", err)
+	}
+	if got := c.PendingJournal(); got != 0 {
+		t.Errorf("Got %d journal entries after server error, want 0", got)
+	}
+	if got := count(); got != 1 {
+		t.Errorf("Sent %d times, want once", got)
+	}
+
+	// Never sent, so queued.
+	c.gmail.BasePath = down.URL + "/"
+	if err := c.sendOrQueue(ctx, "", "Subject: hi\r\n\r\nhello\r\n"); err != ErrQueued {
+		t.Errorf("Got %v while offline, want ErrQueued", err)
+	}
+	if got := c.PendingJournal(); got != 1 {
+		t.Errorf("Got %d journal entries while offline, want 1", got)
+	}
+
+	// Server error on replay moves it aside, instead of sending again.
+	c.gmail.BasePath = ts.URL + "/"
+	if err := c.ReplayJournal(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.PendingJournal(); got != 0 {
+		t.Errorf("Got %d journal entries after replay, want 0", got)
+	}
+	if got := count(); got != 2 {
+		t.Errorf("Sent %d times, want twice", got)
+	}
+}
+
+func TestJournalOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := newJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []*journalEntry{
+		{Op: journalModify, IDs: []string{"a"}, RemoveLabelIDs: []string{Inbox}},
+		{Op: journalModify, IDs: []string{"a", "b"}, AddLabelIDs: []string{Starred}},
+		{Op: journalModify, IDs: []string{"a"}, AddLabelIDs: []string{Inbox}},
+	} {
+		if err := j.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := fmt.Sprint(j.labels("a", []string{Inbox, Unread})), "[UNREAD STARRED INBOX]"; got != want {
+		t.Errorf("Got labels %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(j.labels("b", nil)), "[STARRED]"; got != want {
+		t.Errorf("Got labels %s, want %s", got, want)
+	}
+	if err := j.remove(j.first(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopened journal keeps the order, and continues the sequence.
+	j, err = newJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint64
+	for _, e := range j.entries {
+		seqs = append(seqs, e.Seq)
+	}
+	if got, want := fmt.Sprint(seqs), "[2 3]"; got != want {
+		t.Errorf("Got sequence numbers %s, want %s", got, want)
+	}
+	e := &journalEntry{Op: journalModify, IDs: []string{"c"}}
+	if err := j.add(e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Seq != 4 {
+		t.Errorf("Got sequence number %d, want 4", e.Seq)
+	}
+	if err := j.remove(e, false); err == nil {
+		t.Errorf("Removed entry that's not first")
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var m sync.Mutex
+	var replayed []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req gmail.BatchModifyMessagesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		m.Lock()
+		defer m.Unlock()
+		replayed = append(replayed, strings.Join(req.Ids, ","))
+		if req.Ids[0] == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": {"code": 400, "message": "Bad"}}`)
+		}
+	}))
+	defer ts.Close()
+
+	// Nothing listening, so connections are refused.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	c, err := NewFake(ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.journal, err = newJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Offline, so changes are journalled.
+	c.gmail.BasePath = down.URL + "/"
+	for _, ids := range [][]string{{"a"}, {"bad"}, {"b", "c"}} {
+		if err := c.batchModify(ctx, ids, nil, []string{Inbox}); err != nil {
+			t.Fatalf("batchModify(%v): %v", ids, err)
+		}
+	}
+	if err := c.ReplayJournal(ctx); err == nil {
+		t.Fatalf("Replay succeeded while offline")
+	}
+	if got := c.PendingJournal(); got != 3 {
+		t.Fatalf("Got %d journal entries, want 3", got)
+	}
+	if e := c.journal.first(); e.Attempts != 1 || e.LastErr == "" {
+		t.Errorf("Failed attempt not recorded: %+v", e)
+	}
+
+	// Online again, replayed in order. The bad one is moved aside.
+	c.gmail.BasePath = ts.URL + "/"
+	if err := c.ReplayJournal(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.PendingJournal(); got != 0 {
+		t.Errorf("Got %d journal entries after replay, want 0", got)
+	}
+	if got, want := strings.Join(replayed, " "), "a bad b,c"; got != want {
+		t.Errorf("Replayed %q, want %q", got, want)
+	}
+	fs, err := ioutil.ReadDir(path.Join(dir, journalFailedDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 1 {
+		t.Errorf("Got %d failed entries, want 1", len(fs))
+	}
+}
@@ -0,0 +1,178 @@
+package cmdg
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+const (
+	labelTypeSystem = "system"
+
+	labelColorDark  = "#000000"
+	labelColorLight = "#ffffff"
+)
+
+// IsSystem returns true for labels like INBOX, that can't be changed.
+func (l *Label) IsSystem() bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.Response != nil && l.Response.Type == labelTypeSystem
+}
+
+// LabelPalette returns the background colors Gmail accepts for labels.
+func LabelPalette() []string {
+	var ret []string
+	for c := range textColorMap {
+		if !nonStandardColors[c] {
+			ret = append(ret, c)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// LabelColorString returns an ANSI escape sequence to show a label with the given background color.
+func LabelColorString(bg string) string {
+	return colorMap(labelTextColor(bg), bg)
+}
+
+// labelTextColor picks black or white text, whichever is more readable on the background.
+func labelTextColor(bg string) string {
+	v, err := strconv.ParseUint(strings.TrimPrefix(bg, "#"), 16, 32)
+	if err != nil || len(bg) != 7 {
+		return labelColorDark
+	}
+	r, g, b := (v>>16)&0xff, (v>>8)&0xff, v&0xff
+	if 299*r+587*g+114*b > 128000 {
+		return labelColorDark
+	}
+	return labelColorLight
+}
+
+func (c *CmdG) cacheLabel(l *gmail.Label) *Label {
+	ret := &Label{
+		ID:       l.Id,
+		Label:    l.Name,
+		Response: l,
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.labelCache[l.Id] = ret
+	c.labelChangedLocked(l.Id)
+	return ret
+}
+
+// labelChangedLocked records that the label was changed here. Must
+// hold c.m.
+func (c *CmdG) labelChangedLocked(id string) {
+	if c.labelChanged == nil {
+		c.labelChanged = make(map[string]uint64)
+	}
+	c.labelGen++
+	c.labelChanged[id] = c.labelGen
+}
+
+// CreateLabel creates a new label.
+func (c *CmdG) CreateLabel(ctx context.Context, name string) (*Label, error) {
+	if err := c.CheckWrite("creating label"); err != nil {
+		return nil, err
+	}
+	var l *gmail.Label
+	err := c.wrapLogRPC(ctx, "gmail.Users.Labels.Create", func() (err error) {
+		l, err = c.gmail.Users.Labels.Create(email, &gmail.Label{
+			Name:                  name,
+			LabelListVisibility:   "labelShow",
+			MessageListVisibility: "show",
+		}).Context(ctx).Do()
+		return
+	}, "email=%q name=%q", email, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating label %q", name)
+	}
+	return c.cacheLabel(l), nil
+}
+
+func (c *CmdG) patchLabel(ctx context.Context, id string, patch *gmail.Label) error {
+	if err := c.CheckWrite("changing label"); err != nil {
+		return err
+	}
+	var l *gmail.Label
+	err := c.wrapLogRPC(ctx, "gmail.Users.Labels.Patch", func() (err error) {
+		l, err = c.gmail.Users.Labels.Patch(email, id, patch).Context(ctx).Do()
+		return
+	}, "email=%q labelID=%q patch=%+v", email, id, patch)
+	if err != nil {
+		return err
+	}
+	c.cacheLabel(l)
+	return nil
+}
+
+// RenameLabel renames a label.
+func (c *CmdG) RenameLabel(ctx context.Context, id, name string) error {
+	return errors.Wrapf(c.patchLabel(ctx, id, &gmail.Label{Name: name}), "renaming label %q to %q", id, name)
+}
+
+// SetLabelColor sets the background color of a label, which must be from
+// LabelPalette(). Text color is chosen to be readable. Empty color removes it.
+func (c *CmdG) SetLabelColor(ctx context.Context, id, bg string) error {
+	if err := c.CheckWrite("changing label color"); err != nil {
+		return err
+	}
+	if bg == "" {
+		// Patch ignores empty fields, so need a full update.
+		return errors.Wrapf(c.removeLabelColor(ctx, id), "removing color from label %q", id)
+	}
+	return errors.Wrapf(c.patchLabel(ctx, id, &gmail.Label{
+		Color: &gmail.LabelColor{
+			BackgroundColor: bg,
+			TextColor:       labelTextColor(bg),
+		},
+	}), "setting color of label %q to %q", id, bg)
+}
+
+func (c *CmdG) removeLabelColor(ctx context.Context, id string) error {
+	c.m.RLock()
+	old, found := c.labelCache[id]
+	c.m.RUnlock()
+	if !found {
+		return errors.Errorf("unknown label %q", id)
+	}
+	old.m.Lock()
+	nl := *old.Response
+	old.m.Unlock()
+	nl.Color = nil
+	var l *gmail.Label
+	err := c.wrapLogRPC(ctx, "gmail.Users.Labels.Update", func() (err error) {
+		l, err = c.gmail.Users.Labels.Update(email, id, &nl).Context(ctx).Do()
+		return
+	}, "email=%q labelID=%q", email, id)
+	if err != nil {
+		return err
+	}
+	c.cacheLabel(l)
+	return nil
+}
+
+// DeleteLabel deletes a label, removing it from all messages.
+func (c *CmdG) DeleteLabel(ctx context.Context, id string) error {
+	if err := c.CheckWrite("deleting label"); err != nil {
+		return err
+	}
+	err := c.wrapLogRPC(ctx, "gmail.Users.Labels.Delete", func() error {
+		return c.gmail.Users.Labels.Delete(email, id).Context(ctx).Do()
+	}, "email=%q labelID=%q", email, id)
+	if err != nil {
+		return errors.Wrapf(err, "deleting label %q", id)
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.labelCache, id)
+	c.labelChangedLocked(id)
+	return nil
+}
@@ -0,0 +1,99 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestLoadLabelsKeepsLocalChanges(t *testing.T) {
+	var c *CmdG
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/me/labels" {
+			t.Errorf("Unexpected request for %q", r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// Created and deleted while listing.
+		c.cacheLabel(&gmail.Label{Id: "Label_new", Name: "New"})
+		c.m.Lock()
+		delete(c.labelCache, "Label_gone")
+		c.labelChangedLocked("Label_gone")
+		c.m.Unlock()
+		if err := json.NewEncoder(w).Encode(&gmail.ListLabelsResponse{
+			Labels: []*gmail.Label{
+				{Id: Inbox, Name: Inbox},
+				{Id: "Label_gone", Name: "Gone"},
+			},
+		}); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+	var err error
+	c, err = NewFake(ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.gmail.BasePath = ts.URL + "/"
+	c.cacheLabel(&gmail.Label{Id: "Label_old", Name: "Old"})
+	c.cacheLabel(&gmail.Label{Id: "Label_gone", Name: "Gone"})
+
+	if err := c.LoadLabels(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, l := range c.Labels() {
+		ids = append(ids, l.ID)
+	}
+	sort.Strings(ids)
+	// Label_old was deleted elsewhere before listing.
+	if got, want := fmt.Sprint(ids), "[INBOX Label_new]"; got != want {
+		t.Errorf("Got labels %s, want %s", got, want)
+	}
+}
+
+func TestBatchSpam(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/me/messages/batchModify" {
+			t.Errorf("Unexpected request for %q", r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req gmail.BatchModifyMessagesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		got = fmt.Sprint(req.Ids, req.AddLabelIds, req.RemoveLabelIds)
+	}))
+	defer ts.Close()
+	c, err := NewFake(ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.gmail.BasePath = ts.URL + "/"
+
+	for _, test := range []struct {
+		name string
+		f    func(context.Context, []string) error
+		want string
+	}{
+		{"spam", c.BatchSpam, "[a b] [SPAM] [INBOX]"},
+		{"not spam", c.BatchNotSpam, "[a b] [INBOX] [SPAM]"},
+	} {
+		got = ""
+		if err := test.f(context.Background(), []string{"a", "b"}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got ids, add, remove %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -29,10 +29,14 @@ import (
 
 // Special labels.
 const (
-	Inbox   = "INBOX"
-	Trash   = "TRASH"
-	Unread  = "UNREAD"
-	Starred = "STARRED"
+	Inbox     = "INBOX"
+	Trash     = "TRASH"
+	Unread    = "UNREAD"
+	Starred   = "STARRED"
+	Sent      = "SENT"
+	Spam      = "SPAM"
+	Muted     = "MUTE"
+	Important = "IMPORTANT"
 )
 
 const (
@@ -89,7 +93,7 @@ func (a *Attachment) Download(ctx context.Context) ([]byte, error) {
 		return a.contents, nil
 	}
 	var body *gmail.MessagePartBody
-	err := wrapLogRPC("gmail.Users.Messages.Attachments.Get", func() (err error) {
+	err := a.conn.wrapLogRPC(ctx, "gmail.Users.Messages.Attachments.Get", func() (err error) {
 		body, err = a.conn.gmail.Users.Messages.Attachments.Get(email, a.MsgID, a.ID).Context(ctx).Do()
 		return
 	}, "email=%q msg=%v attachment=%v", email, a.MsgID, a.ID)
@@ -161,26 +165,42 @@ func (msg *Message) rawNoLock(ctx context.Context) (string, error) {
 	if msg.raw != "" {
 		return msg.raw, nil
 	}
+	if msg.conn.cache != nil {
+		if raw, found := msg.conn.cache.getRaw(msg.ID); found {
+			msg.raw = raw
+			return msg.raw, nil
+		}
+	}
 
+	dec, err := msg.fetchRaw(ctx)
+	if err != nil {
+		return "", err
+	}
+	msg.raw = dec
+	if msg.conn.cache != nil {
+		msg.conn.cache.putRaw(msg.ID, dec)
+	}
+	return msg.raw, nil
+}
+
+// fetchRaw downloads the raw message, bypassing and not filling any
+// cache. For going through many messages once, like exports.
+func (msg *Message) fetchRaw(ctx context.Context) (string, error) {
 	var m *gmail.Message
-	err := wrapLogRPC("gmail.Users.Messages.Get", func() (err error) {
+	err := msg.conn.wrapLogRPC(ctx, "gmail.Users.Messages.Get", func() (err error) {
 		m, err = msg.conn.gmail.Users.Messages.Get(email, msg.ID).Format(levelRaw).Context(ctx).Do()
 		return
 	}, "email=%q msg=%v level=%s", email, msg.ID, levelRaw)
 	if err != nil {
 		return "", err
 	}
-	dec, err := MIMEDecode(m.Raw)
-	if err != nil {
-		return "", err
-	}
-	msg.raw = dec
-	return msg.raw, nil
+	return MIMEDecode(m.Raw)
 }
 
 // called with lock held
 func (msg *Message) annotateAttachments() error {
 	var bodystr []string
+	msg.attachments = nil
 	for _, p := range msg.Response.Payload.Parts {
 		if !partIsAttachment(p) {
 			continue
@@ -261,9 +281,12 @@ func (msg *Message) HasLabel(labelID string) bool {
 
 // RemoveLabelID removes a label.
 func (msg *Message) RemoveLabelID(ctx context.Context, labelID string) error {
+	if err := msg.conn.CheckWrite("removing label"); err != nil {
+		return err
+	}
 	var nm *gmail.Message
 	st := time.Now()
-	err := wrapLogRPC("gmail.Users.Messages.Modify", func() (err error) {
+	err := msg.conn.wrapLogRPC(ctx, "gmail.Users.Messages.Modify", func() (err error) {
 		nm, err = msg.conn.gmail.Users.Messages.Modify(email, msg.ID, &gmail.ModifyMessageRequest{
 			RemoveLabelIds: []string{labelID},
 		}).Context(ctx).Do()
@@ -280,7 +303,7 @@ func (msg *Message) RemoveLabelID(ctx context.Context, labelID string) error {
 	if msg.Response == nil {
 		msg.Response = nm
 	} else {
-		msg.Response.LabelIds = nm.LabelIds
+		msg.Response.LabelIds = msg.conn.journalLabels(msg.ID, nm.LabelIds)
 	}
 	return nil
 }
@@ -288,6 +311,10 @@ func (msg *Message) RemoveLabelID(ctx context.Context, labelID string) error {
 // AddLabelIDLocal adds a local label to the local cache *only*. It'll be overwritten at next sync.
 // It's used for faster UI response time on label adding.
 func (msg *Message) AddLabelIDLocal(labelID string) {
+	if msg.conn != nil && msg.conn.ReadOnly() {
+		// Would never be synced.
+		return
+	}
 	msg.m.Lock()
 	defer msg.m.Unlock()
 	if msg.Response == nil {
@@ -304,12 +331,16 @@ func (msg *Message) AddLabelIDLocal(labelID string) {
 // RemoveLabelIDLocal removes a local label from the local cache *only*. It'll be overwritten at next sync.
 // It's used for faster UI response time on label removing.
 func (msg *Message) RemoveLabelIDLocal(labelID string) {
-	if msg.Response == nil {
+	if msg.conn != nil && msg.conn.ReadOnly() {
+		// Would never be synced.
 		return
 	}
-	nl := make([]string, len(msg.Response.LabelIds))
 	msg.m.Lock()
 	defer msg.m.Unlock()
+	if msg.Response == nil {
+		return
+	}
+	nl := make([]string, 0, len(msg.Response.LabelIds))
 	for _, l := range msg.Response.LabelIds {
 		if l != labelID {
 			nl = append(nl, l)
@@ -326,11 +357,23 @@ func (msg *Message) LocalLabels() []string {
 	return msg.Response.LabelIds
 }
 
+// MarkRead removes the UNREAD label, if the message has it. Reading
+// in read-only mode is not an error, so then it does nothing.
+func (msg *Message) MarkRead(ctx context.Context) error {
+	if msg.conn.ReadOnly() || !msg.IsUnread() {
+		return nil
+	}
+	return msg.RemoveLabelID(ctx, Unread)
+}
+
 // AddLabelID adds a label to a message.
 func (msg *Message) AddLabelID(ctx context.Context, labelID string) error {
+	if err := msg.conn.CheckWrite("adding label"); err != nil {
+		return err
+	}
 	st := time.Now()
 	var nm *gmail.Message
-	err := wrapLogRPC("gmail.Users.Messages.Modify", func() (err error) {
+	err := msg.conn.wrapLogRPC(ctx, "gmail.Users.Messages.Modify", func() (err error) {
 		nm, err = msg.conn.gmail.Users.Messages.Modify(email, msg.ID, &gmail.ModifyMessageRequest{
 			AddLabelIds: []string{labelID},
 		}).Context(ctx).Do()
@@ -345,7 +388,7 @@ func (msg *Message) AddLabelID(ctx context.Context, labelID string) error {
 	if msg.Response == nil {
 		msg.Response = nm
 	} else {
-		msg.Response.LabelIds = nm.LabelIds
+		msg.Response.LabelIds = msg.conn.journalLabels(msg.ID, nm.LabelIds)
 	}
 	return nil
 }
@@ -399,53 +442,56 @@ func (msg *Message) GetReplyTo(ctx context.Context) (string, error) {
 	return msg.GetHeader(ctx, "From")
 }
 
-func filteredEmails(from string, cc map[string]bool) []string {
-	var ret []string
-	fa, err := mail.ParseAddress(from)
-	if err != nil {
-		log.Errorf("Failed to parse 'from' address %q: %v", from, err)
-		fa = &mail.Address{ // Dummy entry.
-			Address: "",
-		}
+// formatAddress formats an address for the user to edit, without encoding the name.
+func formatAddress(a *mail.Address) string {
+	if a.Name == "" {
+		return a.Address
 	}
-	seen := map[string]bool{
-		fa.Address: true,
+	return fmt.Sprintf(`%s <%s>`, quoteNameIfNeeded(a.Name), a.Address)
+}
+
+// filteredEmails returns all addresses in the address lists, except
+// `from`, duplicates, and any address for which `skip` returns true.
+func filteredEmails(from string, lists []string, skip func(string) bool) []string {
+	seen := make(map[string]bool)
+	if fa, err := mail.ParseAddress(from); err != nil {
+		log.Errorf("Failed to parse 'from' address %q: %v", from, err)
+	} else {
+		seen[strings.ToLower(fa.Address)] = true
 	}
-	for s := range cc {
-		a, err := mail.ParseAddress(s)
-		if err != nil {
-			log.Errorf("Failed to parse 'cc' address %q: %v", s, err)
-			ret = append(ret, s)
-			continue
-		}
-		if !seen[a.Address] {
-			ret = append(ret, s)
-			seen[a.Address] = true
+	var ret []string
+	for _, l := range lists {
+		for _, a := range parseAddressList(l) {
+			k := strings.ToLower(a.Address)
+			if seen[k] || skip(a.Address) {
+				continue
+			}
+			seen[k] = true
+			ret = append(ret, formatAddress(a))
 		}
 	}
 	return ret
 }
 
 // GetReplyToAll returns both To and CC lines for reply-all.
+// The user's own addresses are not included in CC.
 func (msg *Message) GetReplyToAll(ctx context.Context) (string, string, error) {
 	from, err := msg.GetReplyTo(ctx)
 	if err != nil {
 		return "", "", err
 	}
-	cc := make(map[string]bool)
+	var lists []string
 	if f, err := msg.GetHeader(ctx, "From"); err != nil {
 		return "", "", err
 	} else if f != from {
-		cc[f] = true
-	}
-	if c, err := msg.GetHeader(ctx, "CC"); err == nil && len(c) != 0 {
-		cc[c] = true
+		lists = append(lists, f)
 	}
-	if c, err := msg.GetHeader(ctx, "To"); err == nil && len(c) != 0 {
-		// TODO: if this is not "me"
-		cc[c] = true
+	for _, h := range []string{"To", "CC"} {
+		if c, err := msg.GetHeader(ctx, h); err == nil && len(c) != 0 {
+			lists = append(lists, c)
+		}
 	}
-	return from, strings.Join(filteredEmails(from, cc), ", "), err
+	return from, strings.Join(filteredEmails(from, lists, msg.conn.IsOwnAddress), ", "), nil
 }
 
 // GetFrom returns email address (not name) of sender.
@@ -563,7 +609,7 @@ func (msg *Message) GetLabels(ctx context.Context, withUnread bool) ([]*Label, e
 		if l3.Response == nil {
 			log.Infof("Late loading of label ID %q", l)
 			var l4 *gmail.Label
-			err := wrapLogRPC("gmail.Users.Messages.Labels.Get", func() (err error) {
+			err := msg.conn.wrapLogRPC(ctx, "gmail.Users.Labels.Get", func() (err error) {
 				l4, err = msg.conn.gmail.Users.Labels.Get(email, l).Context(ctx).Do()
 				return
 			}, "email=%q labelID=%v", email, l)
@@ -579,9 +625,9 @@ func (msg *Message) GetLabels(ctx context.Context, withUnread bool) ([]*Label, e
 	return ret, nil
 }
 
-func colorMap(fgs, bgs string) string {
-	// Textcolor.
-	textColorMap := map[string]int{
+var (
+	// textColorMap maps Gmail label colors to terminal colors.
+	textColorMap = map[string]int{
 		// Shades of grey.
 		"#000000": 232,
 		"#434343": 240,
@@ -663,6 +709,21 @@ func colorMap(fgs, bgs string) string {
 		"#0b4f30": 22,  // NON-standard green
 	}
 
+	// Colors in textColorMap that Gmail has been seen to use, but won't accept when setting label colors.
+	nonStandardColors = map[string]bool{
+		"#4986e7": true,
+		"#ffad46": true,
+		"#16a765": true,
+		"#711a36": true,
+		"#fbd3e0": true,
+		"#fbe983": true,
+		"#594c05": true,
+		"#b3efd3": true,
+		"#0b4f30": true,
+	}
+)
+
+func colorMap(fgs, bgs string) string {
 	fg, found := textColorMap[fgs]
 	if !found {
 		log.Infof("Could not find foreground %q", fgs)
@@ -895,7 +956,7 @@ func (msg *Message) GetUnpatchedBody(ctx context.Context) (string, error) {
 func (msg *Message) ReloadLabels(ctx context.Context) error {
 	log.Debugf("Reloading labels of %q %s", msg.ID, string(debug.Stack()))
 	var msg2 *gmail.Message
-	err := wrapLogRPC("gmail.Users.Messages.Get", func() (err error) {
+	err := msg.conn.wrapLogRPC(ctx, "gmail.Users.Messages.Get", func() (err error) {
 		msg2, err = msg.conn.gmail.Users.Messages.Get(email, msg.ID).
 			Format(string(LevelMinimal)).
 			Context(ctx).
@@ -911,7 +972,7 @@ func (msg *Message) ReloadLabels(ctx context.Context) error {
 		msg.Response = msg2
 		msg.level = LevelMinimal
 	} else {
-		msg.Response.LabelIds = msg2.LabelIds
+		msg.Response.LabelIds = msg.conn.journalLabels(msg.ID, msg2.LabelIds)
 	}
 	return nil
 }
@@ -956,7 +1017,7 @@ func (msg *Message) trySigned(ctx context.Context) error {
 
 	// Fetch attachment.
 	var body *gmail.MessagePartBody
-	err := wrapLogRPC("gmail.Users.Messages.Attachments.Get", func() (err error) {
+	err := msg.conn.wrapLogRPC(ctx, "gmail.Users.Messages.Attachments.Get", func() (err error) {
 		body, err = msg.conn.gmail.Users.Messages.Attachments.Get(email, msg.ID, partSig.Body.AttachmentId).Context(ctx).Do()
 		return err
 	}, "email=%q msgID=%v attachmentID=%v", email, msg.ID, partSig.Body.AttachmentId)
@@ -1024,7 +1085,7 @@ func (msg *Message) tryGPGEncrypted(ctx context.Context) error {
 
 	// Fetch data attachment.
 	var body *gmail.MessagePartBody
-	err := wrapLogRPC("gmail.Users.Messages.Attachments.Get", func() (err error) {
+	err := msg.conn.wrapLogRPC(ctx, "gmail.Users.Messages.Attachments.Get", func() (err error) {
 		body, err = msg.conn.gmail.Users.Messages.Attachments.Get(email, msg.ID, partData.Body.AttachmentId).Context(ctx).Do()
 		return
 	}, "email=%q msgID=%v attachmentID=%v", email, msg.ID, partData.Body.AttachmentId)
@@ -1126,18 +1187,29 @@ func (msg *Message) Reload(ctx context.Context, level DataLevel) error {
 }
 
 // Preload loads message data, unless it's already loaded.
+// The disk cache is used if it has the data.
 func (msg *Message) Preload(ctx context.Context, level DataLevel) error {
 	if msg.HasData(level) {
 		return nil
 	}
+	if msg.conn.cache != nil {
+		if m := msg.conn.cache.getMessage(msg.ID, level); m != nil {
+			log.Debugf("Loaded message %q at level %v from disk cache", msg.ID, level)
+			return msg.setResponse(ctx, m, level)
+		}
+	}
 	return msg.load(ctx, level)
 }
 
 func (msg *Message) load(ctx context.Context, level DataLevel) error {
 	st := time.Now()
 	log.Debugf("Loading message %q at level %v, stack %s", msg.ID, level, string(debug.Stack()))
+	var gen uint64
+	if msg.conn.cache != nil {
+		gen = msg.conn.cache.generation()
+	}
 	var msg2 *gmail.Message
-	err := wrapLogRPC("gmail.Users.Messages.Get", func() (err error) {
+	err := msg.conn.wrapLogRPC(ctx, "gmail.Users.Messages.Get", func() (err error) {
 		msg2, err = msg.conn.gmail.Users.Messages.Get(email, msg.ID).
 			Format(string(level)).
 			Context(ctx).
@@ -1148,14 +1220,26 @@ func (msg *Message) load(ctx context.Context, level DataLevel) error {
 		return err
 	}
 	log.Debugf("Downloading message %q level %q took %v", msg.ID, level, time.Since(st))
+	if msg.conn.cache != nil {
+		msg.conn.cache.putMessage(msg.ID, level, msg2, gen)
+	}
+	return msg.setResponse(ctx, msg2, level)
+}
 
+// setResponse replaces the message data with what the API returned at the given level.
+// For LevelFull this also renders the body and checks signatures.
+func (msg *Message) setResponse(ctx context.Context, resp *gmail.Message, level DataLevel) error {
 	msg.m.Lock()
 	defer msg.m.Unlock()
-	msg.Response = msg2
+	var err error
+	msg.Response = resp
+	msg.Response.LabelIds = msg.conn.journalLabels(msg.ID, resp.LabelIds)
 	msg.level = level
 	msg.headers = make(map[string]string)
-	for _, h := range msg.Response.Payload.Headers {
-		msg.headers[strings.ToLower(h.Name)] = h.Value
+	if msg.Response.Payload != nil {
+		for _, h := range msg.Response.Payload.Headers {
+			msg.headers[strings.ToLower(h.Name)] = h.Value
+		}
 	}
 	if level == LevelFull {
 		msg.bodyHTML, err = makeBody(ctx, msg.Response.Payload, true)
@@ -1236,7 +1320,7 @@ func (d *Draft) load(ctx context.Context, level DataLevel) error {
 	}
 	log.Debugf("Loading draft %q at level %v %s", d.ID, level, string(debug.Stack()))
 	var r *gmail.Draft
-	if err := wrapLogRPC("gmail.User.Drafts.Get", func() (err error) {
+	if err := d.conn.wrapLogRPC(ctx, "gmail.Users.Drafts.Get", func() (err error) {
 		r, err = d.conn.gmail.Users.Drafts.Get(email, d.ID).Context(ctx).Format(string(level)).Do()
 		return
 	}, "email=%q msgID=%v level=%v", email, d.ID, level); err != nil {
@@ -1268,14 +1352,23 @@ func (d *Draft) GetBody(ctx context.Context) (string, error) {
 	return d.body, nil
 }
 
-// UpdateParts updates a draft… right?
+// UpdateParts replaces the contents of the draft.
 func (d *Draft) UpdateParts(ctx context.Context, head mail.Header, parts []*Part) error {
-	//d.update(ctx,
-	return fmt.Errorf("NOT IMPLEMENTED")
+	if err := d.conn.CheckWrite("updating draft"); err != nil {
+		return err
+	}
+	msg, err := d.conn.assembleParts("mixed", head, parts)
+	if err != nil {
+		return err
+	}
+	return d.update(ctx, msg)
 }
 
 func (d *Draft) update(ctx context.Context, content string) error {
-	if err := wrapLogRPC("gmail.Users.Drafts.Update", func() error {
+	if err := d.conn.CheckWrite("updating draft"); err != nil {
+		return err
+	}
+	if err := d.conn.wrapLogRPC(ctx, "gmail.Users.Drafts.Update", func() error {
 		_, err := d.conn.gmail.Users.Drafts.Update(email, d.ID, &gmail.Draft{
 			Message: &gmail.Message{
 				Raw: MIMEEncode(content),
@@ -1295,10 +1388,13 @@ func (d *Draft) update(ctx context.Context, content string) error {
 
 // Send sends the draft. Sending a draft makes it no longer a draft.
 func (d *Draft) Send(ctx context.Context) error {
+	if err := d.conn.CheckWrite("sending draft"); err != nil {
+		return err
+	}
 	if err := d.load(ctx, LevelFull); err != nil {
 		return errors.Wrap(err, "downloading draft for send")
 	}
-	return wrapLogRPC("gmail.USers.Drafts.Send", func() error {
+	return d.conn.wrapLogRPC(ctx, "gmail.Users.Drafts.Send", func() error {
 		_, err := d.conn.gmail.Users.Drafts.Send(email, d.Response).Context(ctx).Do()
 		return err
 	}, "email=%q draftID=%v", email, d.ID)
@@ -1306,7 +1402,10 @@ func (d *Draft) Send(ctx context.Context) error {
 
 // Delete deletes the draft.
 func (d *Draft) Delete(ctx context.Context) error {
-	return wrapLogRPC("gmail.Users.Drafts.Delete", func() error {
+	if err := d.conn.CheckWrite("deleting draft"); err != nil {
+		return err
+	}
+	return d.conn.wrapLogRPC(ctx, "gmail.Users.Drafts.Delete", func() error {
 		return d.conn.gmail.Users.Drafts.Delete(email, d.ID).Context(ctx).Do()
 	}, "email=%q draftID=%v", email, d.ID)
 }
@@ -0,0 +1,46 @@
+package cmdg
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// MuteThread mutes a whole thread and archives it. Gmail keeps later
+// replies to a muted thread out of the inbox.
+func (c *CmdG) MuteThread(ctx context.Context, id ThreadID) error {
+	if err := c.CheckWrite("muting thread"); err != nil {
+		return err
+	}
+	err := c.wrapLogRPC(ctx, "gmail.Users.Threads.Modify", func() error {
+		_, err := c.gmail.Users.Threads.Modify(email, string(id), &gmail.ModifyThreadRequest{
+			AddLabelIds:    []string{Muted},
+			RemoveLabelIds: []string{Inbox},
+		}).Context(ctx).Do()
+		return err
+	}, "email=%q thread=%v", email, id)
+	if err != nil {
+		return errors.Wrapf(err, "muting thread %q", id)
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.muted == nil {
+		c.muted = make(map[ThreadID]bool)
+	}
+	c.muted[id] = true
+	return nil
+}
+
+// IsMuted returns true if the message from history is in a muted
+// thread, either by label or because it was muted in this session.
+func (c *CmdG) IsMuted(m *gmail.Message) bool {
+	for _, l := range m.LabelIds {
+		if l == Muted {
+			return true
+		}
+	}
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.muted[ThreadID(m.ThreadId)]
+}
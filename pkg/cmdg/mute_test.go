@@ -0,0 +1,56 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestMuteThread(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/me/threads/t1/modify"; got != want {
+			t.Errorf("Got path %q, want %q", got, want)
+		}
+		var req gmail.ModifyThreadRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if fmt.Sprint(req.AddLabelIds, req.RemoveLabelIds) != "[MUTE] [INBOX]" {
+			t.Errorf("Bad modify request: %+v", req)
+		}
+		fmt.Fprint(w, `{"id": "t1"}`)
+	}))
+	defer ts.Close()
+	c, err := NewFake(ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.gmail.BasePath = ts.URL + "/"
+
+	for _, m := range []*gmail.Message{
+		{Id: "a", ThreadId: "t1"},
+		{Id: "b", ThreadId: "t2"},
+	} {
+		if c.IsMuted(m) {
+			t.Errorf("%q muted before muting", m.Id)
+		}
+	}
+	if !c.IsMuted(&gmail.Message{Id: "c", ThreadId: "t3", LabelIds: []string{Inbox, Muted}}) {
+		t.Errorf("Message with MUTE label not muted")
+	}
+
+	if err := c.MuteThread(context.Background(), "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsMuted(&gmail.Message{Id: "d", ThreadId: "t1", LabelIds: []string{Inbox}}) {
+		t.Errorf("New message in muted thread not muted")
+	}
+	if c.IsMuted(&gmail.Message{Id: "b", ThreadId: "t2"}) {
+		t.Errorf("Other thread muted")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"sync"
 
+	log "github.com/sirupsen/logrus"
 	gmail "google.golang.org/api/gmail/v1"
 )
 
@@ -24,25 +25,47 @@ func (p *Page) Next(ctx context.Context) (*Page, error) {
 	return p.conn.ListMessages(ctx, p.Label, p.Query, p.Response.NextPageToken)
 }
 
-// PreloadSubjects async loads message basic info.
+// PreloadSubjects loads message basic info for the whole page, in batches.
+// Messages that fail to load are logged and left empty, to be retried when displayed.
 func (p *Page) PreloadSubjects(ctx context.Context) error {
+	if err := p.conn.BatchPreload(ctx, p.Messages, LevelMetadata); err != nil {
+		log.Errorf("Failed to batch load page: %v", err)
+	}
+	return ctx.Err()
+}
+
+// ThreadPage is a page of threads, as returned by ListThreads.
+type ThreadPage struct {
+	Label string
+	Query string
+
+	conn     *CmdG
+	Threads  []*Thread
+	Response *gmail.ListThreadsResponse
+}
+
+// Next returns the next page.
+func (p *ThreadPage) Next(ctx context.Context) (*ThreadPage, error) {
+	return p.conn.ListThreads(ctx, p.Label, p.Query, p.Response.NextPageToken)
+}
+
+// PreloadSubjects loads message basic info for all threads in the page, and waits for it to finish.
+// Threads that fail to load are logged and left empty.
+func (p *ThreadPage) PreloadSubjects(ctx context.Context) error {
 	conc := 100
 	sem := make(chan struct{}, conc)
-	num := len(p.Response.Messages)
-	errs := make([]error, num, num)
-	for n := 0; n < len(p.Response.Messages); n++ {
-		n := n
+	for _, t := range p.Threads {
+		t := t
 		sem <- struct{}{}
 		go func() {
 			defer func() { <-sem }()
-
-			if err := p.Messages[n].Preload(ctx, LevelMetadata); err != nil {
-				errs[n] = err
+			if err := t.Preload(ctx, LevelMetadata); err != nil {
+				log.Errorf("Failed to load thread %q: %v", t.ID, err)
 			}
 		}()
 	}
 	for t := 0; t < conc; t++ {
 		sem <- struct{}{}
 	}
-	return nil
+	return ctx.Err()
 }
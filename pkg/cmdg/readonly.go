@@ -0,0 +1,44 @@
+package cmdg
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Scope for read-only access. No contacts or appdata.
+	readOnlyScope = "https://www.googleapis.com/auth/gmail.readonly"
+)
+
+var (
+	readOnlyFlag = flag.Bool("readonly", false, "Read-only mode. When configuring, only asks for read access to email.")
+
+	// ErrReadOnly is returned for any change to the mailbox in read-only mode.
+	ErrReadOnly = fmt.Errorf("not allowed in read-only mode")
+)
+
+// scopeFor returns the OAuth scope to ask for.
+func scopeFor(readOnly bool) string {
+	if readOnly {
+		return readOnlyScope
+	}
+	return scope
+}
+
+// ReadOnly returns true if nothing may be changed.
+func (c *CmdG) ReadOnly() bool {
+	return c.readOnly
+}
+
+// CheckWrite returns ErrReadOnly if changes are not allowed. Every
+// function that changes mail, labels, drafts, settings, or contacts
+// calls this first, so the UI only needs to show the error.
+// `what` describes the change, for the error message.
+func (c *CmdG) CheckWrite(what string) error {
+	if c.readOnly {
+		return errors.Wrap(ErrReadOnly, what)
+	}
+	return nil
+}
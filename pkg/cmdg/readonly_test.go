@@ -0,0 +1,52 @@
+package cmdg
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestReadOnly(t *testing.T) {
+	c, err := NewFake(&http.Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CheckWrite("test"); err != nil {
+		t.Errorf("Writable connection refused: %v", err)
+	}
+
+	c.readOnly = true
+	ctx := context.Background()
+	for name, f := range map[string]func() error{
+		"archive": func() error { return c.BatchArchive(ctx, []string{"a"}) },
+		"delete":  func() error { return c.BatchDelete(ctx, []string{"a"}) },
+		"draft":   func() error { return c.MakeDraft(ctx, "mixed", nil, nil) },
+		"label": func() error {
+			_, err := c.CreateLabel(ctx, "new")
+			return err
+		},
+		"import": func() error {
+			_, err := c.Import(ctx, "/dev/null", ImportOptions{})
+			return err
+		},
+		"mute": func() error { return c.MuteThread(ctx, "t") },
+		"send": func() error { return c.SendParts(ctx, NewThread, "mixed", nil, nil) },
+	} {
+		if err := f(); errors.Cause(err) != ErrReadOnly {
+			t.Errorf("%s: got %v, want ErrReadOnly", name, err)
+		}
+	}
+	if err := c.BatchMarkRead(ctx, []string{"a"}); err != nil {
+		t.Errorf("Marking read should be silently skipped, got %v", err)
+	}
+
+	msg := NewMessage(c, "a")
+	msg.Response = &gmail.Message{Id: "a"}
+	msg.AddLabelIDLocal(Starred)
+	if msg.HasLabel(Starred) {
+		t.Errorf("Local label added in read-only mode")
+	}
+}
@@ -0,0 +1,362 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+const (
+	recipientsFileName = "recipients.json"
+
+	// How many sent messages to look at the first time.
+	maxRecipientHarvest = 2000
+
+	// Every this long the weight of having sent to an address halves.
+	recipientHalfLife = 30 * 24 * time.Hour
+)
+
+// Recipient is an address we've sent email to.
+type Recipient struct {
+	// Address in "Name Name <email@example.com>" format, as last used.
+	Address string `json:"address"`
+
+	// Number of messages sent to the address.
+	Count int `json:"count"`
+
+	// Time of the latest message, in milliseconds since epoch.
+	Last int64 `json:"last"`
+
+	// Decayed count as of Last. Use Score() to get current value.
+	Weight float64 `json:"weight"`
+}
+
+// decay returns how much a message sent `ms` milliseconds ago is worth.
+func decay(ms int64) float64 {
+	return math.Pow(0.5, float64(ms)/float64(recipientHalfLife/time.Millisecond))
+}
+
+// Score returns the frequency and recency rank of the address at time `now`.
+// Each message sent counts as 1, halving every recipientHalfLife.
+func (r *Recipient) Score(now time.Time) float64 {
+	return r.Weight * decay(timeMS(now)-r.Last)
+}
+
+// add records one more message sent at `ms`. Messages don't need to be
+// added in order.
+func (r *Recipient) add(ms int64) {
+	r.Count++
+	if ms >= r.Last {
+		r.Weight = r.Weight*decay(ms-r.Last) + 1
+		r.Last = ms
+	} else {
+		r.Weight += decay(r.Last - ms)
+	}
+}
+
+func timeMS(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// recipientIndex is all addresses we've sent to, keyed by lower case email address.
+type recipientIndex struct {
+	// Internal date of newest sent message seen, in milliseconds since epoch.
+	Newest     int64                 `json:"newest"`
+	Recipients map[string]*Recipient `json:"recipients"`
+
+	// Messages sent by us and already added, that are newer than
+	// Newest. Message ID to internal date.
+	Recorded map[string]int64 `json:"recorded"`
+}
+
+func newRecipientIndex() *recipientIndex {
+	return &recipientIndex{
+		Recipients: make(map[string]*Recipient),
+		Recorded:   make(map[string]int64),
+	}
+}
+
+// addAddresses records a message sent at `ms` to all addresses in the address lists.
+func (ri *recipientIndex) addAddresses(ms int64, lists ...string) {
+	seen := make(map[string]bool)
+	for _, l := range lists {
+		for _, a := range parseAddressList(l) {
+			k := strings.ToLower(a.Address)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			r, found := ri.Recipients[k]
+			if !found {
+				r = &Recipient{}
+				ri.Recipients[k] = r
+			}
+			// Prefer the latest name used, but don't lose the name
+			// because of a message sent to just the address.
+			if r.Address == "" || (a.Name != "" && (ms >= r.Last || !strings.Contains(r.Address, "<"))) {
+				r.Address = formatAddress(a)
+			}
+			r.add(ms)
+		}
+	}
+}
+
+// readRecipientIndex reads the index from disk. Returns an empty index if
+// there is none, or it's not usable.
+func readRecipientIndex(fn string) *recipientIndex {
+	ri := newRecipientIndex()
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return ri
+	}
+	if err != nil {
+		log.Errorf("Failed to read recipients file %q: %v", fn, err)
+		return ri
+	}
+	if err := json.Unmarshal(b, ri); err != nil || ri.Recipients == nil {
+		log.Errorf("Corrupt recipients file %q, ignoring: %v", fn, err)
+		return newRecipientIndex()
+	}
+	if ri.Recorded == nil {
+		ri.Recorded = make(map[string]int64)
+	}
+	return ri
+}
+
+func (ri *recipientIndex) write(fn string) error {
+	b, err := json.Marshal(ri)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fn, b)
+}
+
+// copy returns a deep copy, so that it can be changed without holding locks.
+func (ri *recipientIndex) copy() *recipientIndex {
+	ret := &recipientIndex{
+		Newest:     ri.Newest,
+		Recipients: make(map[string]*Recipient, len(ri.Recipients)),
+		Recorded:   make(map[string]int64, len(ri.Recorded)),
+	}
+	for k, v := range ri.Recipients {
+		t := *v
+		ret.Recipients[k] = &t
+	}
+	for k, v := range ri.Recorded {
+		ret.Recorded[k] = v
+	}
+	return ret
+}
+
+// getRecipientIndex returns a copy of the current index, reading it from disk if needed.
+// Hold recipientsMu until the copy is set, if changing it.
+func (c *CmdG) getRecipientIndex() *recipientIndex {
+	c.m.RLock()
+	ri := c.recipients
+	c.m.RUnlock()
+	if ri != nil {
+		return ri.copy()
+	}
+	if c.recipientsFile != "" {
+		return readRecipientIndex(c.recipientsFile)
+	}
+	return newRecipientIndex()
+}
+
+// setRecipientIndex makes the index current, and saves it to disk.
+func (c *CmdG) setRecipientIndex(ri *recipientIndex) {
+	c.m.Lock()
+	c.recipients = ri
+	c.m.Unlock()
+	if c.recipientsFile != "" {
+		if err := ri.write(c.recipientsFile); err != nil {
+			log.Errorf("Failed to save recipients to %q: %v", c.recipientsFile, err)
+		}
+	}
+}
+
+// sentMessage is the part of a sent message that's needed for the index.
+type sentMessage struct {
+	id    string
+	ms    int64
+	lists []string
+}
+
+// recipientHeaders are the headers harvested from sent messages.
+var recipientHeaders = []string{"To", "Cc", "Bcc"}
+
+// getSent gets the date and recipients of sent messages, in batches.
+// Only those headers are fetched, and nothing is cached, since
+// the messages are usually not otherwise looked at. Messages that fail
+// to load are skipped.
+func (c *CmdG) getSent(ctx context.Context, ids []string) []*sentMessage {
+	var ret []*sentMessage
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > batchMax {
+			chunk = chunk[:batchMax]
+		}
+		ids = ids[len(chunk):]
+		resps, errs, err := c.batchGet(ctx, chunk, LevelMetadata, recipientHeaders...)
+		if err != nil {
+			log.Errorf("Failed to load %d sent messages: %v", len(chunk), err)
+			continue
+		}
+		for n, m := range resps {
+			if errs[n] != nil {
+				log.Errorf("Failed to load sent message %q: %v", chunk[n], errs[n])
+				continue
+			}
+			s := &sentMessage{id: m.Id, ms: m.InternalDate}
+			if m.Payload != nil {
+				for _, h := range m.Payload.Headers {
+					for _, want := range recipientHeaders {
+						if strings.EqualFold(h.Name, want) {
+							s.lists = append(s.lists, h.Value)
+						}
+					}
+				}
+			}
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// LoadRecipients updates the index of addresses we send to, from messages
+// in SENT that are newer than what's already in the index.
+func (c *CmdG) LoadRecipients(ctx context.Context) error {
+	c.recipientsMu.Lock()
+	newest := c.getRecipientIndex().Newest
+	c.recipientsMu.Unlock()
+
+	// Find new sent messages.
+	query := ""
+	if newest > 0 {
+		query = fmt.Sprintf("after:%d", newest/1000)
+	}
+	var ids []string
+	token := ""
+	for len(ids) < maxRecipientHarvest {
+		var res *gmail.ListMessagesResponse
+		err := c.wrapLogRPC(ctx, "gmail.Users.Messages.List", func() (err error) {
+			q := c.gmail.Users.Messages.List(email).
+				LabelIds(Sent).
+				PageToken(token).
+				MaxResults(500).
+				Context(ctx).
+				Fields("messages,nextPageToken")
+			if query != "" {
+				q = q.Q(query)
+			}
+			res, err = q.Do()
+			return
+		}, "email=%q token=%v labelID=%q query=%q", email, token, Sent, query)
+		if err != nil {
+			return errors.Wrap(err, "listing sent messages")
+		}
+		for _, m := range res.Messages {
+			ids = append(ids, m.Id)
+		}
+		token = res.NextPageToken
+		if token == "" {
+			break
+		}
+	}
+	if len(ids) > maxRecipientHarvest {
+		ids = ids[:maxRecipientHarvest]
+	}
+	sent := c.getSent(ctx, ids)
+
+	// The index may have changed while downloading, so start over
+	// from the current one.
+	c.recipientsMu.Lock()
+	defer c.recipientsMu.Unlock()
+	ri := c.getRecipientIndex()
+	newest = ri.Newest
+	added := 0
+	for _, m := range sent {
+		// `after:` has only second granularity, so may overlap.
+		if m.ms <= ri.Newest {
+			continue
+		}
+		if m.ms > newest {
+			newest = m.ms
+		}
+		if _, found := ri.Recorded[m.id]; found {
+			continue
+		}
+		ri.addAddresses(m.ms, m.lists...)
+		added++
+	}
+	ri.Newest = newest
+	for id, ms := range ri.Recorded {
+		if ms <= ri.Newest {
+			delete(ri.Recorded, id)
+		}
+	}
+	log.Infof("Added %d sent messages to recipient index, now %d addresses", added, len(ri.Recipients))
+	c.setRecipientIndex(ri)
+	return nil
+}
+
+// recordSent adds the recipients of a message we just sent to the index,
+// remembering the ID so that it's not counted again when seen in SENT.
+func (c *CmdG) recordSent(msgID, msg string) {
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil {
+		log.Errorf("Failed to parse sent message for recipients: %v", err)
+		return
+	}
+	ms := timeMS(time.Now())
+	c.recipientsMu.Lock()
+	defer c.recipientsMu.Unlock()
+	ri := c.getRecipientIndex()
+	ri.addAddresses(ms, m.Header.Get("To"), m.Header.Get("CC"), m.Header.Get("Bcc"))
+	ri.Recorded[msgID] = ms
+	c.setRecipientIndex(ri)
+}
+
+// Recipients returns all addresses we've sent to, best ranked first.
+func (c *CmdG) Recipients() []*Recipient {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if c.recipients == nil {
+		return nil
+	}
+	now := time.Now()
+	var ret []*Recipient
+	for _, r := range c.recipients.Recipients {
+		t := *r
+		ret = append(ret, &t)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Score(now) > ret[j].Score(now)
+	})
+	return ret
+}
+
+// RecipientScore returns the rank of the email address. Zero if never sent to.
+func (c *CmdG) RecipientScore(addr string) float64 {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if c.recipients == nil {
+		return 0
+	}
+	r, found := c.recipients.Recipients[strings.ToLower(addr)]
+	if !found {
+		return 0
+	}
+	return r.Score(time.Now())
+}
@@ -0,0 +1,166 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestRecipientOrder(t *testing.T) {
+	day := int64(24 * time.Hour / time.Millisecond)
+	times := []int64{10 * day, 40 * day, 25 * day}
+
+	var fwd, rev Recipient
+	for _, ms := range times {
+		fwd.add(ms)
+	}
+	for i := len(times) - 1; i >= 0; i-- {
+		rev.add(times[i])
+	}
+	now := time.Unix(0, 0).Add(50 * 24 * time.Hour)
+	if fwd.Count != 3 || rev.Count != 3 {
+		t.Errorf("Wrong count: %d and %d", fwd.Count, rev.Count)
+	}
+	if fwd.Last != 40*day || rev.Last != 40*day {
+		t.Errorf("Wrong last: %d and %d", fwd.Last, rev.Last)
+	}
+	if a, b := fwd.Score(now), rev.Score(now); math.Abs(a-b) > 1e-9 {
+		t.Errorf("Score depends on order: %v vs %v", a, b)
+	}
+}
+
+func TestRecipientScore(t *testing.T) {
+	var r Recipient
+	r.add(0)
+	if got := r.Score(time.Unix(0, 0)); got != 1 {
+		t.Errorf("Fresh score: got %v, want 1", got)
+	}
+	if got := r.Score(time.Unix(0, 0).Add(recipientHalfLife)); math.Abs(got-0.5) > 1e-9 {
+		t.Errorf("Score after half life: got %v, want 0.5", got)
+	}
+
+	// One recent beats two old.
+	var old Recipient
+	old.add(0)
+	old.add(0)
+	var recent Recipient
+	recent.add(int64(3 * recipientHalfLife / time.Millisecond))
+	now := time.Unix(0, 0).Add(3 * recipientHalfLife)
+	if old.Score(now) >= recent.Score(now) {
+		t.Errorf("Old %v should score lower than recent %v", old.Score(now), recent.Score(now))
+	}
+}
+
+func TestRecipientIndexAdd(t *testing.T) {
+	ri := newRecipientIndex()
+	ri.addAddresses(1000, "bob@example.com, Alice <ALICE@example.com>", "alice@example.com")
+	ri.addAddresses(2000, "Bob Smith <Bob@example.com>")
+	ri.addAddresses(500, "bob@example.com")
+	if got, want := len(ri.Recipients), 2; got != want {
+		t.Fatalf("Got %d recipients, want %d", got, want)
+	}
+	a := ri.Recipients["alice@example.com"]
+	if a.Count != 1 {
+		t.Errorf("Alice counted %d times, want once", a.Count)
+	}
+	if got, want := a.Address, "Alice <ALICE@example.com>"; got != want {
+		t.Errorf("Alice address: got %q, want %q", got, want)
+	}
+	b := ri.Recipients["bob@example.com"]
+	if b.Count != 3 || b.Last != 2000 {
+		t.Errorf("Bob: got count %d last %d, want 3 and 2000", b.Count, b.Last)
+	}
+	if got, want := b.Address, `"Bob Smith" <Bob@example.com>`; got != want {
+		t.Errorf("Bob address: got %q, want %q", got, want)
+	}
+}
+
+func TestLoadRecipients(t *testing.T) {
+	var c *CmdG
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gmail/v1/users/me/messages":
+			if err := json.NewEncoder(w).Encode(&gmail.ListMessagesResponse{
+				Messages: []*gmail.Message{{Id: "a"}, {Id: "b"}},
+			}); err != nil {
+				t.Error(err)
+			}
+		case "/batch/gmail/v1":
+			// Sent while harvesting.
+			c.recordSent("c", "To: carol@example.com\r\n\r\nHello\r\n")
+
+			_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil {
+				t.Error(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mr := multipart.NewReader(r.Body, params["boundary"])
+			mw := multipart.NewWriter(w)
+			w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+			for n := 0; ; n++ {
+				p, err := mr.NextPart()
+				if err != nil {
+					break
+				}
+				var method, target string
+				if _, err := fmt.Fscan(p, &method, &target); err != nil {
+					t.Error(err)
+				}
+				if !strings.Contains(target, "metadataHeaders=To") {
+					t.Errorf("Not asking for only some headers: %q", target)
+				}
+				id := strings.TrimPrefix(strings.SplitN(target, "?", 2)[0], "/gmail/v1/users/me/messages/")
+				rp, err := mw.CreatePart(map[string][]string{
+					"Content-Type": {"application/http"},
+					"Content-ID":   {fmt.Sprintf("<response-item-%d>", n)},
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				fmt.Fprintf(rp, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\r\n"+
+					`{"id":%q,"internalDate":"1000","payload":{"headers":[{"name":"To","value":"%s@example.com"}]}}`, id, id)
+			}
+			if err := mw.Close(); err != nil {
+				t.Error(err)
+			}
+		default:
+			t.Errorf("Unexpected request for %q", r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewFake(&http.Client{Transport: &redirectTransport{to: u}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadRecipients(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range c.Recipients() {
+		got = append(got, r.Address)
+	}
+	if len(got) != 3 {
+		t.Errorf("Got recipients %q, want a, b, and carol", got)
+	}
+	if len(c.messageCache) != 0 {
+		t.Errorf("Sent messages were cached")
+	}
+}
@@ -0,0 +1,193 @@
+package cmdg
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 32 * time.Second
+
+	// Gmail allows 250 quota units per user per second, as a moving average.
+	quotaUnitsPerSecond = 250
+)
+
+var (
+	rpcRetries = flag.Int("rpc_retries", 5, "Number of times to retry RPCs that fail with rate limiting or server errors.")
+
+	// Quota units per RPC, from https://developers.google.com/gmail/api/reference/quota
+	// Keyed by the name given to wrapLogRPC. Non-Gmail RPCs are not limited.
+	quotaUnits = map[string]int{
+		"gmail.Users.Drafts.Create":            10,
+		"gmail.Users.Drafts.Delete":            10,
+		"gmail.Users.Drafts.Get":               5,
+		"gmail.Users.Drafts.List":              5,
+		"gmail.Users.Drafts.Send":              100,
+		"gmail.Users.Drafts.Update":            15,
+		"gmail.Users.GetProfile":               1,
+		"gmail.Users.History.List":             2,
+		"gmail.Users.Labels.Create":            5,
+		"gmail.Users.Labels.Delete":            5,
+		"gmail.Users.Labels.Get":               1,
+		"gmail.Users.Labels.List":              1,
+		"gmail.Users.Labels.Patch":             5,
+		"gmail.Users.Labels.Update":            5,
+		"gmail.Users.Messages.Attachments.Get": 5,
+		"gmail.Users.Messages.BatchDelete":     50,
+		"gmail.Users.Messages.BatchModify":     50,
+		"gmail.Users.Messages.Get":             5,
+		"gmail.Users.Messages.Import":          25,
+		"gmail.Users.Messages.List":            5,
+		"gmail.Users.Messages.Modify":          5,
+		"gmail.Users.Messages.Send":            100,
+		"gmail.Users.Settings.Filters.Create":  5,
+		"gmail.Users.Settings.Filters.Delete":  5,
+		"gmail.Users.Settings.Filters.List":    1,
+		"gmail.Users.Settings.GetVacation":     1,
+		"gmail.Users.Settings.SendAs.List":     1,
+		"gmail.Users.Settings.UpdateVacation":  5,
+		"gmail.Users.Threads.Get":              10,
+		"gmail.Users.Threads.List":             10,
+		"gmail.Users.Threads.Modify":           10,
+	}
+
+	// RPCs that may have taken effect even if they returned a server error,
+	// and so are only retried when rate limited.
+	nonIdempotent = map[string]bool{
+		"gmail.Users.Drafts.Send":     true,
+		"gmail.Users.Messages.Import": true,
+		"gmail.Users.Messages.Send":   true,
+	}
+)
+
+// quotaLimiter is a token bucket of quota units.
+// A request larger than what's available is allowed, but whoever asks next has to wait longer.
+type quotaLimiter struct {
+	m      sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newQuotaLimiter(rate, burst float64) *quotaLimiter {
+	return &quotaLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes the units from the bucket, and returns how long to wait before using them.
+func (q *quotaLimiter) reserve(now time.Time, units int) time.Duration {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.tokens += now.Sub(q.last).Seconds() * q.rate
+	if q.tokens > q.burst {
+		q.tokens = q.burst
+	}
+	q.last = now
+	q.tokens -= float64(units)
+	if q.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-q.tokens / q.rate * float64(time.Second))
+}
+
+// wait blocks until the units may be spent, or the context is done.
+func (q *quotaLimiter) wait(ctx context.Context, fn string, units int) error {
+	if units == 0 {
+		return nil
+	}
+	if d := q.reserve(time.Now(), units); d > 0 {
+		log.Debugf("Waiting %v for %d quota units for %s", d, units, fn)
+		return sleep(ctx, d)
+	}
+	return nil
+}
+
+// sleep waits for `d`, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// rpcQuotaUnits returns the quota cost of `n` calls to the RPC.
+func rpcQuotaUnits(fn string, n int) int {
+	return quotaUnits[strings.Replace(fn, "gmail.Batch.", "gmail.", 1)] * n
+}
+
+// retryable returns if the RPC error is worth retrying, and how long the server asked us to wait, if at all.
+func retryable(fn string, err error) (bool, time.Duration) {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	if !ok {
+		return false, 0
+	}
+	var after time.Duration
+	if e.Header != nil {
+		after = parseRetryAfter(e.Header.Get("Retry-After"), time.Now())
+	}
+	switch {
+	case e.Code == http.StatusTooManyRequests:
+		return true, after
+	case e.Code == http.StatusForbidden:
+		// Gmail sometimes uses 403 for rate limiting.
+		for _, ei := range e.Errors {
+			if ei.Reason == "rateLimitExceeded" || ei.Reason == "userRateLimitExceeded" {
+				return true, after
+			}
+		}
+		return false, 0
+	case e.Code >= 500:
+		return !nonIdempotent[strings.Replace(fn, "gmail.Batch.", "gmail.", 1)], after
+	}
+	return false, 0
+}
+
+// parseRetryAfter parses a Retry-After header, which is either seconds or a date.
+func parseRetryAfter(s string, now time.Time) time.Duration {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 {
+			return 0
+		}
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// backoff returns how long to wait before retry number `attempt` (starting at 0).
+// Exponential, with jitter so that many failed calls don't all retry at the same time.
+func backoff(attempt int) time.Duration {
+	d := retryBaseDelay << uint(attempt)
+	if d > retryMaxDelay || d <= 0 {
+		d = retryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
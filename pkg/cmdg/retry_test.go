@@ -0,0 +1,208 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryable(t *testing.T) {
+	withHeader := func(code int, retryAfter string) error {
+		h := make(http.Header)
+		h.Set("Retry-After", retryAfter)
+		return &googleapi.Error{Code: code, Header: h}
+	}
+	for _, test := range []struct {
+		fn    string
+		err   error
+		retry bool
+		after time.Duration
+	}{
+		{"gmail.Users.Messages.Get", fmt.Errorf("some error"), false, 0},
+		{"gmail.Users.Messages.Get", &googleapi.Error{Code: 404}, false, 0},
+		{"gmail.Users.Messages.Get", &googleapi.Error{Code: 400}, false, 0},
+		{"gmail.Users.Messages.Get", &googleapi.Error{Code: 429}, true, 0},
+		{"gmail.Users.Messages.Get", withHeader(429, "7"), true, 7 * time.Second},
+		{"gmail.Users.Messages.Get", errors.Wrap(withHeader(503, "2"), "wrapped"), true, 2 * time.Second},
+		{"gmail.Users.Messages.Get", &googleapi.Error{Code: 500}, true, 0},
+		{"gmail.Batch.Users.Messages.Get", &googleapi.Error{Code: 502}, true, 0},
+		{"gmail.Users.Messages.Send", &googleapi.Error{Code: 500}, false, 0},
+		{"gmail.Users.Messages.Send", &googleapi.Error{Code: 429}, true, 0},
+		{"gmail.Users.Messages.Get", &googleapi.Error{Code: 403}, false, 0},
+		{"gmail.Users.Messages.Get", &googleapi.Error{
+			Code:   403,
+			Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}},
+		}, true, 0},
+	} {
+		retry, after := retryable(test.fn, test.err)
+		if retry != test.retry || after != test.after {
+			t.Errorf("%s %v: got %v %v, want %v %v", test.fn, test.err, retry, after, test.retry, test.after)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, test := range []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", 0},
+		{"junk", 0},
+		{"-3", 0},
+		{"120", 2 * time.Minute},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{now.Add(-30 * time.Second).Format(http.TimeFormat), 0},
+	} {
+		if got := parseRetryAfter(test.in, now); got != test.want {
+			t.Errorf("parseRetryAfter(%q): got %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		d := backoff(attempt)
+		max := retryBaseDelay << uint(attempt)
+		if max > retryMaxDelay || max <= 0 {
+			max = retryMaxDelay
+		}
+		if d < max/2 || d > max {
+			t.Errorf("backoff(%d) = %v, want in [%v,%v]", attempt, d, max/2, max)
+		}
+	}
+}
+
+func TestQuotaLimiter(t *testing.T) {
+	q := newQuotaLimiter(100, 100)
+	now := q.last
+	if d := q.reserve(now, 50); d != 0 {
+		t.Errorf("Within burst: got wait %v", d)
+	}
+	if d := q.reserve(now, 100); d != 500*time.Millisecond {
+		t.Errorf("Over burst: got wait %v, want 500ms", d)
+	}
+	// One second later 100 units have come back, but there was a 50 debt.
+	if d := q.reserve(now.Add(time.Second), 100); d != 500*time.Millisecond {
+		t.Errorf("After refill: got wait %v, want 500ms", d)
+	}
+	// Never refills above the burst.
+	if d := q.reserve(now.Add(time.Hour), 100); d != 0 {
+		t.Errorf("After long idle: got wait %v", d)
+	}
+	if d := q.reserve(now.Add(time.Hour), 1); d != 10*time.Millisecond {
+		t.Errorf("After long idle, over burst: got wait %v, want 10ms", d)
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c, err := NewFake(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	st := time.Now()
+	err = c.wrapLogRPC(ctx, "test", func() error {
+		calls++
+		return &googleapi.Error{Code: 503}
+	}, "")
+	if e, ok := err.(*googleapi.Error); !ok || e.Code != 503 {
+		t.Errorf("Got error %v, want the RPC's", err)
+	}
+	if calls != 1 {
+		t.Errorf("Got %d calls, want 1", calls)
+	}
+	// First backoff is at least retryBaseDelay/2.
+	if d := time.Since(st); d >= retryBaseDelay/2 {
+		t.Errorf("Backoff not cut short by context, took %v", d)
+	}
+
+	q := newQuotaLimiter(1, 1)
+	q.reserve(time.Now(), 100)
+	if err := q.wait(ctx, "test", 1); err != context.DeadlineExceeded {
+		t.Errorf("Quota wait returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRetryPages(t *testing.T) {
+	var m sync.Mutex
+	failed := make(map[string]bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/me/drafts/") {
+			// Loading of the listed drafts.
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": 404, "message": "Not Found"}}`)
+			return
+		}
+		// Second page fails once.
+		if r.FormValue("pageToken") == "2" && !failed[r.URL.Path] {
+			failed[r.URL.Path] = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error": {"code": 503, "message": "Backend Error"}}`)
+			return
+		}
+		var resp interface{}
+		switch r.URL.Path + "/" + r.FormValue("pageToken") {
+		case "/me/history/":
+			resp = &gmail.ListHistoryResponse{HistoryId: 10, NextPageToken: "2", History: []*gmail.History{{Id: 1}}}
+		case "/me/history/2":
+			resp = &gmail.ListHistoryResponse{HistoryId: 20, History: []*gmail.History{{Id: 2}}}
+		case "/me/drafts/":
+			resp = &gmail.ListDraftsResponse{NextPageToken: "2", Drafts: []*gmail.Draft{{Id: "a"}}}
+		case "/me/drafts/2":
+			resp = &gmail.ListDraftsResponse{Drafts: []*gmail.Draft{{Id: "b"}}}
+		default:
+			t.Errorf("Unexpected request for %q", r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+	c, err := NewFake(ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.gmail.BasePath = ts.URL + "/"
+	ctx := context.Background()
+
+	hists, h, err := c.History(ctx, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint64
+	for _, hist := range hists {
+		ids = append(ids, hist.Id)
+	}
+	if got, want := fmt.Sprint(ids), "[1 2]"; got != want || h != 20 {
+		t.Errorf("Got history %s at %d, want %s at 20", got, h, want)
+	}
+
+	drafts, err := c.ListDrafts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dids []string
+	for _, d := range drafts {
+		dids = append(dids, d.ID)
+	}
+	if got, want := fmt.Sprint(dids), "[a b]"; got != want {
+		t.Errorf("Got drafts %s, want %s", got, want)
+	}
+}
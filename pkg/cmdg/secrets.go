@@ -0,0 +1,460 @@
+package cmdg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	secretFile    = "file"
+	secretCommand = "command"
+	secretKeyring = "keyring"
+
+	tokenFileExt = ".token"
+
+	// scrypt parameters for passphrase encrypted token files.
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+var (
+	secretStoreFlag = flag.String("secret_store", "", "Where to store the OAuth refresh token when configuring or migrating: "+
+		"'file' (passphrase encrypted), 'command' (e.g. pass), or 'keyring' (Secret Service, using secret-tool). Default is in the config file.")
+	secretFileFlag   = flag.String("secret_file", "", "Passphrase encrypted token file. Default is next to the config file.")
+	secretGetCmd     = flag.String("secret_get_command", "", "Shell command that prints the refresh token. E.g. 'pass show cmdg'.")
+	secretStoreCmd   = flag.String("secret_store_command", "", "Shell command that stores the refresh token read from stdin. E.g. 'pass insert -m cmdg'.")
+	secretDeleteCmd  = flag.String("secret_delete_command", "", "Shell command that deletes the refresh token. E.g. 'pass rm -f cmdg'.")
+	secretToolBinary = flag.String("secret_tool", "secret-tool", "Path to secret-tool, for the keyring secret store.")
+
+	revokeURL         = "https://oauth2.googleapis.com/revoke"
+	errNoRefreshToken = fmt.Errorf("no refresh token")
+
+	// Passphrase asks the user for the passphrase for the encrypted token file.
+	// Replaced by the UI once it's running.
+	Passphrase = terminalPassphrase
+)
+
+// ConfigSecret says where the refresh token is stored, when not in the config file.
+type ConfigSecret struct {
+	// Type is "file", "command", or "keyring".
+	Type string
+
+	// File is the passphrase encrypted token file.
+	File string `json:",omitempty"`
+
+	// Shell commands to get, store, and delete the token.
+	GetCommand    string `json:",omitempty"`
+	StoreCommand  string `json:",omitempty"`
+	DeleteCommand string `json:",omitempty"`
+
+	// Account is used to look up the token in the keyring.
+	Account string `json:",omitempty"`
+}
+
+// SecretStore stores the refresh token somewhere other than the config file.
+type SecretStore interface {
+	Get() (string, error)
+	Set(string) error
+	Delete() error
+}
+
+// terminalPassphrase reads a passphrase from the terminal, without echo.
+func terminalPassphrase(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", fmt.Errorf("need passphrase, but stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	b, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(b), err
+}
+
+// newSecretStore returns the store for the config.
+func newSecretStore(s *ConfigSecret) (SecretStore, error) {
+	switch s.Type {
+	case secretFile:
+		return &fileSecret{fn: s.File}, nil
+	case secretCommand:
+		return &commandSecret{get: s.GetCommand, store: s.StoreCommand, del: s.DeleteCommand}, nil
+	case secretKeyring:
+		return &keyringSecret{account: s.Account}, nil
+	}
+	return nil, fmt.Errorf("unknown secret store type %q", s.Type)
+}
+
+// secretConfigFromFlags returns the secret store config the flags ask for,
+// or nil to store the token in the config file.
+func secretConfigFromFlags(fn string) (*ConfigSecret, error) {
+	account := strings.TrimSuffix(path.Base(fn), path.Ext(fn))
+	switch *secretStoreFlag {
+	case "":
+		return nil, nil
+	case secretFile:
+		f := *secretFileFlag
+		if f == "" {
+			f = strings.TrimSuffix(fn, path.Ext(fn)) + tokenFileExt
+		}
+		return &ConfigSecret{Type: secretFile, File: f}, nil
+	case secretCommand:
+		if *secretGetCmd == "" || *secretStoreCmd == "" {
+			return nil, fmt.Errorf("-secret_store=command needs -secret_get_command and -secret_store_command")
+		}
+		return &ConfigSecret{
+			Type:          secretCommand,
+			GetCommand:    *secretGetCmd,
+			StoreCommand:  *secretStoreCmd,
+			DeleteCommand: *secretDeleteCmd,
+		}, nil
+	case secretKeyring:
+		return &ConfigSecret{Type: secretKeyring, Account: account}, nil
+	}
+	return nil, fmt.Errorf("unknown -secret_store %q", *secretStoreFlag)
+}
+
+// encryptedToken is the on-disk format of the passphrase encrypted token.
+type encryptedToken struct {
+	Salt  []byte
+	Nonce []byte
+	Box   []byte
+}
+
+func tokenKey(passphrase string, salt []byte) (*[32]byte, error) {
+	k, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], k)
+	return &key, nil
+}
+
+func encryptToken(token, passphrase string) ([]byte, error) {
+	e := encryptedToken{Salt: make([]byte, 16), Nonce: make([]byte, 24)}
+	if _, err := rand.Read(e.Salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	key, err := tokenKey(passphrase, e.Salt)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], e.Nonce)
+	e.Box = secretbox.Seal(nil, []byte(token), &nonce, key)
+	return json.Marshal(&e)
+}
+
+func decryptToken(data []byte, passphrase string) (string, error) {
+	var e encryptedToken
+	if err := json.Unmarshal(data, &e); err != nil {
+		return "", errors.Wrap(err, "corrupt token file")
+	}
+	if len(e.Nonce) != 24 {
+		return "", fmt.Errorf("corrupt token file: nonce is %d bytes", len(e.Nonce))
+	}
+	key, err := tokenKey(passphrase, e.Salt)
+	if err != nil {
+		return "", err
+	}
+	var nonce [24]byte
+	copy(nonce[:], e.Nonce)
+	b, ok := secretbox.Open(nil, e.Box, &nonce, key)
+	if !ok {
+		return "", fmt.Errorf("wrong passphrase, or corrupt token file")
+	}
+	return string(b), nil
+}
+
+// fileSecret is a passphrase encrypted file.
+type fileSecret struct {
+	fn string
+}
+
+func (f *fileSecret) Get() (string, error) {
+	b, err := ioutil.ReadFile(f.fn)
+	if err != nil {
+		return "", err
+	}
+	pass, err := Passphrase(fmt.Sprintf("Passphrase for %s: ", f.fn))
+	if err != nil {
+		return "", err
+	}
+	return decryptToken(b, pass)
+}
+
+func (f *fileSecret) Set(token string) error {
+	pass, err := Passphrase(fmt.Sprintf("New passphrase for %s: ", f.fn))
+	if err != nil {
+		return err
+	}
+	again, err := Passphrase("Repeat passphrase: ")
+	if err != nil {
+		return err
+	}
+	if pass != again {
+		return fmt.Errorf("passphrases don't match")
+	}
+	if pass == "" {
+		return fmt.Errorf("empty passphrase")
+	}
+	b, err := encryptToken(token, pass)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.fn, b)
+}
+
+func (f *fileSecret) Delete() error {
+	if err := os.Remove(f.fn); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// runShell runs the shell command, with `stdin` as input, and returns its output.
+func runShell(cmd, stdin string) (string, error) {
+	c := exec.Command("/bin/sh", "-c", cmd)
+	c.Stdin = strings.NewReader(stdin)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "running %q: %s", cmd, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// commandSecret runs external commands, such as `pass`.
+type commandSecret struct {
+	get, store, del string
+}
+
+func (c *commandSecret) Get() (string, error) {
+	s, err := runShell(c.get, "")
+	if err != nil {
+		return "", err
+	}
+	// First line only, like `pass` convention.
+	return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0]), nil
+}
+
+func (c *commandSecret) Set(token string) error {
+	_, err := runShell(c.store, token+"\n")
+	return err
+}
+
+func (c *commandSecret) Delete() error {
+	if c.del == "" {
+		log.Warningf("No delete command configured. Remove the token yourself")
+		return nil
+	}
+	_, err := runShell(c.del, "")
+	return err
+}
+
+// keyringSecret uses the Secret Service D-Bus API, through secret-tool.
+type keyringSecret struct {
+	account string
+}
+
+func (k *keyringSecret) attrs() []string {
+	return []string{"service", "cmdg", "account", k.account}
+}
+
+func (k *keyringSecret) run(stdin string, args ...string) (string, error) {
+	c := exec.Command(*secretToolBinary, append(args, k.attrs()...)...)
+	c.Stdin = strings.NewReader(stdin)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "running %s %s: %s", *secretToolBinary, args[0], strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+func (k *keyringSecret) Get() (string, error) {
+	s, err := k.run("", "lookup")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(s), nil
+}
+
+func (k *keyringSecret) Set(token string) error {
+	_, err := k.run(token, "store", "--label=cmdg refresh token for "+k.account)
+	return err
+}
+
+func (k *keyringSecret) Delete() error {
+	_, err := k.run("", "clear")
+	return err
+}
+
+// readConfig reads and parses the config file.
+func readConfig(fn string) (*Config, error) {
+	f, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var conf Config
+	if err := json.Unmarshal(f, &conf); err != nil {
+		return nil, errors.Wrapf(err, "unmarshalling config")
+	}
+	return &conf, nil
+}
+
+// writeConfig writes the config file, readable only by the user.
+func writeConfig(fn string, conf *Config) error {
+	b, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(fn), 0700); err != nil {
+		return errors.Wrapf(err, "creating config directory %q", path.Dir(fn))
+	}
+	if err := writeFileAtomic(fn, b); err != nil {
+		return err
+	}
+	return os.Chmod(fn, 0600)
+}
+
+// refreshToken returns the refresh token from wherever it's stored.
+func (conf *Config) refreshToken() (string, error) {
+	if conf.Secret == nil {
+		return conf.OAuth.RefreshToken, nil
+	}
+	s, err := newSecretStore(conf.Secret)
+	if err != nil {
+		return "", err
+	}
+	t, err := s.Get()
+	if err != nil {
+		return "", errors.Wrapf(err, "getting refresh token from %s store", conf.Secret.Type)
+	}
+	if t == "" {
+		return "", errNoRefreshToken
+	}
+	return t, nil
+}
+
+// storeToken puts the refresh token in the store asked for by flags.
+func storeToken(fn string, conf *Config, token string) error {
+	sc, err := secretConfigFromFlags(fn)
+	if err != nil {
+		return err
+	}
+	if sc == nil {
+		conf.OAuth.RefreshToken = token
+		conf.Secret = nil
+		return nil
+	}
+	s, err := newSecretStore(sc)
+	if err != nil {
+		return err
+	}
+	if err := s.Set(token); err != nil {
+		return errors.Wrapf(err, "storing refresh token in %s store", sc.Type)
+	}
+	conf.OAuth.RefreshToken = ""
+	conf.OAuth.AccessToken = ""
+	conf.Secret = sc
+	return nil
+}
+
+// MigrateSecret moves the refresh token from the config file into the
+// secret store given by flags.
+func MigrateSecret(fn string) error {
+	conf, err := readConfig(fn)
+	if err != nil {
+		return err
+	}
+	if conf.Secret != nil {
+		return fmt.Errorf("refresh token is already in a %s store", conf.Secret.Type)
+	}
+	if conf.OAuth.RefreshToken == "" {
+		return errNoRefreshToken
+	}
+	if *secretStoreFlag == "" {
+		return fmt.Errorf("need -secret_store to migrate to")
+	}
+	if err := storeToken(fn, conf, conf.OAuth.RefreshToken); err != nil {
+		return err
+	}
+	return writeConfig(fn, conf)
+}
+
+// revokeToken asks Google to invalidate the token.
+func revokeToken(client *http.Client, token string) error {
+	resp, err := client.PostForm(revokeURL, url.Values{"token": {token}})
+	if err != nil {
+		return errors.Wrap(err, "revoking token")
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	// Already revoked or expired is fine.
+	if resp.StatusCode == http.StatusBadRequest && strings.Contains(string(b), "invalid_token") {
+		log.Warningf("Token was already invalid")
+		return nil
+	}
+	return fmt.Errorf("revoking token: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+}
+
+// Logout revokes the refresh token, and wipes it from the config and secret store.
+func Logout(fn string) error {
+	conf, err := readConfig(fn)
+	if err != nil {
+		return err
+	}
+	token, err := conf.refreshToken()
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return errNoRefreshToken
+	}
+	tp, err := proxyTransport()
+	if err != nil {
+		return err
+	}
+	if err := revokeToken(&http.Client{Transport: tp}, token); err != nil {
+		return err
+	}
+	if conf.Secret != nil {
+		s, err := newSecretStore(conf.Secret)
+		if err != nil {
+			return err
+		}
+		if err := s.Delete(); err != nil {
+			return errors.Wrapf(err, "deleting refresh token from %s store", conf.Secret.Type)
+		}
+		conf.Secret = nil
+	}
+	conf.OAuth.RefreshToken = ""
+	conf.OAuth.AccessToken = ""
+	return writeConfig(fn, conf)
+}
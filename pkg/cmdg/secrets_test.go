@@ -0,0 +1,153 @@
+package cmdg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEncryptToken(t *testing.T) {
+	b, err := encryptToken("the-token", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "the-token") {
+		t.Errorf("Token in plaintext: %s", b)
+	}
+	if got, err := decryptToken(b, "secret"); err != nil {
+		t.Error(err)
+	} else if got != "the-token" {
+		t.Errorf("Got %q, want %q", got, "the-token")
+	}
+	if _, err := decryptToken(b, "wrong"); err == nil {
+		t.Errorf("Wrong passphrase worked")
+	}
+}
+
+func withPassphrases(t *testing.T, ps ...string) func() {
+	old := Passphrase
+	Passphrase = func(string) (string, error) {
+		if len(ps) == 0 {
+			t.Fatal("Too many passphrase prompts")
+		}
+		p := ps[0]
+		ps = ps[1:]
+		return p, nil
+	}
+	return func() { Passphrase = old }
+}
+
+func TestMigrateSecretFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "cmdg.conf")
+	if err := writeConfig(fn, &Config{OAuth: ConfigOAuth{ClientID: "id", RefreshToken: "the-token"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	oldFlag := *secretStoreFlag
+	*secretStoreFlag = secretFile
+	defer func() { *secretStoreFlag = oldFlag }()
+
+	// Mismatched passphrases.
+	restore := withPassphrases(t, "a", "b")
+	if err := MigrateSecret(fn); err == nil {
+		t.Errorf("Migrated with mismatched passphrase")
+	}
+	restore()
+
+	restore = withPassphrases(t, "pass", "pass")
+	if err := MigrateSecret(fn); err != nil {
+		t.Fatal(err)
+	}
+	restore()
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "the-token") {
+		t.Errorf("Token still in config: %s", b)
+	}
+	conf, err := readConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Secret == nil || conf.Secret.File != path.Join(dir, "cmdg.token") {
+		t.Fatalf("Bad secret config: %+v", conf.Secret)
+	}
+
+	defer withPassphrases(t, "pass")()
+	if got, err := conf.refreshToken(); err != nil {
+		t.Error(err)
+	} else if got != "the-token" {
+		t.Errorf("Got %q, want %q", got, "the-token")
+	}
+	if err := MigrateSecret(fn); err == nil {
+		t.Errorf("Migrated twice")
+	}
+}
+
+func TestCommandSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "token")
+	s := &commandSecret{
+		get:   "cat " + fn,
+		store: "cat > " + fn,
+		del:   "rm " + fn,
+	}
+	if err := s.Set("the-token"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get(); err != nil {
+		t.Error(err)
+	} else if got != "the-token" {
+		t.Errorf("Got %q, want %q", got, "the-token")
+	}
+	if err := s.Delete(); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.Get(); err == nil {
+		t.Errorf("Get after delete succeeded")
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	for _, test := range []struct {
+		code int
+		body string
+		err  bool
+	}{
+		{code: 200, body: "{}"},
+		{code: 400, body: `{"error": "invalid_token"}`},
+		{code: 500, body: "oops", err: true},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if got := r.FormValue("token"); got != "the-token" {
+				t.Errorf("Revoking %q, want %q", got, "the-token")
+			}
+			w.WriteHeader(test.code)
+			fmt.Fprint(w, test.body)
+		}))
+		old := revokeURL
+		revokeURL = ts.URL
+		err := revokeToken(ts.Client(), "the-token")
+		revokeURL = old
+		ts.Close()
+		if got := err != nil; got != test.err {
+			t.Errorf("Status %d: got error %v, want error: %v", test.code, err, test.err)
+		}
+	}
+}
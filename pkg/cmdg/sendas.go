@@ -0,0 +1,167 @@
+package cmdg
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+var (
+	manyNewlinesRE = regexp.MustCompile(`\n{3,}`)
+)
+
+// Identity is an address the user can send as. The primary address, or a send-as alias.
+type Identity struct {
+	Email     string
+	Name      string
+	Signature string // Plain text.
+	Default   bool
+	Primary   bool
+}
+
+// From returns the identity formatted for the From header.
+func (i *Identity) From() string {
+	if i.Name == "" {
+		return i.Email
+	}
+	return fmt.Sprintf(`%s <%s>`, quoteNameIfNeeded(i.Name), i.Email)
+}
+
+// htmlToText turns an HTML signature or vacation text into plain text.
+func htmlToText(s string) string {
+	var out strings.Builder
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.TrimSpace(manyNewlinesRE.ReplaceAllString(out.String(), "\n\n"))
+		case html.TextToken:
+			out.Write(z.Text())
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			tn, _ := z.TagName()
+			switch string(tn) {
+			case "br", "p", "div", "tr", "li":
+				out.WriteString("\n")
+			}
+		}
+	}
+}
+
+// LoadSendAs loads all identities the user can send as.
+func (c *CmdG) LoadSendAs(ctx context.Context) error {
+	var r *gmail.ListSendAsResponse
+	err := c.wrapLogRPC(ctx, "gmail.Users.Settings.SendAs.List", func() (err error) {
+		r, err = c.gmail.Users.Settings.SendAs.List(email).Context(ctx).Do()
+		return
+	}, "email=%q", email)
+	if err != nil {
+		return errors.Wrap(err, "listing send-as identities")
+	}
+	var ids []*Identity
+	for _, s := range r.SendAs {
+		if !s.IsPrimary && s.VerificationStatus != "" && s.VerificationStatus != "accepted" {
+			log.Infof("Skipping unverified send-as address %q", s.SendAsEmail)
+			continue
+		}
+		ids = append(ids, &Identity{
+			Email:     s.SendAsEmail,
+			Name:      s.DisplayName,
+			Signature: htmlToText(s.Signature),
+			Default:   s.IsDefault,
+			Primary:   s.IsPrimary,
+		})
+	}
+	// Default first, then alphabetical.
+	sort.SliceStable(ids, func(i, j int) bool {
+		if ids[i].Default != ids[j].Default {
+			return ids[i].Default
+		}
+		return ids[i].Email < ids[j].Email
+	})
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.identities = ids
+	return nil
+}
+
+// Identities returns all identities the user can send as, default first.
+func (c *CmdG) Identities() []*Identity {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.identities
+}
+
+// DefaultIdentity returns the identity to use if nothing else is known. nil if not loaded.
+func (c *CmdG) DefaultIdentity() *Identity {
+	ids := c.Identities()
+	if len(ids) == 0 {
+		return nil
+	}
+	return ids[0]
+}
+
+// IsOwnAddress returns true if the email address is one of the user's identities.
+func (c *CmdG) IsOwnAddress(addr string) bool {
+	for _, i := range c.Identities() {
+		if strings.EqualFold(i.Email, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IdentityFor returns the first identity addressed in any of the given address lists,
+// or the default identity if none is.
+func (c *CmdG) IdentityFor(lists ...string) *Identity {
+	for _, l := range lists {
+		for _, a := range parseAddressList(l) {
+			for _, i := range c.Identities() {
+				if strings.EqualFold(i.Email, a.Address) {
+					return i
+				}
+			}
+		}
+	}
+	return c.DefaultIdentity()
+}
+
+// IdentityFor returns the identity that the message was sent to, so it can be replied from.
+func (msg *Message) IdentityFor(ctx context.Context) *Identity {
+	var lists []string
+	for _, h := range []string{"Delivered-To", "To", "CC"} {
+		if s, err := msg.GetHeader(ctx, h); err == nil {
+			lists = append(lists, s)
+		}
+	}
+	return msg.conn.IdentityFor(lists...)
+}
+
+// parseAddressList parses an address list, skipping (and logging) any garbage.
+func parseAddressList(s string) []*mail.Address {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	as, err := mail.ParseAddressList(s)
+	if err == nil {
+		return as
+	}
+	// Try one by one, in case only some are broken.
+	var ret []*mail.Address
+	for _, p := range strings.Split(s, ",") {
+		a, err := mail.ParseAddress(p)
+		if err != nil {
+			log.Warningf("Failed to parse address %q: %v", p, err)
+			continue
+		}
+		ret = append(ret, a)
+	}
+	return ret
+}
@@ -0,0 +1,41 @@
+package cmdg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHTMLToText(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"Plain", "Plain"},
+		{"<div>Thomas</div><div>Example &amp; Co</div>", "Thomas\n\nExample & Co"},
+		{"Line one<br>Line two<br/>", "Line one\nLine two"},
+		{`<p><a href="https://example.com">example.com</a></p>`, "example.com"},
+	} {
+		if got := htmlToText(test.in); got != test.want {
+			t.Errorf("htmlToText(%q): got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestFilteredEmails(t *testing.T) {
+	own := func(s string) bool {
+		return strings.EqualFold(s, "me@example.com") || strings.EqualFold(s, "alias@example.org")
+	}
+	got := filteredEmails("Bob <bob@example.com>", []string{
+		`"Smith, Alice" <alice@example.com>, Me <ME@example.com>`,
+		"bob@example.com, carol@example.com",
+		"alias@example.org, Alice <ALICE@example.com>",
+	}, own)
+	want := []string{
+		`"Smith, Alice" <alice@example.com>`,
+		"carol@example.com",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
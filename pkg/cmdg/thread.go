@@ -0,0 +1,210 @@
+package cmdg
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// Thread is a conversation. A list of messages.
+type Thread struct {
+	m        sync.RWMutex
+	conn     *CmdG
+	level    DataLevel
+	messages []*Message
+
+	ID       ThreadID
+	Response *gmail.Thread
+}
+
+// ThreadCache returns the thread from the cache, adding it if not already there.
+func (c *CmdG) ThreadCache(t *Thread) *Thread {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if t2, found := c.threadCache[t.ID]; found {
+		return t2
+	}
+	c.threadCache[t.ID] = t
+	return t
+}
+
+func newThread(c *CmdG, id ThreadID) *Thread {
+	return c.ThreadCache(&Thread{
+		conn: c,
+		ID:   id,
+	})
+}
+
+// GetThread returns a thread with at least message metadata loaded.
+func (c *CmdG) GetThread(ctx context.Context, id ThreadID) (*Thread, error) {
+	t := newThread(c, id)
+	if err := t.Preload(ctx, LevelMetadata); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ReloadThread returns a thread with message metadata freshly loaded,
+// e.g. because history says its labels or messages have changed.
+func (c *CmdG) ReloadThread(ctx context.Context, id ThreadID) (*Thread, error) {
+	t := newThread(c, id)
+	if err := t.Reload(ctx, LevelMetadata); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListThreads lists threads in a given label or query, with optional page token.
+func (c *CmdG) ListThreads(ctx context.Context, label, query, token string) (*ThreadPage, error) {
+	const fields = "threads,resultSizeEstimate,nextPageToken"
+	nres := int64(pageSize)
+
+	q := c.gmail.Users.Threads.List(email).
+		PageToken(token).
+		MaxResults(nres).
+		Context(ctx).
+		Fields(fields)
+	if query != "" {
+		q = q.Q(query)
+	}
+	if label != "" {
+		q = q.LabelIds(label)
+	}
+	var res *gmail.ListThreadsResponse
+	err := c.wrapLogRPC(ctx, "gmail.Users.Threads.List", func() (err error) {
+		res, err = q.Do()
+		return
+	}, "email=%q token=%v labelID=%q query=%q size=%d fields=%q", email, token, label, query, nres, fields)
+	if err != nil {
+		return nil, err
+	}
+	p := &ThreadPage{
+		conn:     c,
+		Label:    label,
+		Query:    query,
+		Response: res,
+	}
+	for _, t := range res.Threads {
+		p.Threads = append(p.Threads, newThread(c, ThreadID(t.Id)))
+	}
+	return p, nil
+}
+
+// HasData returns if the thread has at least the given level for all messages.
+func (t *Thread) HasData(level DataLevel) bool {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return hasData(t.level, level)
+}
+
+// Preload loads the thread, unless it's already loaded.
+func (t *Thread) Preload(ctx context.Context, level DataLevel) error {
+	if t.HasData(level) {
+		return nil
+	}
+	return t.load(ctx, level)
+}
+
+// Reload unconditionally reloads the thread.
+func (t *Thread) Reload(ctx context.Context, level DataLevel) error {
+	return t.load(ctx, level)
+}
+
+func (t *Thread) load(ctx context.Context, level DataLevel) error {
+	st := time.Now()
+	var gen uint64
+	if t.conn.cache != nil {
+		gen = t.conn.cache.generation()
+	}
+	var r *gmail.Thread
+	err := t.conn.wrapLogRPC(ctx, "gmail.Users.Threads.Get", func() (err error) {
+		r, err = t.conn.gmail.Users.Threads.Get(email, string(t.ID)).
+			Format(string(level)).
+			Context(ctx).
+			Do()
+		return
+	}, "email=%q threadID=%v level=%s", email, t.ID, level)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Downloading thread %q level %q took %v", t.ID, level, time.Since(st))
+
+	var msgs []*Message
+	for _, m := range r.Messages {
+		msg := NewMessage(t.conn, m.Id)
+		if msg.HasData(level) {
+			// Don't throw away data we already have. Labels may have changed though.
+			msg.m.Lock()
+			if msg.Response != nil {
+				msg.Response.LabelIds = t.conn.journalLabels(msg.ID, m.LabelIds)
+			}
+			msg.m.Unlock()
+		} else {
+			if t.conn.cache != nil {
+				t.conn.cache.putMessage(m.Id, level, m, gen)
+			}
+			if err := msg.setResponse(ctx, m, level); err != nil {
+				return err
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.Response = r
+	t.level = level
+	t.messages = msgs
+	return nil
+}
+
+// Messages returns the messages in the thread, oldest first.
+func (t *Thread) Messages() []*Message {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return t.messages
+}
+
+// Len returns the number of messages in the thread.
+func (t *Thread) Len() int {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return len(t.messages)
+}
+
+// Last returns the most recent message in the thread, or nil if not loaded.
+func (t *Thread) Last() *Message {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	if len(t.messages) == 0 {
+		return nil
+	}
+	return t.messages[len(t.messages)-1]
+}
+
+// MessageIDs returns the IDs of all messages in the thread.
+func (t *Thread) MessageIDs() []string {
+	var ret []string
+	for _, m := range t.Messages() {
+		ret = append(ret, m.ID)
+	}
+	return ret
+}
+
+// HasLabel returns true if any message in the thread has the label.
+func (t *Thread) HasLabel(labelID string) bool {
+	for _, m := range t.Messages() {
+		if m.HasLabel(labelID) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUnread returns true if any message in the thread is unread.
+func (t *Thread) IsUnread() bool {
+	return t.HasLabel(Unread)
+}
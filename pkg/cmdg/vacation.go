@@ -0,0 +1,74 @@
+package cmdg
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// GetVacation gets the vacation responder settings.
+func (c *CmdG) GetVacation(ctx context.Context) (*gmail.VacationSettings, error) {
+	var v *gmail.VacationSettings
+	err := c.wrapLogRPC(ctx, "gmail.Users.Settings.GetVacation", func() (err error) {
+		v, err = c.gmail.Users.Settings.GetVacation(email).Context(ctx).Do()
+		return
+	}, "email=%q", email)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting vacation settings")
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.vacation = v
+	return v, nil
+}
+
+// VacationText returns the responder text as plain text. If only
+// the HTML version is set, that's converted.
+func VacationText(v *gmail.VacationSettings) string {
+	if v.ResponseBodyPlainText == "" && v.ResponseBodyHtml != "" {
+		return htmlToText(v.ResponseBodyHtml)
+	}
+	return v.ResponseBodyPlainText
+}
+
+// UpdateVacation sets the vacation responder settings.
+func (c *CmdG) UpdateVacation(ctx context.Context, v *gmail.VacationSettings) error {
+	if err := c.CheckWrite("changing vacation responder"); err != nil {
+		return err
+	}
+	// Send false and zero values too, or they won't be changed.
+	v.ForceSendFields = []string{"EnableAutoReply", "RestrictToContacts", "RestrictToDomain", "StartTime", "EndTime", "ResponseSubject", "ResponseBodyPlainText", "ResponseBodyHtml"}
+	v.NullFields = nil
+	var r *gmail.VacationSettings
+	err := c.wrapLogRPC(ctx, "gmail.Users.Settings.UpdateVacation", func() (err error) {
+		r, err = c.gmail.Users.Settings.UpdateVacation(email, v).Context(ctx).Do()
+		return
+	}, "email=%q enabled=%v start=%d end=%d", email, v.EnableAutoReply, v.StartTime, v.EndTime)
+	if err != nil {
+		return errors.Wrap(err, "updating vacation settings")
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.vacation = r
+	return nil
+}
+
+// VacationActive returns true if the vacation responder, as last loaded, is replying at time `now`.
+func (c *CmdG) VacationActive(now time.Time) bool {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	v := c.vacation
+	if v == nil || !v.EnableAutoReply {
+		return false
+	}
+	ms := now.UnixNano() / int64(time.Millisecond)
+	if v.StartTime != 0 && ms < v.StartTime {
+		return false
+	}
+	if v.EndTime != 0 && ms >= v.EndTime {
+		return false
+	}
+	return true
+}
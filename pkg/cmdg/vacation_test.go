@@ -0,0 +1,23 @@
+package cmdg
+
+import (
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestVacationText(t *testing.T) {
+	for _, test := range []struct {
+		v    gmail.VacationSettings
+		want string
+	}{
+		{gmail.VacationSettings{}, ""},
+		{gmail.VacationSettings{ResponseBodyPlainText: "Away"}, "Away"},
+		{gmail.VacationSettings{ResponseBodyPlainText: "Away", ResponseBodyHtml: "<b>Gone</b>"}, "Away"},
+		{gmail.VacationSettings{ResponseBodyHtml: "<div>Away until <b>Monday</b>.</div><div>Thanks</div>"}, "Away until Monday.\n\nThanks"},
+	} {
+		if got := VacationText(&test.v); got != test.want {
+			t.Errorf("VacationText(%+v): got %q, want %q", test.v, got, test.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package dialog
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/mattn/go-runewidth"
@@ -23,6 +24,16 @@ type Option struct {
 	Key    string
 	KeyInt int
 	Label  string
+
+	// Keywords are also matched when filtering, but not shown.
+	Keywords []string
+
+	// Score ranks matching options. Highest first.
+	Score float64
+
+	// Display is shown instead of the label, if set. E.g. the label
+	// with colors. Matching is still done on the label.
+	Display string
 }
 
 // String gives string representation usable for showing to the user.
@@ -33,6 +44,14 @@ func (o *Option) String() string {
 	return o.Label
 }
 
+// display returns what to show for the option in a selection.
+func (o *Option) display() string {
+	if o.Display != "" {
+		return o.Display
+	}
+	return o.String()
+}
+
 // Message shows a message that's dismissed by pressing enter.
 // Should not fail, but if it's important checking error value is optional.
 // Any errors are logged.
@@ -144,17 +163,46 @@ func Question(title string, opts []Option, keys *input.Input) (string, error) {
 	}
 }
 
+// matches returns true if the lower case filter string is a substring
+// of the option or any of its keywords.
+func (o *Option) matches(filter string) bool {
+	if strings.Contains(strings.ToLower(o.String()), filter) {
+		return true
+	}
+	for _, k := range o.Keywords {
+		if strings.Contains(strings.ToLower(k), filter) {
+			return true
+		}
+	}
+	return false
+}
+
 // filterSubmatch filters out all options not matching input. Case insensitive.
 func filterSubmatch(opts []*Option, filter string) []*Option {
 	var ret []*Option
+	filter = strings.ToLower(filter)
 	for _, o := range opts {
-		if strings.Contains(strings.ToLower(o.String()), strings.ToLower(filter)) {
+		if o.matches(filter) {
 			ret = append(ret, o)
 		}
 	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Score > ret[j].Score
+	})
 	return ret
 }
 
+// hasExact returns true if one of the options is exactly the input,
+// ignoring case.
+func hasExact(opts []*Option, in string) bool {
+	for _, o := range opts {
+		if strings.EqualFold(o.String(), in) {
+			return true
+		}
+	}
+	return false
+}
+
 // Strings2Options takes a slice of strings and turns them into Options.
 func Strings2Options(ss []string) []*Option {
 	var ret []*Option
@@ -193,6 +241,15 @@ func TrimOneChar(s string) string {
 // Entry asks for a free-form input.
 // Example: Search.
 func Entry(prompt string, keys *input.Input) (string, error) {
+	return entry(prompt, false, keys)
+}
+
+// Password is like Entry, but doesn't show what's typed.
+func Password(prompt string, keys *input.Input) (string, error) {
+	return entry(prompt, true, keys)
+}
+
+func entry(prompt string, hide bool, keys *input.Input) (string, error) {
 	screen, err := display.NewScreen()
 	if err != nil {
 		return "", err
@@ -203,7 +260,11 @@ func Entry(prompt string, keys *input.Input) (string, error) {
 	defer keys.PastePop()
 	for {
 		start := 3
-		content := fmt.Sprintf("%s%s%s%s%s", prefix, display.Bold, prompt, display.Reset, cur)
+		shown := cur
+		if hide {
+			shown = strings.Repeat("*", display.StringWidth(cur))
+		}
+		content := fmt.Sprintf("%s%s%s%s%s", prefix, display.Bold, prompt, display.Reset, shown)
 		screen.Printlnf(start+2, "%s", content)
 		screen.SetCursor(start+2, display.StringWidth(content)+1)
 		screen.Draw()
@@ -229,15 +290,28 @@ func Entry(prompt string, keys *input.Input) (string, error) {
 // If `free` is `true` then the user can input anything. If `false` then the options listed are the only valid ones.
 // Example: Email recipient choice.
 func Selection(opts []*Option, prompt string, free bool, keys *input.Input) (*Option, error) {
+	o, _, err := selection(opts, prompt, free, false, keys)
+	return o, err
+}
+
+// SelectionNew is like Selection without free input, except that if the
+// typed text matches none of the options then it's returned as a new option.
+// The bool returned is true if the option is new.
+// Example: Label choice, with the option of creating a new label.
+func SelectionNew(opts []*Option, prompt string, keys *input.Input) (*Option, bool, error) {
+	return selection(opts, prompt, false, true, keys)
+}
+
+func selection(opts []*Option, prompt string, free, allowNew bool, keys *input.Input) (*Option, bool, error) {
 	screen, err := display.NewScreen()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	cur := ""
 	last := ""
 	selected := -1
 	scroll := 0 // TODO, implement scrolling.
-	visible := opts
+	visible := filterSubmatch(opts, "")
 	keys.PastePush(false)
 	defer keys.PastePop()
 	for {
@@ -251,33 +325,44 @@ func Selection(opts []*Option, prompt string, free bool, keys *input.Input) (*Op
 			if selected == n {
 				sstr = display.Bold + ">"
 			}
-			screen.Printlnf(n+start, "%s%s %s", prefix, sstr, o)
+			screen.Printlnf(n+start, "%s%s %s", prefix, sstr, o.display())
 		}
 
 		// Clear the area.
-		for n := len(visible); n < len(opts); n++ {
+		for n := len(visible); n <= len(opts); n++ {
 			screen.Printlnf(n+start, "")
 		}
+		canCreate := allowNew && cur != "" && !hasExact(visible, cur)
+		if canCreate {
+			sstr := display.Reset + " "
+			if selected == len(visible) {
+				sstr = display.Bold + ">"
+			}
+			screen.Printlnf(len(visible)+start, "%s%s [enter] — Create %q", prefix, sstr, cur)
+		}
 
 		screen.Draw()
 
 		key := <-keys.Chan()
 		switch key {
 		case input.Enter:
-			if selected < 0 {
-				if !free {
+			if selected < 0 || selected == len(visible) {
+				isNew := canCreate
+				if !free && !isNew {
 					continue
 				}
 				return &Option{
 					Key:   cur,
 					Label: cur,
-				}, nil
+				}, isNew, nil
 			}
-			return visible[selected], nil
+			return visible[selected], false, nil
 		case input.CtrlN:
 			selected++
-			if selected >= len(visible) {
-				selected = len(visible) - 1
+			if max := len(visible) - 1; canCreate && selected > max {
+				selected = len(visible)
+			} else if selected > max {
+				selected = max
 			}
 		case input.CtrlP:
 			selected--
@@ -285,7 +370,7 @@ func Selection(opts []*Option, prompt string, free bool, keys *input.Input) (*Op
 				selected = 0
 			}
 		case input.CtrlC:
-			return nil, ErrAborted
+			return nil, false, ErrAborted
 		case input.Backspace, input.CtrlH:
 			cur = TrimOneChar(cur)
 		case input.CtrlU:
@@ -26,6 +26,9 @@ func TestTrimOneChar(t *testing.T) {
 func TestFilterSubmatch(t *testing.T) {
 	a := &Option{Label: "foo"}
 	b := &Option{Label: "bar"}
+	c := &Option{Label: "Alice <alice@example.com>", Keywords: []string{"Ally", "Acme Corp"}}
+	d := &Option{Label: "bob@example.com", Score: 0.5}
+	e := &Option{Label: "tom@example.com", Score: 3}
 
 	for _, test := range []struct {
 		in     []*Option
@@ -47,9 +50,49 @@ func TestFilterSubmatch(t *testing.T) {
 			filter: "fo",
 			out:    []*Option{a},
 		},
+		{
+			in:     []*Option{a, b, c},
+			filter: "ally",
+			out:    []*Option{c},
+		},
+		{
+			in:     []*Option{a, b, c},
+			filter: "ACME",
+			out:    []*Option{c},
+		},
+		{
+			in:     []*Option{a, b, d, e},
+			filter: "o",
+			out:    []*Option{e, d, a},
+		},
+		{
+			in:     []*Option{a, b, d, e},
+			filter: "",
+			out:    []*Option{e, d, a, b},
+		},
 	} {
 		if got, want := filterSubmatch(test.in, test.filter), test.out; !reflect.DeepEqual(got, want) {
 			t.Errorf("For %q with filter %q got %q, want %q", test.in, test.filter, got, want)
 		}
 	}
 }
+
+func TestHasExact(t *testing.T) {
+	opts := []*Option{
+		{Key: "Label_1", Label: "Work"},
+		{Key: "Label_2", Label: "Work/Old", Display: "\x1b[38;2;0;0;0mWork/Old\x1b[0m"},
+	}
+	for _, test := range []struct {
+		in   string
+		want bool
+	}{
+		{"work", true},
+		{"Work/Old", true},
+		{"Wor", false},
+		{"Label_1", false},
+	} {
+		if got := hasExact(opts, test.in); got != test.want {
+			t.Errorf("hasExact(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}